@@ -0,0 +1,3 @@
+// src/routes/orders/lookup/[token]/+page.ts
+export const ssr = false;
+export const prerender = false;
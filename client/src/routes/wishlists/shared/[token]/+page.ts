@@ -0,0 +1,3 @@
+// src/routes/wishlists/shared/[token]/+page.ts
+export const ssr = false;
+export const prerender = false;
@@ -0,0 +1,426 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"server/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// Abandoned cart sweep tuning
+const (
+	cartSweepInterval   = 15 * time.Minute
+	cartSweepBatch      = 100
+	defaultAbandonAfter = 24 * time.Hour
+	// Carts idle for longer are recorded but not emailed, and orders placed
+	// later than this after detection do not count as recoveries
+	cartRecoveryWindow = 7 * 24 * time.Hour
+	// Advisory lock key so only one server sweeps at a time
+	cartSweepLock = 4501
+)
+
+// cartRecoveryEmailData - Values available to the cart recovery template
+type cartRecoveryEmailData struct {
+	StoreName   string
+	Name        string
+	Items       []emailItem
+	Subtotal    string
+	RecoveryURL string
+}
+
+// idleCart - One owner's cart that has not changed since the cutoff
+type idleCart struct {
+	UserID         *uint
+	GuestCartID    *uint
+	Items          int
+	LastActivityAt time.Time
+}
+
+// owner - The cart owner the idle cart belongs to
+func (c idleCart) owner() cartOwner {
+	if c.UserID != nil {
+		return cartOwner{UserID: *c.UserID}
+	}
+	return cartOwner{GuestCartID: *c.GuestCartID}
+}
+
+// abandonAfter - How long a cart sits untouched before it counts as abandoned,
+// ABANDONED_CART_AFTER takes a Go duration such as 6h or 90m
+func abandonAfter() time.Duration {
+	return envDuration("ABANDONED_CART_AFTER", defaultAbandonAfter)
+}
+
+// cartActivity - Last change to a cart line, rows from before updated_at
+// existed fall back to when they were added
+const cartActivity = "COALESCE(carts.updated_at, carts.added_at)"
+
+// RunCartWorker - Records abandoned carts, queues their recovery emails and
+// removes expired guest carts until the process exits, run it in its own goroutine
+func (h *HandlerContext) RunCartWorker() {
+	ticker := time.NewTicker(cartSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for {
+			found, err := h.detectAbandonedCarts(abandonAfter())
+			if err != nil {
+				log.Printf("Error detecting abandoned carts: %v", err)
+			}
+			if err != nil || found < cartSweepBatch {
+				break
+			}
+		}
+
+		if expired, err := h.expireGuestCarts(); err != nil {
+			log.Printf("Error expiring guest carts: %v", err)
+		} else if expired > 0 {
+			log.Printf("Expired %d guest carts", expired)
+		}
+	}
+}
+
+// detectAbandonedCarts - Records one batch of carts idle for longer than idle
+// that have no record for their current idle spell, returns how many were found
+func (h *HandlerContext) detectAbandonedCarts(idle time.Duration) (int, error) {
+	now := time.Now()
+
+	var carts []idleCart
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var locked bool
+		if err := tx.Raw("SELECT pg_try_advisory_xact_lock(?)", cartSweepLock).Scan(&locked).Error; err != nil || !locked {
+			return err
+		}
+
+		if err := tx.Model(&models.Cart{}).
+			Select("carts.user_id, carts.guest_cart_id, SUM(carts.quantity) AS items, MAX("+cartActivity+") AS last_activity_at").
+			Joins("LEFT JOIN guest_carts ON guest_carts.id = carts.guest_cart_id").
+			Where("carts.guest_cart_id IS NULL OR guest_carts.last_seen_at > ?", now.Add(-guestCartTTL)).
+			Group("carts.user_id, carts.guest_cart_id").
+			Having("MAX("+cartActivity+") < ?", now.Add(-idle)).
+			Having(`NOT EXISTS (SELECT 1 FROM abandoned_carts
+				WHERE abandoned_carts.user_id IS NOT DISTINCT FROM carts.user_id
+				AND abandoned_carts.guest_cart_id IS NOT DISTINCT FROM carts.guest_cart_id
+				AND abandoned_carts.last_activity_at >= MAX(` + cartActivity + `))`).
+			Order("last_activity_at").
+			Limit(cartSweepBatch).
+			Scan(&carts).Error; err != nil {
+			return err
+		}
+
+		for _, cart := range carts {
+			if err := recordAbandonedCart(tx, cart, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(carts), nil
+}
+
+// recordAbandonedCart - Saves an idle cart and queues its recovery email when
+// the owner can be reached and the cart is recent enough to be worth it
+func recordAbandonedCart(tx *gorm.DB, cart idleCart, now time.Time) error {
+	var items []models.Cart
+	if err := cart.owner().scope(tx).Preload("Product").Find(&items).Error; err != nil {
+		return err
+	}
+
+	var subtotal int64
+	var lines []emailItem
+	for _, item := range items {
+		amount := toCents(item.Product.Price) * int64(item.Quantity)
+		subtotal += amount
+		lines = append(lines, emailItem{
+			Name:     item.Product.Name,
+			Quantity: item.Quantity,
+			Amount:   formatCents(amount),
+		})
+	}
+
+	email, name, locale, err := cartContact(tx, cart)
+	if err != nil {
+		return err
+	}
+
+	abandoned := models.AbandonedCart{
+		UserID:         cart.UserID,
+		GuestCartID:    cart.GuestCartID,
+		Email:          email,
+		Items:          cart.Items,
+		Subtotal:       subtotal,
+		LastActivityAt: cart.LastActivityAt,
+		DetectedAt:     now,
+	}
+	if err := tx.Create(&abandoned).Error; err != nil {
+		return err
+	}
+
+	if email == "" || len(lines) == 0 || now.Sub(cart.LastActivityAt) > cartRecoveryWindow {
+		return nil
+	}
+
+	data := cartRecoveryEmailData{
+		StoreName:   envOr("SELLER_NAME", "Two Idiots Store"),
+		Name:        name,
+		Items:       lines,
+		Subtotal:    formatCents(subtotal),
+		RecoveryURL: storeURL("/cart/recover/" + signID("cart-recovery", abandoned.ID)),
+	}
+	subject, text, html, err := renderEmail(locale, "cart_recovery", data)
+	if err != nil {
+		log.Printf("Error rendering cart_recovery email for abandoned cart %d: %v", abandoned.ID, err)
+		return nil
+	}
+
+	job := models.EmailJob{
+		UserID:        cart.UserID,
+		Template:      "cart_recovery",
+		Locale:        locale,
+		To:            email,
+		Subject:       subject,
+		TextBody:      text,
+		HTMLBody:      html,
+		Status:        models.EmailPending,
+		NextAttemptAt: now,
+	}
+	if err := tx.Create(&job).Error; err != nil {
+		return err
+	}
+	return tx.Model(&abandoned).Update("email_job_id", job.ID).Error
+}
+
+// cartContact - Who to email about an idle cart, guests are only known by the
+// address they typed into their latest checkout quote
+func cartContact(tx *gorm.DB, cart idleCart) (email, name, locale string, err error) {
+	if cart.UserID != nil {
+		var user models.User
+		if err := tx.First(&user, *cart.UserID).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return "", "", defaultLocale, nil
+			}
+			return "", "", "", err
+		}
+		return user.Email, strings.TrimSpace(user.FirstName), emailLocale(user.Locale), nil
+	}
+
+	var quote models.CheckoutQuote
+	err = tx.Where("guest_cart_id = ? AND guest_email <> ''", *cart.GuestCartID).
+		Order("created_at DESC").
+		First(&quote).Error
+	if err == gorm.ErrRecordNotFound {
+		return "", "", defaultLocale, nil
+	}
+	if err != nil {
+		return "", "", "", err
+	}
+	return quote.GuestEmail, strings.TrimSpace(quote.GuestName), defaultLocale, nil
+}
+
+// expireGuestCarts - Deletes guest carts unseen for longer than guestCartTTL
+// along with their items, returns how many carts went
+func (h *HandlerContext) expireGuestCarts() (int64, error) {
+	var expired int64
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		stale := tx.Model(&models.GuestCart{}).Select("id").Where("last_seen_at < ?", time.Now().Add(-guestCartTTL))
+		if err := tx.Where("guest_cart_id IN (?)", stale).Delete(&models.Cart{}).Error; err != nil {
+			return err
+		}
+		result := tx.Where("last_seen_at < ?", time.Now().Add(-guestCartTTL)).Delete(&models.GuestCart{})
+		expired = result.RowsAffected
+		return result.Error
+	})
+	return expired, err
+}
+
+// markCartRecovered - Credits an order to the owner's latest open abandoned
+// cart, run inside the checkout transaction
+func markCartRecovered(tx *gorm.DB, owner cartOwner, orderID uint) error {
+	latest := owner.scope(tx.Model(&models.AbandonedCart{})).
+		Select("MAX(id)").
+		Where("recovered_at IS NULL AND detected_at > ?", time.Now().Add(-cartRecoveryWindow))
+	return tx.Model(&models.AbandonedCart{}).
+		Where("id = (?)", latest).
+		Updates(map[string]any{"recovered_at": time.Now(), "order_id": orderID}).Error
+}
+
+// RecoverCart - Follows a recovery email link, guests get their cart token back
+func (h *HandlerContext) RecoverCart(w http.ResponseWriter, r *http.Request) {
+	abandonedID, ok := parseSignedID("cart-recovery", chi.URLParam(r, "token"))
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Cart not found")
+		return
+	}
+
+	var abandoned models.AbandonedCart
+	if err := h.db.First(&abandoned, abandonedID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Cart not found")
+			return
+		}
+		log.Printf("Error fetching abandoned cart %d: %v", abandonedID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to recover cart")
+		return
+	}
+
+	if err := h.db.Model(&abandoned).Where("clicked_at IS NULL").Update("clicked_at", time.Now()).Error; err != nil {
+		log.Printf("Error recording click on abandoned cart %d: %v", abandoned.ID, err)
+	}
+
+	if abandoned.UserID != nil {
+		// Signed-in carts live on the account, the client only needs to sign in
+		respondWithJson(w, http.StatusOK, map[string]any{
+			"message":      "Sign in to continue with your cart",
+			"requiresAuth": true,
+		})
+		return
+	}
+
+	result := h.db.Model(&models.GuestCart{}).
+		Where("id = ? AND last_seen_at > ?", *abandoned.GuestCartID, time.Now().Add(-guestCartTTL)).
+		Update("last_seen_at", time.Now())
+	if result.Error != nil {
+		log.Printf("Error touching guest cart %d: %v", *abandoned.GuestCartID, result.Error)
+		respondWithError(w, http.StatusInternalServerError, "Failed to recover cart")
+		return
+	}
+	if result.RowsAffected == 0 {
+		respondWithError(w, http.StatusGone, "This cart has expired")
+		return
+	}
+
+	token := signID("guest-cart", *abandoned.GuestCartID)
+	setCartToken(w, token)
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message":   "Cart recovered",
+		"cartToken": token,
+	})
+}
+
+// GetAbandonedCarts - Lists recorded abandoned carts newest first, optionally
+// by state: open, clicked or recovered
+func (h *HandlerContext) GetAbandonedCarts(w http.ResponseWriter, r *http.Request) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		limit = 10
+	}
+	offset := (page - 1) * limit
+
+	query, err := abandonedCartRange(h.db.Model(&models.AbandonedCart{}), r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch r.URL.Query().Get("state") {
+	case "":
+	case "open":
+		query = query.Where("recovered_at IS NULL")
+	case "clicked":
+		query = query.Where("clicked_at IS NOT NULL AND recovered_at IS NULL")
+	case "recovered":
+		query = query.Where("recovered_at IS NOT NULL")
+	default:
+		respondWithError(w, http.StatusBadRequest, "Invalid state, expected open, clicked or recovered")
+		return
+	}
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		log.Printf("Error counting abandoned carts: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch abandoned carts")
+		return
+	}
+
+	var carts []models.AbandonedCart
+	if err := query.Order("detected_at DESC, id DESC").Offset(offset).Limit(limit).Find(&carts).Error; err != nil {
+		log.Printf("Error fetching abandoned carts: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch abandoned carts")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"abandonedCarts": carts,
+		"totalPages":     (int(total) + limit - 1) / limit,
+		"currentPage":    page,
+		"totalItems":     total,
+	})
+}
+
+// abandonedCartMetrics - Funnel of abandoned carts detected in a period.
+// Carts ordered without a recovery email count as organic, not recovered.
+type abandonedCartMetrics struct {
+	Detected         int64   `json:"detected"`
+	Emailed          int64   `json:"emailed"`
+	Clicked          int64   `json:"clicked"`
+	Recovered        int64   `json:"recovered"`        // Ordered after a recovery email
+	Organic          int64   `json:"organic"`          // Ordered without one
+	RecoveryRate     float64 `json:"recoveryRate"`     // Recovered out of emailed
+	AbandonedValue   int64   `json:"abandonedValue"`   // In cents, subtotal of every detected cart
+	RecoveredRevenue int64   `json:"recoveredRevenue"` // In cents, total of the orders recovered by email
+	OrganicRevenue   int64   `json:"organicRevenue"`   // In cents, total of the organic orders
+}
+
+// GetAbandonedCartMetrics - Recovery funnel for carts detected between from and to
+func (h *HandlerContext) GetAbandonedCartMetrics(w http.ResponseWriter, r *http.Request) {
+	query, err := abandonedCartRange(h.db.Model(&models.AbandonedCart{}), r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var metrics abandonedCartMetrics
+	if err := query.
+		Select(`COUNT(*) AS detected,
+			COUNT(abandoned_carts.email_job_id) AS emailed,
+			COUNT(abandoned_carts.clicked_at) AS clicked,
+			COUNT(abandoned_carts.recovered_at) FILTER (WHERE abandoned_carts.email_job_id IS NOT NULL) AS recovered,
+			COUNT(abandoned_carts.recovered_at) FILTER (WHERE abandoned_carts.email_job_id IS NULL) AS organic,
+			COALESCE(SUM(abandoned_carts.subtotal), 0) AS abandoned_value,
+			COALESCE(SUM(orders.total) FILTER (WHERE abandoned_carts.email_job_id IS NOT NULL), 0) AS recovered_revenue,
+			COALESCE(SUM(orders.total) FILTER (WHERE abandoned_carts.email_job_id IS NULL), 0) AS organic_revenue`).
+		Joins("LEFT JOIN orders ON orders.id = abandoned_carts.order_id").
+		Scan(&metrics).Error; err != nil {
+		log.Printf("Error computing abandoned cart metrics: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch abandoned cart metrics")
+		return
+	}
+	if metrics.Emailed > 0 {
+		metrics.RecoveryRate = float64(metrics.Recovered) / float64(metrics.Emailed)
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"metrics": metrics,
+	})
+}
+
+// abandonedCartRange - Limits a query to carts detected between the from and
+// to dates, both inclusive
+func abandonedCartRange(query *gorm.DB, r *http.Request) (*gorm.DB, error) {
+	if fromParam := r.URL.Query().Get("from"); fromParam != "" {
+		from, err := time.Parse(time.DateOnly, fromParam)
+		if err != nil {
+			return nil, errors.New("Invalid from date, expected YYYY-MM-DD")
+		}
+		query = query.Where("abandoned_carts.detected_at >= ?", from)
+	}
+	if toParam := r.URL.Query().Get("to"); toParam != "" {
+		to, err := time.Parse(time.DateOnly, toParam)
+		if err != nil {
+			return nil, errors.New("Invalid to date, expected YYYY-MM-DD")
+		}
+		query = query.Where("abandoned_carts.detected_at < ?", to.AddDate(0, 0, 1))
+	}
+	return query, nil
+}
@@ -1,14 +1,21 @@
 package handlers
 
 import (
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"server/models"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/stripe/stripe-go/v76"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // AdminMiddleware - Ensures user is an admin
@@ -41,6 +48,7 @@ func (h *HandlerContext) GetDashboardData(w http.ResponseWriter, r *http.Request
 	var totalUsers int64
 	var totalOrders int64
 	var totalRevenue int64
+	var totalRefunded int64
 	var lowStockProducts int64
 
 	// Fetch total users
@@ -57,15 +65,26 @@ func (h *HandlerContext) GetDashboardData(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Fetch total revenue (sum of order totals)
-	if err := h.db.Model(&models.Order{}).Select("COALESCE(SUM(total), 0)").Scan(&totalRevenue).Error; err != nil {
+	// Fetch total revenue (sum of order totals net of the money refunded, cancelled orders brought nothing in)
+	if err := h.db.Model(&models.Order{}).Where("status <> ?", models.OrderCancelled).
+		Select(`COALESCE(SUM(total - COALESCE((SELECT SUM(amount) FROM refunds
+			WHERE refunds.order_id = orders.id AND refunds.status = ?), 0)), 0)`, models.RefundSucceeded).
+		Scan(&totalRevenue).Error; err != nil {
 		log.Printf("Error fetching revenue: %v", err)
 		respondWithError(w, http.StatusInternalServerError, "Failed to fetch revenue")
 		return
 	}
 
-	// Fetch low stock products (stock <= 5)
-	if err := h.db.Model(&models.Product{}).Where("stock <= ?", 5).Count(&lowStockProducts).Error; err != nil {
+	// Fetch total refunded (pending refunds have not left yet, failed ones never will)
+	if err := h.db.Model(&models.Refund{}).Where("status = ?", models.RefundSucceeded).
+		Select("COALESCE(SUM(amount), 0)").Scan(&totalRefunded).Error; err != nil {
+		log.Printf("Error fetching refunds: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch refunds")
+		return
+	}
+
+	// Fetch low stock products (at or below their reorder threshold)
+	if err := h.db.Model(&models.Product{}).Where("stock <= reorder_threshold").Count(&lowStockProducts).Error; err != nil {
 		log.Printf("Error fetching low stock products: %v", err)
 		respondWithError(w, http.StatusInternalServerError, "Failed to fetch low stock products")
 		return
@@ -100,6 +119,7 @@ func (h *HandlerContext) GetDashboardData(w http.ResponseWriter, r *http.Request
 			"totalUsers":       totalUsers,
 			"totalOrders":      totalOrders,
 			"totalRevenue":     totalRevenue,
+			"totalRefunded":    totalRefunded,
 			"lowStockProducts": lowStockProducts,
 		},
 		"recentOrders": recentOrders,
@@ -166,7 +186,21 @@ func (h *HandlerContext) UpdateProduct(w http.ResponseWriter, r *http.Request) {
 		Price       float64 `json:"price"`
 		Description string  `json:"description"`
 		CategoryID  uint    `json:"categoryId"`
-		Stock       int     `json:"stock"`
+
+		// Optional, left unchanged when omitted
+		Stock            *int                  `json:"stock"`            // Counted stock, the difference is posted as an adjustment
+		ExpectedStock    *int                  `json:"expectedStock"`    // Stock the count was taken against, required with stock
+		StockReason      string                `json:"stockReason"`      // Why the count changed
+		ReorderThreshold *int                  `json:"reorderThreshold"` // Stock at or below this raises a low stock alert
+		BackorderMode    *models.BackorderMode `json:"backorderMode"`    // Empty stops selling beyond stock
+		BackorderLimit   *int                  `json:"backorderLimit"`   // Units that may wait for stock
+		AvailableOn      *string               `json:"availableOn"`      // Expected date, YYYY-MM-DD, empty clears it
+		BackorderMessage *string               `json:"backorderMessage"` // Replaces the default notice
+		Archived         *bool                 `json:"archived"`         // Archived products are hidden from the store
+		WeightGrams      *int                  `json:"weightGrams"`
+		LengthCm         *float64              `json:"lengthCm"`
+		WidthCm          *float64              `json:"widthCm"`
+		HeightCm         *float64              `json:"heightCm"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
 		log.Printf("Invalid request body: %v", err)
@@ -189,9 +223,112 @@ func (h *HandlerContext) UpdateProduct(w http.ResponseWriter, r *http.Request) {
 	product.Price = reqBody.Price
 	product.Description = reqBody.Description
 	product.CategoryID = reqBody.CategoryID
-	product.Stock = reqBody.Stock
+	if reqBody.Stock != nil && *reqBody.Stock < 0 {
+		respondWithError(w, http.StatusBadRequest, "Stock cannot be negative")
+		return
+	}
+	if reqBody.Stock != nil && reqBody.ExpectedStock == nil {
+		respondWithError(w, http.StatusBadRequest, "Expected stock is required to update stock")
+		return
+	}
+	if reqBody.ReorderThreshold != nil {
+		if *reqBody.ReorderThreshold < 0 {
+			respondWithError(w, http.StatusBadRequest, "Reorder threshold cannot be negative")
+			return
+		}
+		product.ReorderThreshold = *reqBody.ReorderThreshold
+	}
+	if reqBody.BackorderMode != nil {
+		product.BackorderMode = *reqBody.BackorderMode
+	}
+	if reqBody.BackorderLimit != nil {
+		product.BackorderLimit = *reqBody.BackorderLimit
+	}
+	availableOn := ""
+	if reqBody.AvailableOn != nil {
+		availableOn = *reqBody.AvailableOn
+	} else if product.AvailableOn != nil {
+		availableOn = product.AvailableOn.Format(time.DateOnly)
+	}
+	if product.AvailableOn, err = validBackorder(product.BackorderMode, product.BackorderLimit, availableOn); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if reqBody.BackorderMessage != nil {
+		product.BackorderMessage = strings.TrimSpace(*reqBody.BackorderMessage)
+	}
+	if (reqBody.WeightGrams != nil && *reqBody.WeightGrams < 0) ||
+		(reqBody.LengthCm != nil && *reqBody.LengthCm < 0) ||
+		(reqBody.WidthCm != nil && *reqBody.WidthCm < 0) ||
+		(reqBody.HeightCm != nil && *reqBody.HeightCm < 0) {
+		respondWithError(w, http.StatusBadRequest, "Weight and dimensions cannot be negative")
+		return
+	}
+	if reqBody.WeightGrams != nil {
+		product.WeightGrams = *reqBody.WeightGrams
+	}
+	if reqBody.LengthCm != nil {
+		product.LengthCm = *reqBody.LengthCm
+	}
+	if reqBody.WidthCm != nil {
+		product.WidthCm = *reqBody.WidthCm
+	}
+	if reqBody.HeightCm != nil {
+		product.HeightCm = *reqBody.HeightCm
+	}
+	if reqBody.Archived != nil {
+		switch {
+		case *reqBody.Archived && product.ArchivedAt == nil:
+			now := time.Now()
+			product.ArchivedAt = &now
+		case !*reqBody.Archived:
+			product.ArchivedAt = nil
+		}
+	}
 
-	if err := h.db.Save(&product).Error; err != nil {
+	adminID, _ := strconv.ParseUint(r.URL.Query().Get("userId"), 10, 32)
+
+	// Stock only changes through the ledger, price drops and restocks reach
+	// the wishlists and stock alerts in the same transaction
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("stock").Save(&product).Error; err != nil {
+			return err
+		}
+
+		// An unchanged count is no change, a count against stale stock would
+		// undo the sales and receipts since
+		if reqBody.Stock != nil && *reqBody.Stock != *reqBody.ExpectedStock {
+			var current models.Product
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "stock").First(&current, product.ID).Error; err != nil {
+				return err
+			}
+			if current.Stock != *reqBody.ExpectedStock {
+				return stockError(fmt.Sprintf("Stock changed to %d since the product was loaded, reload and count again", current.Stock))
+			}
+			reason := strings.TrimSpace(reqBody.StockReason)
+			if reason == "" {
+				reason = "Stock count updated"
+			}
+			if _, err := moveStock(tx, stockChange{
+				ProductID: product.ID,
+				Quantity:  *reqBody.Stock - current.Stock,
+				Type:      models.StockAdjustment,
+				Reason:    reason,
+				ActorID:   actorRef(uint(adminID)),
+			}); err != nil {
+				return err
+			}
+		}
+		if err := syncWishlistAlerts(tx, product.ID); err != nil {
+			return err
+		}
+		return syncStockAlerts(tx, product.ID)
+	})
+	if err != nil {
+		if msg, ok := err.(stockError); ok {
+			respondWithError(w, http.StatusConflict, string(msg))
+			return
+		}
 		log.Printf("Error updating product: %v", err)
 		respondWithError(w, http.StatusInternalServerError, "Failed to update product")
 		return
@@ -234,7 +371,10 @@ func (h *HandlerContext) DeleteProduct(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// UpdateOrderStatus - Updates an order's status
+// UpdateOrderStatus - Moves an order to a new status if the transition is
+// allowed. Statuses with side effects go through them: cancelling restocks
+// and refunds, refunding refunds everything left, paid needs the payment to
+// have gone through and shipped or delivered need the shipments to match.
 func (h *HandlerContext) UpdateOrderStatus(w http.ResponseWriter, r *http.Request) {
 	orderIDStr := chi.URLParam(r, "id")
 	orderID, err := strconv.ParseUint(orderIDStr, 10, 32)
@@ -244,8 +384,11 @@ func (h *HandlerContext) UpdateOrderStatus(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	adminID, _ := strconv.ParseUint(r.URL.Query().Get("userId"), 10, 32)
+
 	var reqBody struct {
 		Status string `json:"status"`
+		Note   string `json:"note"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
 		log.Printf("Invalid request body: %v", err)
@@ -253,22 +396,15 @@ func (h *HandlerContext) UpdateOrderStatus(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	validStatuses := []string{"pending", "processing", "shipped", "delivered", "cancelled"}
-	isValidStatus := false
-	for _, s := range validStatuses {
-		if reqBody.Status == s {
-			isValidStatus = true
-			break
-		}
-	}
-	if !isValidStatus {
+	status := models.OrderStatus(reqBody.Status)
+	if !status.Valid() {
 		log.Printf("Invalid status: %s", reqBody.Status)
 		respondWithError(w, http.StatusBadRequest, "Invalid status")
 		return
 	}
 
 	var order models.Order
-	if err := h.db.First(&order, orderID).Error; err != nil {
+	if err := h.db.Preload("Items").Preload("Discounts").Preload("Refunds").Preload("Shipments").First(&order, orderID).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			respondWithError(w, http.StatusNotFound, "Order not found")
 		} else {
@@ -277,11 +413,92 @@ func (h *HandlerContext) UpdateOrderStatus(w http.ResponseWriter, r *http.Reques
 		}
 		return
 	}
+	if !order.Status.CanTransitionTo(status) {
+		respondWithError(w, http.StatusConflict, "Cannot change order status from "+string(order.Status)+" to "+string(status))
+		return
+	}
+
+	switch status {
+	case models.OrderRefunded:
+		// A refunded status without the money going back would be a lie
+		var refund *models.Refund
+		err = h.db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			refund, err = issueRefund(tx, &order, refundRequest{Full: true, Reason: reqBody.Note}, uint(adminID), actorAdmin)
+			return err
+		})
+		if err != nil {
+			switch e := err.(type) {
+			case refundError:
+				respondWithError(w, http.StatusBadRequest, string(e))
+			case orderStatusError:
+				respondWithError(w, http.StatusConflict, string(e))
+			default:
+				log.Printf("Error refunding order %d: %v", order.ID, err)
+				respondWithError(w, http.StatusInternalServerError, "Failed to refund order")
+			}
+			return
+		}
+		settleErr := settleRefund(&h.db, refund)
+		respondWithRefund(w, refund, settleErr, map[string]any{
+			"message": "Order status updated successfully",
+		})
+		return
+	case models.OrderPaid:
+		// Orders placed before payment intents were stored have nothing to check
+		if order.PaymentIntentID != "" {
+			paymentState, err := paymentStatus(order.PaymentIntentID)
+			if err != nil {
+				log.Printf("Error checking payment of order %d: %v", order.ID, err)
+				respondWithError(w, http.StatusBadGateway, "Failed to check the payment with the payment provider")
+				return
+			}
+			if paymentState != stripe.PaymentIntentStatusSucceeded {
+				respondWithError(w, http.StatusConflict, "Payment has not gone through, it is "+string(paymentState))
+				return
+			}
+		}
+	case models.OrderShipped:
+		if len(order.Shipments) == 0 {
+			respondWithError(w, http.StatusConflict, "Create a shipment to ship the order")
+			return
+		}
+	case models.OrderDelivered:
+		if !orderDelivered(order) {
+			respondWithError(w, http.StatusConflict, "Order is delivered once every unit has shipped and every shipment is delivered")
+			return
+		}
+	}
+
+	// Cancelling also restocks and refunds
+	if status == models.OrderCancelled {
+		err = h.db.Transaction(func(tx *gorm.DB) error {
+			return cancelOrder(tx, &order, uint(adminID), actorAdmin, reqBody.Note)
+		})
+		if err != nil {
+			respondWithCancelError(w, err)
+			return
+		}
+		if err := settlePayments(&h.db, &order); err != nil {
+			log.Printf("Error settling payment of cancelled order %d: %v", order.ID, err)
+		}
 
-	order.Status = reqBody.Status
-	if err := h.db.Save(&order).Error; err != nil {
-		log.Printf("Error updating order status: %v", err)
-		respondWithError(w, http.StatusInternalServerError, "Failed to update order status")
+		respondWithJson(w, http.StatusOK, map[string]string{
+			"message": "Order status updated successfully",
+		})
+		return
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		return transitionOrder(tx, &order, status, uint(adminID), actorAdmin, reqBody.Note)
+	})
+	if err != nil {
+		if msg, ok := err.(orderStatusError); ok {
+			respondWithError(w, http.StatusConflict, string(msg))
+		} else {
+			log.Printf("Error updating order status: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to update order status")
+		}
 		return
 	}
 
@@ -290,7 +507,6 @@ func (h *HandlerContext) UpdateOrderStatus(w http.ResponseWriter, r *http.Reques
 	})
 }
 
-
 // GetOrder - Fetches a single order with details
 func (h *HandlerContext) GetOrder(w http.ResponseWriter, r *http.Request) {
     orderIDStr := chi.URLParam(r, "id")
@@ -305,6 +521,12 @@ func (h *HandlerContext) GetOrder(w http.ResponseWriter, r *http.Request) {
     if err := h.db.
         Preload("Items").
         Preload("User").
+        Preload("Discounts").
+        Preload("Refunds.Items").
+        Preload("Shipments.Items").
+        Preload("Notes", func(db *gorm.DB) *gorm.DB {
+            return db.Order("created_at, id")
+        }).
         First(&order, orderID).Error; err != nil {
         if err == gorm.ErrRecordNotFound {
             respondWithError(w, http.StatusNotFound, "Order not found")
@@ -320,54 +542,254 @@ func (h *HandlerContext) GetOrder(w http.ResponseWriter, r *http.Request) {
     })
 }
 
-// GetAllOrders - Fetches a paginated list of orders
+// Columns admin order lists can be sorted by
+var orderSortColumns = map[string]string{
+	"createdAt": "orders.created_at",
+	"total":     "orders.total",
+	"status":    "orders.status",
+	"id":        "orders.id",
+}
+
+// adminOrderQuery - Orders matching the admin filters in the query string:
+// status (comma separated), from/to (YYYY-MM-DD, inclusive), email (partial),
+// minTotal/maxTotal (cents), productId, and sort/order. The error is a
+// message for the client about an invalid filter.
+func (h *HandlerContext) adminOrderQuery(r *http.Request) (*gorm.DB, error) {
+	params := r.URL.Query()
+	query := h.db.Model(&models.Order{})
+
+	if statusParam := params.Get("status"); statusParam != "" {
+		var statuses []models.OrderStatus
+		for _, s := range strings.Split(statusParam, ",") {
+			status := models.OrderStatus(strings.TrimSpace(s))
+			if !status.Valid() {
+				return nil, errors.New("Invalid status: " + string(status))
+			}
+			statuses = append(statuses, status)
+		}
+		query = query.Where("orders.status IN ?", statuses)
+	}
+
+	if fromParam := params.Get("from"); fromParam != "" {
+		from, err := time.Parse(time.DateOnly, fromParam)
+		if err != nil {
+			return nil, errors.New("Invalid from date, expected YYYY-MM-DD")
+		}
+		query = query.Where("orders.created_at >= ?", from)
+	}
+	if toParam := params.Get("to"); toParam != "" {
+		to, err := time.Parse(time.DateOnly, toParam)
+		if err != nil {
+			return nil, errors.New("Invalid to date, expected YYYY-MM-DD")
+		}
+		query = query.Where("orders.created_at < ?", to.AddDate(0, 0, 1))
+	}
+
+	if awaitingParam := params.Get("awaitingStock"); awaitingParam != "" {
+		awaiting, err := strconv.ParseBool(awaitingParam)
+		if err != nil {
+			return nil, errors.New("Invalid awaitingStock, expected true or false")
+		}
+		query = query.Where("orders.awaiting_stock = ?", awaiting)
+	}
+
+	if email := strings.TrimSpace(params.Get("email")); email != "" {
+		query = query.Where("(orders.user_id IN (?) OR orders.guest_email ILIKE ?)",
+			h.db.Model(&models.User{}).Select("id").Where("email ILIKE ?", "%"+email+"%"), "%"+email+"%")
+	}
+
+	if minParam := params.Get("minTotal"); minParam != "" {
+		minTotal, err := strconv.ParseInt(minParam, 10, 64)
+		if err != nil {
+			return nil, errors.New("Invalid minTotal")
+		}
+		query = query.Where("orders.total >= ?", minTotal)
+	}
+	if maxParam := params.Get("maxTotal"); maxParam != "" {
+		maxTotal, err := strconv.ParseInt(maxParam, 10, 64)
+		if err != nil {
+			return nil, errors.New("Invalid maxTotal")
+		}
+		query = query.Where("orders.total <= ?", maxTotal)
+	}
+
+	if productParam := params.Get("productId"); productParam != "" {
+		productID, err := strconv.ParseUint(productParam, 10, 32)
+		if err != nil {
+			return nil, errors.New("Invalid productId")
+		}
+		query = query.Where("EXISTS (?)", h.db.Model(&models.OrderItem{}).Select("1").
+			Where("order_items.order_id = orders.id AND order_items.product_id = ?", productID))
+	}
+
+	sortColumn := "orders.created_at"
+	if sortParam := params.Get("sort"); sortParam != "" {
+		column, ok := orderSortColumns[sortParam]
+		if !ok {
+			return nil, errors.New("Invalid sort, expected createdAt, total, status or id")
+		}
+		sortColumn = column
+	}
+	direction := "DESC"
+	if strings.EqualFold(params.Get("order"), "asc") {
+		direction = "ASC"
+	}
+	query = query.Order(sortColumn + " " + direction).Order("orders.id " + direction)
+
+	return query, nil
+}
+
+// Largest page of the admin order list, the CSV export is for everything
+const maxAdminOrdersPageSize = 100
+
+// GetAllOrders - Fetches a filtered, sorted and paginated list of orders
 func (h *HandlerContext) GetAllOrders(w http.ResponseWriter, r *http.Request) {
-    pageStr := r.URL.Query().Get("page")
-    limitStr := r.URL.Query().Get("limit")
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		limit = 10
+	}
+	limit = min(limit, maxAdminOrdersPageSize)
+	offset := (page - 1) * limit
 
-    page, err := strconv.Atoi(pageStr)
-    if err != nil || page < 1 {
-        page = 1
-    }
-    limit, err := strconv.Atoi(limitStr)
-    if err != nil || limit < 1 {
-        limit = 10
-    }
+	query, err := h.adminOrderQuery(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-    offset := (page - 1) * limit
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		log.Printf("Error counting orders: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Error fetching orders")
+		return
+	}
 
-    var orders []models.Order
-    if err := h.db.
-        Preload("User").
-        Order("created_at DESC").
-        Offset(offset).
-        Limit(limit).
-        Find(&orders).Error; err != nil {
-        log.Printf("Error fetching orders: %v", err)
-        respondWithError(w, http.StatusInternalServerError, "Error fetching orders")
-        return
-    }
+	var orders []models.Order
+	if err := query.
+		Preload("User").
+		Offset(offset).
+		Limit(limit).
+		Find(&orders).Error; err != nil {
+		log.Printf("Error fetching orders: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Error fetching orders")
+		return
+	}
 
-    respondWithJson(w, http.StatusOK, map[string]interface{}{
-        "orders": orders,
-    })
+	totalPages := (int(total) + limit - 1) / limit
+
+	respondWithJson(w, http.StatusOK, map[string]interface{}{
+		"orders":      orders,
+		"totalPages":  totalPages,
+		"currentPage": page,
+		"totalItems":  total,
+	})
 }
 
-func (h *HandlerContext) UpdateOrder(w http.ResponseWriter, r *http.Request) {
-	orderIDStr := chi.URLParam(r, "id")
-	orderID, err := strconv.ParseUint(orderIDStr, 10, 32)
+// ExportOrders - Streams every order matching the GetAllOrders filters as CSV
+func (h *HandlerContext) ExportOrders(w http.ResponseWriter, r *http.Request) {
+	query, err := h.adminOrderQuery(r)
 	if err != nil {
-		log.Printf("Invalid order ID: %v", err)
-		respondWithError(w, http.StatusBadRequest, "Invalid order ID")
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	var reqBody struct {
-		Status string `json:"status"`
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="orders-%s.csv"`, time.Now().Format("20060102-150405")))
+
+	cents := func(amount int64) string {
+		sign := ""
+		if amount < 0 {
+			sign, amount = "-", -amount
+		}
+		return fmt.Sprintf("%s%d.%02d", sign, amount/100, amount%100)
 	}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		log.Printf("Invalid request body: %v", err)
-		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+	// Customer input starting like a formula would run in a spreadsheet
+	text := func(value string) string {
+		if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+			return "'" + value
+		}
+		return value
+	}
+
+	out := csv.NewWriter(w)
+	flusher, _ := w.(http.Flusher)
+	out.Write([]string{
+		"order_id", "created_at", "status", "customer_email", "customer_name", "items",
+		"discount", "shipping", "tax", "total", "refunded", "net",
+		"payment_intent_id", "country", "state", "postal_code",
+	})
+
+	// One cursor over the filtered orders keeps memory flat however many match
+	rows, err := query.
+		Select("orders.*, COALESCE(users.email, orders.guest_email) AS customer_email, " +
+			"COALESCE(users.first_name, orders.guest_name) AS customer_first_name, " +
+			"COALESCE(users.last_name, '') AS customer_last_name, " +
+			"(SELECT COALESCE(SUM(quantity), 0) FROM order_items WHERE order_items.order_id = orders.id) AS units").
+		Joins("LEFT JOIN users ON users.id = orders.user_id").
+		Rows()
+	if err != nil {
+		log.Printf("Error exporting orders: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	for count := 1; rows.Next(); count++ {
+		var row struct {
+			models.Order
+			CustomerEmail     string
+			CustomerFirstName string
+			CustomerLastName  string
+			Units             int
+		}
+		if err := h.db.ScanRows(rows, &row); err != nil {
+			log.Printf("Error exporting orders: %v", err)
+			break
+		}
+
+		out.Write([]string{
+			strconv.FormatUint(uint64(row.ID), 10),
+			row.CreatedAt.UTC().Format(time.RFC3339),
+			string(row.Status),
+			text(row.CustomerEmail),
+			text(strings.TrimSpace(row.CustomerFirstName + " " + row.CustomerLastName)),
+			strconv.Itoa(row.Units),
+			cents(row.Discount),
+			cents(row.Shipping),
+			cents(row.Tax),
+			cents(row.Total),
+			cents(row.Refunded),
+			cents(row.Total - row.Refunded),
+			row.PaymentIntentID,
+			text(row.Country),
+			text(row.State),
+			text(row.PostalCode),
+		})
+
+		if count%500 == 0 {
+			out.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error exporting orders: %v", err)
+	}
+	out.Flush()
+}
+
+// GetOrderTimelineAdmin - Status history of any order
+func (h *HandlerContext) GetOrderTimelineAdmin(w http.ResponseWriter, r *http.Request) {
+	orderIDStr := chi.URLParam(r, "id")
+	orderID, err := strconv.ParseUint(orderIDStr, 10, 32)
+	if err != nil {
+		log.Printf("Invalid order ID: %v", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid order ID")
 		return
 	}
 
@@ -382,14 +804,15 @@ func (h *HandlerContext) UpdateOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	order.Status = reqBody.Status
-	if err := h.db.Save(&order).Error; err != nil {
-		log.Printf("Error updating order: %v", err)
-		respondWithError(w, http.StatusInternalServerError, "Failed to update order")
+	events, err := h.orderTimeline(order.ID)
+	if err != nil {
+		log.Printf("Error fetching order events: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch order timeline")
 		return
 	}
 
-	respondWithJson(w, http.StatusOK, map[string]string{
-		"message": "Order updated successfully",
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"status": order.Status,
+		"events": events,
 	})
 }
@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"server/models"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// backorderedStock - Units of each product sold beyond stock and still waiting
+// for receipts
+func backorderedStock(db *gorm.DB, productIDs []uint) (map[uint]int, error) {
+	waiting := make(map[uint]int, len(productIDs))
+	if len(productIDs) == 0 {
+		return waiting, nil
+	}
+
+	var rows []struct {
+		ProductID uint
+		Quantity  int
+	}
+	if err := db.Model(&models.OrderItem{}).
+		Select("product_id, SUM(backordered_quantity) AS quantity").
+		Where("product_id IN ? AND backordered_quantity > 0", productIDs).
+		Group("product_id").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		waiting[row.ProductID] = row.Quantity
+	}
+	return waiting, nil
+}
+
+// sellable - Units a shopper can buy right now, from stock or beyond it.
+// Available and Backorderable must be filled in.
+func sellable(product models.Product) int {
+	return product.Available + product.Backorderable
+}
+
+// backorderNotice - What shoppers are told about units sold beyond stock,
+// empty for products that are only sold from stock
+func backorderNotice(product models.Product) string {
+	switch {
+	case product.BackorderMode == models.BackorderNone:
+		return ""
+	case product.BackorderMessage != "":
+		return product.BackorderMessage
+	}
+
+	expected := ""
+	if product.AvailableOn != nil {
+		expected = product.AvailableOn.Format("Jan 2, 2006")
+	}
+	if product.BackorderMode == models.BackorderPreorder {
+		if expected != "" {
+			return "Pre-order, expected to ship from " + expected
+		}
+		return "Pre-order, ships on release"
+	}
+	if expected != "" {
+		return "Backordered, expected back in stock on " + expected
+	}
+	return "Backordered, ships as soon as it is back in stock"
+}
+
+// backorderItem - Marks units of an order line as sold beyond stock so they
+// wait for receipts, and flags the order
+func backorderItem(tx *gorm.DB, order *models.Order, itemID uint, product models.Product, quantity int) error {
+	if err := tx.Model(&models.OrderItem{}).Where("id = ?", itemID).Updates(map[string]any{
+		"backorder_mode":       product.BackorderMode,
+		"backordered_quantity": quantity,
+		"available_on":         product.AvailableOn,
+	}).Error; err != nil {
+		return err
+	}
+	for i := range order.Items {
+		if order.Items[i].ID == itemID {
+			order.Items[i].BackorderMode = product.BackorderMode
+			order.Items[i].BackorderedQuantity = quantity
+			order.Items[i].AvailableOn = product.AvailableOn
+		}
+	}
+
+	order.AwaitingStock = true
+	return tx.Model(&models.Order{}).Where("id = ?", order.ID).Update("awaiting_stock", true).Error
+}
+
+// backorderShortfall - Backorders units of a paid order whose reserved stock
+// was gone by the time the payment arrived, whatever the product's settings
+func backorderShortfall(tx *gorm.DB, orderID, productID uint, quantity int) error {
+	var item models.OrderItem
+	if err := tx.Where("order_id = ? AND product_id = ?", orderID, productID).Order("id").First(&item).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&models.OrderItem{}).Where("id = ?", item.ID).
+		UpdateColumn("backordered_quantity", gorm.Expr("backordered_quantity + ?", quantity)).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&models.Order{}).Where("id = ?", orderID).Update("awaiting_stock", true).Error; err != nil {
+		return err
+	}
+
+	var status models.OrderStatus
+	if err := tx.Model(&models.Order{}).Where("id = ?", orderID).Pluck("status", &status).Error; err != nil {
+		return err
+	}
+	note := fmt.Sprintf("%d of %s were no longer in stock and wait for a receipt", quantity, item.Name)
+	return recordOrderEvent(tx, orderID, status, status, 0, actorSystem, note)
+}
+
+// syncAwaitingStock - Clears an order's flag once none of its units wait for stock
+func syncAwaitingStock(tx *gorm.DB, orderID uint) error {
+	return tx.Exec(`UPDATE orders SET awaiting_stock = EXISTS (
+		SELECT 1 FROM order_items WHERE order_items.order_id = orders.id AND order_items.backordered_quantity > 0)
+		WHERE id = ?`, orderID).Error
+}
+
+// clearBackorders - Drops the units an order still waits for, they never left
+// stock so nothing is put back. Items must be preloaded.
+func clearBackorders(tx *gorm.DB, order *models.Order) error {
+	if !order.AwaitingStock {
+		return nil
+	}
+	if err := tx.Model(&models.OrderItem{}).
+		Where("order_id = ? AND backordered_quantity > 0", order.ID).
+		Update("backordered_quantity", 0).Error; err != nil {
+		return err
+	}
+	for i := range order.Items {
+		order.Items[i].BackorderedQuantity = 0
+	}
+	order.AwaitingStock = false
+	return tx.Model(&models.Order{}).Where("id = ?", order.ID).Update("awaiting_stock", false).Error
+}
+
+// fillOrderBackorders - Fills what stock allows of a newly paid order's
+// backordered lines, stock that came in while it was pending went to no one
+func fillOrderBackorders(tx *gorm.DB, orderID uint) error {
+	var productIDs []uint
+	if err := tx.Model(&models.OrderItem{}).
+		Distinct("product_id").
+		Where("order_id = ? AND backordered_quantity > 0", orderID).
+		Order("product_id").
+		Pluck("product_id", &productIDs).Error; err != nil {
+		return err
+	}
+	for _, productID := range productIDs {
+		if err := fillBackorders(tx, productID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillBackorders - Sells a product's unreserved stock to the paid order lines
+// waiting for it, oldest order first, so those units can ship
+func fillBackorders(tx *gorm.DB, productID uint) error {
+	var waiting []struct {
+		ID                  uint
+		OrderID             uint
+		Name                string
+		BackorderedQuantity int
+		Status              models.OrderStatus
+		Country             string
+		State               string
+	}
+	if err := tx.Table("order_items").
+		Select(`order_items.id, order_items.order_id, order_items.name, order_items.backordered_quantity,
+			orders.status, orders.country, orders.state`).
+		Joins("JOIN orders ON orders.id = order_items.order_id").
+		Where("order_items.product_id = ? AND order_items.backordered_quantity > 0 AND orders.status IN ?",
+			productID, []models.OrderStatus{models.OrderPaid, models.OrderProcessing, models.OrderShipped}).
+		Order("orders.created_at, order_items.id").
+		Scan(&waiting).Error; err != nil {
+		return err
+	}
+	if len(waiting) == 0 {
+		return nil
+	}
+
+	var product models.Product
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "stock").First(&product, productID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		return err
+	}
+	if err := fillAvailable(tx, &product); err != nil {
+		return err
+	}
+
+	available := product.Available
+	for _, line := range waiting {
+		take := min(available, line.BackorderedQuantity)
+		if take <= 0 {
+			break
+		}
+
+		allocations, err := allocateStock(tx, models.OrderItem{ProductID: productID, Name: line.Name, Quantity: take}, line.Country, line.State)
+		if _, ok := err.(checkoutError); ok {
+			// Stock not placed in a warehouse yet, the next receipt tries again
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(allocations) == 0 {
+			allocations = []warehouseAllocation{{Quantity: take}}
+		}
+		for _, allocation := range allocations {
+			change := stockChange{
+				ProductID: productID,
+				Quantity:  -allocation.Quantity,
+				Type:      models.StockSale,
+				Reason:    "Backorder filled",
+				OrderID:   &line.OrderID,
+			}
+			if allocation.WarehouseID != 0 {
+				change.WarehouseID = &allocation.WarehouseID
+			}
+			if _, err := moveStock(tx, change); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Model(&models.OrderItem{}).Where("id = ?", line.ID).
+			UpdateColumn("backordered_quantity", gorm.Expr("backordered_quantity - ?", take)).Error; err != nil {
+			return err
+		}
+		if err := syncAwaitingStock(tx, line.OrderID); err != nil {
+			return err
+		}
+		note := fmt.Sprintf("%d of %s came into stock and can ship", take, line.Name)
+		if err := recordOrderEvent(tx, line.OrderID, line.Status, line.Status, 0, actorSystem, note); err != nil {
+			return err
+		}
+		available -= take
+	}
+	return nil
+}
+
+// parseAvailableOn - Expected availability date from a request, nil when empty
+func parseAvailableOn(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	date, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return nil, err
+	}
+	return &date, nil
+}
+
+// validBackorder - Checks a product's backorder settings, returning the
+// expected availability date
+func validBackorder(mode models.BackorderMode, limit int, availableOn string) (*time.Time, error) {
+	if !mode.Valid() {
+		return nil, errors.New("Invalid backorder mode, expected backorder or preorder")
+	}
+	if limit < 0 {
+		return nil, errors.New("Backorder limit cannot be negative")
+	}
+	if mode != models.BackorderNone && limit == 0 {
+		return nil, errors.New("Backorder limit is required for " + string(mode))
+	}
+	date, err := parseAvailableOn(availableOn)
+	if err != nil {
+		return nil, errors.New("Invalid availableOn date, expected YYYY-MM-DD")
+	}
+	return date, nil
+}
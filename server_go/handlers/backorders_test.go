@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"server/models"
+	"testing"
+	"time"
+)
+
+func TestBackorderNotice(t *testing.T) {
+	june := time.Date(2024, 6, 3, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		product models.Product
+		want    string
+	}{
+		{"stock only", models.Product{BackorderMessage: "Ignored"}, ""},
+		{"custom message", models.Product{BackorderMode: models.BackorderAllowed, BackorderMessage: "Back soon", AvailableOn: &june}, "Back soon"},
+		{"backorder with date", models.Product{BackorderMode: models.BackorderAllowed, AvailableOn: &june}, "Backordered, expected back in stock on Jun 3, 2024"},
+		{"backorder without date", models.Product{BackorderMode: models.BackorderAllowed}, "Backordered, ships as soon as it is back in stock"},
+		{"pre-order with date", models.Product{BackorderMode: models.BackorderPreorder, AvailableOn: &june}, "Pre-order, expected to ship from Jun 3, 2024"},
+		{"pre-order without date", models.Product{BackorderMode: models.BackorderPreorder}, "Pre-order, ships on release"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := backorderNotice(tt.product); got != tt.want {
+				t.Fatalf("backorderNotice() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidBackorder(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        models.BackorderMode
+		limit       int
+		availableOn string
+		wantDate    string
+		wantErr     bool
+	}{
+		{"stock only", models.BackorderNone, 0, "", "", false},
+		{"backorder", models.BackorderAllowed, 10, "", "", false},
+		{"pre-order with date", models.BackorderPreorder, 10, "2024-06-03", "2024-06-03", false},
+		{"unknown mode", "later", 10, "", "", true},
+		{"negative limit", models.BackorderNone, -1, "", "", true},
+		{"missing limit", models.BackorderPreorder, 0, "", "", true},
+		{"invalid date", models.BackorderAllowed, 10, "06/03/2024", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			date, err := validBackorder(tt.mode, tt.limit, tt.availableOn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validBackorder() error = %v, want error: %v", err, tt.wantErr)
+			}
+			got := ""
+			if date != nil {
+				got = date.Format(time.DateOnly)
+			}
+			if got != tt.wantDate {
+				t.Fatalf("validBackorder() date = %q, want %q", got, tt.wantDate)
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
 	"server/models"
 	"strconv"
@@ -10,35 +12,58 @@ import (
 	"gorm.io/gorm"
 )
 
+// GetCart - The user's cart, or the guest cart named by the cart token
 func (h *HandlerContext) GetCart(w http.ResponseWriter, r *http.Request) {
-	userIDStr := r.URL.Query().Get("userId")
-	userID, err := strconv.ParseUint(userIDStr, 10, 32)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid user ID")
+	owner, ok := h.resolveCartOwner(w, r, false)
+	if !ok {
 		return
 	}
 
-	var cartItems []models.Cart
-	if err := h.db.Preload("Product").Preload("Product.Images").Where("user_id = ?", userID).Find(&cartItems).Error; err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to fetch cart")
+	cartItems := []models.Cart{}
+	if !owner.empty() {
+		if err := owner.scope(h.db.Preload("Product").Preload("Product.Images")).Find(&cartItems).Error; err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to fetch cart")
+			return
+		}
+		if err := fillCartAvailable(&h.db, cartItems); err != nil {
+			log.Printf("Error fetching reserved stock: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to fetch cart")
+			return
+		}
+	}
+
+	// Preview promotions, shipping discounts are only known at checkout
+	lines := cartTaxableLines(cartItems)
+	subtotal := int64(0)
+	for _, line := range lines {
+		subtotal += line.Amount
+	}
+
+	couponError := ""
+	promotions, err := h.activePromotions(owner.UserID, r.URL.Query().Get("couponCode"))
+	if msg, ok := err.(checkoutError); ok {
+		couponError = string(msg)
+		promotions, err = h.activePromotions(owner.UserID, "")
+	}
+	if err != nil {
+		log.Printf("Error fetching promotions: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch promotions")
 		return
 	}
+	discount := applyPromotions(promotions, lines, 0)
 
 	respondWithJson(w, http.StatusOK, map[string]any{
-		"message":   "Cart retrieved successfully",
-		"cartItems": cartItems,
+		"message":     "Cart retrieved successfully",
+		"cartItems":   cartItems,
+		"subtotal":    subtotal,
+		"discount":    discount,
+		"couponError": couponError,
+		"warnings":    cartWarnings(cartItems),
 	})
 }
 
+// AddToCart - Adds a product to the cart, visitors without one get a guest cart
 func (h *HandlerContext) AddToCart(w http.ResponseWriter, r *http.Request) {
-	userIdQuery := r.URL.Query().Get("userId")
-	userId, err := strconv.ParseUint(userIdQuery, 10, 32)
-
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid userId")
-		return
-	}
-
 	var reqBody struct {
 		ProductId uint `json:"productId"`
 		Quantity  int  `json:"quantity"`
@@ -69,13 +94,30 @@ func (h *HandlerContext) AddToCart(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if product.Stock < reqBody.Quantity {
+	if product.ArchivedAt != nil {
+		respondWithError(w, http.StatusBadRequest, "Product is no longer available")
+		return
+	}
+
+	// Units held by other shoppers' checkouts cannot be added, backorders
+	// can go beyond stock up to their limit
+	if err := fillAvailable(&h.db, &product); err != nil {
+		log.Printf("Error fetching reserved stock: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Error finding product")
+		return
+	}
+	if sellable(product) < reqBody.Quantity {
 		respondWithError(w, http.StatusBadRequest, "Insufficient stock")
 		return
 	}
 
+	owner, ok := h.resolveCartOwner(w, r, true)
+	if !ok {
+		return
+	}
+
 	var cartItem models.Cart
-	err = h.db.Where("user_id = ? AND product_id = ?", userId, reqBody.ProductId).First(&cartItem).Error
+	err := owner.scope(h.db.Where("product_id = ?", reqBody.ProductId)).First(&cartItem).Error
 	if err != nil && err != gorm.ErrRecordNotFound {
 		respondWithError(w, http.StatusInternalServerError, "Error checking cart")
 		return
@@ -83,11 +125,10 @@ func (h *HandlerContext) AddToCart(w http.ResponseWriter, r *http.Request) {
 
 	// If never add this products
 	if err == gorm.ErrRecordNotFound {
-		cartItem = models.Cart{
-			UserID:    uint(userId),
-			ProductID: reqBody.ProductId,
-			Quantity:  reqBody.Quantity,
-		}
+		cartItem = owner.newItem()
+		cartItem.ProductID = reqBody.ProductId
+		cartItem.Quantity = reqBody.Quantity
+		cartItem.PriceAtAdd = toCents(product.Price)
 
 		if err := h.db.Create(&cartItem).Error; err != nil {
 			respondWithError(w, http.StatusInternalServerError, "Failed to add to cart")
@@ -98,11 +139,12 @@ func (h *HandlerContext) AddToCart(w http.ResponseWriter, r *http.Request) {
 
 		// If already exists this product then update the new quantity
 		newQuantity := cartItem.Quantity + reqBody.Quantity
-		if product.Stock < newQuantity {
+		if sellable(product) < newQuantity {
 			respondWithError(w, http.StatusBadRequest, "Insufficient stock")
 			return
 		}
 		cartItem.Quantity = newQuantity
+		cartItem.PriceAtAdd = toCents(product.Price) // Adding more means the shopper saw the current price
 		if err := h.db.Save(&cartItem).Error; err != nil {
 			respondWithError(w, http.StatusInternalServerError, "Failed to update cart")
 			return
@@ -117,10 +159,8 @@ func (h *HandlerContext) AddToCart(w http.ResponseWriter, r *http.Request) {
 
 // UpdateCartItem - Update the quantity of a cart item
 func (h *HandlerContext) UpdateCartItem(w http.ResponseWriter, r *http.Request) {
-	userIdQuery := r.URL.Query().Get("userId")
-	userId, err := strconv.ParseUint(userIdQuery, 10, 32)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid userId")
+	owner, ok := h.resolveCartOwner(w, r, false)
+	if !ok {
 		return
 	}
 
@@ -146,7 +186,7 @@ func (h *HandlerContext) UpdateCartItem(w http.ResponseWriter, r *http.Request)
 
 	// Fetch the cart item
 	var cartItem models.Cart
-	if err := h.db.Preload("Product").Where("user_id = ? AND id = ?", userId, cartId).First(&cartItem).Error; err != nil {
+	if err := owner.scope(h.db.Preload("Product").Where("id = ?", cartId)).First(&cartItem).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			respondWithError(w, http.StatusNotFound, "Cart item not found")
 		} else {
@@ -156,7 +196,12 @@ func (h *HandlerContext) UpdateCartItem(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Check stock availability
-	if cartItem.Product.Stock < reqBody.Quantity {
+	if err := fillAvailable(&h.db, &cartItem.Product); err != nil {
+		log.Printf("Error fetching reserved stock: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Error fetching cart item")
+		return
+	}
+	if sellable(cartItem.Product) < reqBody.Quantity {
 		respondWithError(w, http.StatusBadRequest, "Insufficient stock")
 		return
 	}
@@ -176,10 +221,8 @@ func (h *HandlerContext) UpdateCartItem(w http.ResponseWriter, r *http.Request)
 
 // RemoveFromCart - Remove an item from the cart
 func (h *HandlerContext) RemoveFromCart(w http.ResponseWriter, r *http.Request) {
-	userIdQuery := r.URL.Query().Get("userId")
-	userId, err := strconv.ParseUint(userIdQuery, 10, 32)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid userId")
+	owner, ok := h.resolveCartOwner(w, r, false)
+	if !ok {
 		return
 	}
 
@@ -192,7 +235,7 @@ func (h *HandlerContext) RemoveFromCart(w http.ResponseWriter, r *http.Request)
 
 	// Fetch the cart item
 	var cartItem models.Cart
-	if err := h.db.Where("user_id = ? AND id = ?", userId, cartId).First(&cartItem).Error; err != nil {
+	if err := owner.scope(h.db.Where("id = ?", cartId)).First(&cartItem).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			respondWithError(w, http.StatusNotFound, "Cart item not found")
 		} else {
@@ -211,3 +254,138 @@ func (h *HandlerContext) RemoveFromCart(w http.ResponseWriter, r *http.Request)
 		"message": "Cart item removed successfully",
 	})
 }
+
+// Kinds of cart warnings
+const (
+	cartPriceChanged      = "price_changed"
+	cartInsufficientStock = "insufficient_stock"
+	cartOutOfStock        = "out_of_stock"
+	cartProductArchived   = "product_archived"
+	cartBackordered       = "backordered"
+)
+
+// cartWarning - A cart line that no longer matches what the shopper added
+type cartWarning struct {
+	CartItemID uint   `json:"cartItemId"`
+	ProductID  uint   `json:"productId"`
+	Type       string `json:"type"`
+	Message    string `json:"message"`
+	OldPrice   int64  `json:"oldPrice,omitempty"`  // In cents, price changes only
+	NewPrice   int64  `json:"newPrice,omitempty"`  // In cents, price changes only
+	Available  int    `json:"available,omitempty"` // Units left to buy, insufficient stock only
+	Quantity   int    `json:"quantity,omitempty"`  // Units that wait for stock, backorders only
+}
+
+// cartWarnings - Checks cart items with preloaded products and their
+// availability filled in against the current catalogue. Unavailable lines get a single warning, others can get
+// a stock, a backorder and a price warning.
+func cartWarnings(cartItems []models.Cart) []cartWarning {
+	warnings := []cartWarning{}
+	for _, item := range cartItems {
+		warning := cartWarning{CartItemID: item.ID, ProductID: item.ProductID}
+
+		if item.Product.ID == 0 || item.Product.ArchivedAt != nil {
+			warning.Type = cartProductArchived
+			warning.Message = "This product is no longer available"
+			warnings = append(warnings, warning)
+			continue
+		}
+		if sellable(item.Product) <= 0 {
+			warning.Type = cartOutOfStock
+			warning.Message = item.Product.Name + " is out of stock"
+			warnings = append(warnings, warning)
+			continue
+		}
+
+		if sellable(item.Product) < item.Quantity {
+			stock := warning
+			stock.Type = cartInsufficientStock
+			stock.Message = fmt.Sprintf("Only %d of %s left in stock", sellable(item.Product), item.Product.Name)
+			stock.Available = sellable(item.Product)
+			warnings = append(warnings, stock)
+		}
+		if waiting := min(item.Quantity, sellable(item.Product)) - item.Product.Available; waiting > 0 {
+			backordered := warning
+			backordered.Type = cartBackordered
+			backordered.Message = fmt.Sprintf("%d of %s: %s", waiting, item.Product.Name, backorderNotice(item.Product))
+			backordered.Quantity = waiting
+			warnings = append(warnings, backordered)
+		}
+		if price := toCents(item.Product.Price); item.PriceAtAdd != 0 && item.PriceAtAdd != price {
+			changed := warning
+			changed.Type = cartPriceChanged
+			changed.Message = fmt.Sprintf("The price of %s changed from %s to %s", item.Product.Name, formatCents(item.PriceAtAdd), formatCents(price))
+			changed.OldPrice = item.PriceAtAdd
+			changed.NewPrice = price
+			warnings = append(warnings, changed)
+		}
+	}
+	return warnings
+}
+
+// AcceptCartChanges - Applies the fixes for the cart's warnings: unavailable
+// lines are removed, quantities are lowered to the stock and new prices are
+// accepted
+func (h *HandlerContext) AcceptCartChanges(w http.ResponseWriter, r *http.Request) {
+	owner, ok := h.resolveCartOwner(w, r, false)
+	if !ok {
+		return
+	}
+
+	applied := []cartWarning{}
+	cartItems := []models.Cart{}
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if owner.empty() {
+			return nil
+		}
+		if err := owner.scope(tx.Preload("Product")).Order("id").Find(&cartItems).Error; err != nil {
+			return err
+		}
+		if err := fillCartAvailable(tx, cartItems); err != nil {
+			return err
+		}
+		// Backorder notices are for information, there is nothing to apply
+		for _, warning := range cartWarnings(cartItems) {
+			if warning.Type != cartBackordered {
+				applied = append(applied, warning)
+			}
+		}
+
+		kept := cartItems[:0]
+		for _, item := range cartItems {
+			if item.Product.ID == 0 || item.Product.ArchivedAt != nil || sellable(item.Product) <= 0 {
+				if err := tx.Delete(&item).Error; err != nil {
+					return err
+				}
+				continue
+			}
+
+			quantity := min(item.Quantity, sellable(item.Product))
+			price := toCents(item.Product.Price)
+			if quantity != item.Quantity || price != item.PriceAtAdd {
+				if err := tx.Model(&item).Updates(map[string]any{
+					"quantity":     quantity,
+					"price_at_add": price,
+				}).Error; err != nil {
+					return err
+				}
+				item.Quantity = quantity
+				item.PriceAtAdd = price
+			}
+			kept = append(kept, item)
+		}
+		cartItems = kept
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error accepting cart changes: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to update cart")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message":   "Cart updated successfully",
+		"applied":   applied,
+		"cartItems": cartItems,
+	})
+}
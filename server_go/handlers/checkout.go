@@ -1,36 +1,161 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
-	"os"
+	"net/mail"
 	"server/models"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/stripe/stripe-go/v76"
-	"github.com/stripe/stripe-go/v76/client"
+	"gorm.io/gorm"
 )
 
+// Flat shipping fee in cents
+const flatShippingCents = 1000
+
+type CheckoutAddress struct {
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	State      string `json:"state"`
+	PostalCode string `json:"postalCode"`
+	Country    string `json:"country"`
+}
+
+// matches - Reports whether the address falls in an area, empty fields match anything
+func (a CheckoutAddress) matches(country, state, postalPrefix string) bool {
+	if country != "" && !strings.EqualFold(country, strings.TrimSpace(a.Country)) {
+		return false
+	}
+	if state != "" && !strings.EqualFold(state, strings.TrimSpace(a.State)) {
+		return false
+	}
+	if postalPrefix != "" {
+		postalCode := strings.ToUpper(strings.ReplaceAll(a.PostalCode, " ", ""))
+		prefix := strings.ToUpper(strings.ReplaceAll(postalPrefix, " ", ""))
+		if !strings.HasPrefix(postalCode, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// areaSpecificity - Ranks areas so that narrower ones win over broader ones
+func areaSpecificity(country, state, postalPrefix string) int {
+	score := 0
+	if postalPrefix != "" {
+		score += 100 + len(postalPrefix)
+	}
+	if state != "" {
+		score += 10
+	}
+	if country != "" {
+		score += 1
+	}
+	return score
+}
+
+// How long a checkout quote can be paid for
+const checkoutQuoteTTL = 15 * time.Minute
+
+// CheckoutQuoteRequest - What the customer chose on the checkout page
+type CheckoutQuoteRequest struct {
+	Address          CheckoutAddress `json:"address"`
+	ShippingMethodID uint            `json:"shippingMethodId"` // 0 picks the cheapest method
+	CouponCode       string          `json:"couponCode,omitempty"`
+	Email            string          `json:"email,omitempty"` // Guest checkout only, where order emails go
+	Name             string          `json:"name,omitempty"`  // Guest checkout only
+}
+
+// CheckoutRequest - Pays for a quote created by CreateCheckoutQuote
 type CheckoutRequest struct {
-	CartItems []struct {
-		ProductID uint `json:"productId"`
-		Quantity  int  `json:"quantity"`
-	} `json:"cartItems"`
-	Address struct {
-		Line1      string `json:"line1"`
-		Line2      string `json:"line2,omitempty"`
-		City       string `json:"city"`
-		State      string `json:"state"`
-		PostalCode string `json:"postalCode"`
-		Country    string `json:"country"`
-	} `json:"address"`
+	QuoteID     uint   `json:"quoteId"`
+	GiftMessage string `json:"giftMessage,omitempty"` // Printed for the recipient, visible to the customer
 }
 
-func (h *HandlerContext) CreatePaymentIntent(w http.ResponseWriter, r *http.Request) {
-	userIdQuery := r.URL.Query().Get("userId")
-	userId, err := strconv.ParseUint(userIdQuery, 10, 32)
+// Longest gift message accepted at checkout, in characters
+const maxGiftMessageLength = 500
+
+// checkoutError - A pricing problem caused by the request rather than the server
+type checkoutError string
+
+func (e checkoutError) Error() string {
+	return string(e)
+}
+
+// CartPricing - Totals for a cart, all amounts in cents
+type CartPricing struct {
+	Subtotal int64         `json:"subtotal"`
+	Discount DiscountQuote `json:"discount"`
+	Shipping ShippingRate  `json:"shipping"`
+	Tax      TaxQuote      `json:"tax"`
+	Total    int64         `json:"total"`
+}
+
+// Smallest amount the payment provider can charge, in cents
+const minimumCharge = 50
+
+// priceCart - Applies promotions, shipping and tax to cart items with preloaded
+// products. Request problems, and totals too small to charge, are returned
+// as a checkoutError.
+func (h *HandlerContext) priceCart(userID uint, cartItems []models.Cart, address CheckoutAddress, shippingMethodID uint, couponCode string) (CartPricing, error) {
+	var pricing CartPricing
+
+	lines := cartTaxableLines(cartItems)
+	for _, line := range lines {
+		pricing.Subtotal += line.Amount
+	}
+
+	promotions, err := h.activePromotions(userID, couponCode)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid userId")
+		return pricing, err
+	}
+
+	// Item discounts do not depend on shipping, free shipping thresholds are
+	// met with what is paid for the items
+	itemDiscount := applyPromotions(promotions, lines, 0).ItemDiscount
+	rates, err := h.shippingRates(cartItems, address, itemDiscount)
+	if err != nil {
+		return pricing, err
+	}
+	shipping, ok := selectShippingRate(rates, shippingMethodID)
+	if !ok {
+		return pricing, checkoutError("Shipping method not available for this address")
+	}
+	pricing.Shipping = shipping
+	pricing.Discount = applyPromotions(promotions, lines, shipping.Cost)
+
+	// Tax is charged on what the customer actually pays
+	for i := range lines {
+		lines[i].Amount -= pricing.Discount.LineDiscounts[i]
+	}
+	pricing.Tax, err = h.calculateTax(lines, shipping.Cost-pricing.Discount.ShippingDiscount, address)
+	if err != nil {
+		return pricing, err
+	}
+
+	pricing.Total = pricing.Subtotal - pricing.Discount.Total + shipping.Cost + pricing.Tax.Added
+	if pricing.Total > 0 && pricing.Total < minimumCharge {
+		return pricing, checkoutError("Order total must be at least " + formatCents(minimumCharge) + " unless it is free")
+	}
+	return pricing, nil
+}
+
+// CreatePaymentIntent - Places the order for a quote and starts its payment,
+// for a signed-in user or a guest cart. Free orders are paid on the spot and
+// get no payment intent.
+func (h *HandlerContext) CreatePaymentIntent(w http.ResponseWriter, r *http.Request) {
+	owner, ok := h.resolveCartOwner(w, r, false)
+	if !ok {
 		return
 	}
 
@@ -40,87 +165,344 @@ func (h *HandlerContext) CreatePaymentIntent(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	if req.QuoteID == 0 {
+		respondWithError(w, http.StatusBadRequest, "QuoteId is required")
+		return
+	}
+
+	req.GiftMessage = strings.TrimSpace(req.GiftMessage)
+	if utf8.RuneCountInString(req.GiftMessage) > maxGiftMessageLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Gift message must be at most %d characters", maxGiftMessageLength))
+		return
+	}
+
+	var quote models.CheckoutQuote
+	if err := owner.scope(h.db.Where("id = ?", req.QuoteID)).First(&quote).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Quote not found")
+		} else {
+			respondWithError(w, http.StatusInternalServerError, "Failed to fetch quote: "+err.Error())
+		}
+		return
+	}
+
+	if quote.UsedAt != nil {
+		respondWithError(w, http.StatusConflict, "Quote has already been paid")
+		return
+	}
+	if time.Now().After(quote.ExpiresAt) {
+		respondWithError(w, http.StatusConflict, "Quote has expired, please review your order again")
+		return
+	}
+
 	// Fetch cart items
 	var cartItems []models.Cart
-	if err := h.db.Preload("Product").Where("user_id = ?", userId).Find(&cartItems).Error; err != nil {
+	if err := owner.scope(h.db.Preload("Product")).Order("id").Find(&cartItems).Error; err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to fetch cart items: "+err.Error())
 		return
 	}
 
-	// Validate cart items match request
-	if len(cartItems) != len(req.CartItems) {
-		respondWithError(w, http.StatusBadRequest, "Cart items mismatch")
+	if len(cartItems) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Cart is empty")
 		return
 	}
-	total := int64(0)
-	for i, item := range cartItems {
-		if item.ProductID != req.CartItems[i].ProductID || item.Quantity != req.CartItems[i].Quantity {
-			respondWithError(w, http.StatusBadRequest, "Cart items mismatch")
-			return
-		}
-		total += int64(item.Product.Price * float64(item.Quantity) * 100)
-	}
-	total += 1000                         // $10 shipping in cents
-	total += int64(float64(total) * 0.08) // 8% tax
 
-	// Initialize Stripe client
-	stripeKey := os.Getenv("STRIPE_SECRET")
-	if stripeKey == "" {
-		respondWithError(w, http.StatusInternalServerError, "Stripe secret key not configured")
+	// The quote only holds while the cart and prices stay the same
+	if cartFingerprint(cartItems) != quote.CartHash {
+		respondWithError(w, http.StatusConflict, "Cart changed since the quote was created, please review your order again")
 		return
 	}
-	stripe.Key = stripeKey
-	sc := &client.API{}
-	sc.Init(stripe.Key, nil)
 
-	// Create payment intent
-	params := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(total),
-		Currency: stripe.String(string(stripe.CurrencyUSD)),
-		Metadata: map[string]string{
-			"userId": strconv.FormatUint(userId, 10),
-		},
+	address := CheckoutAddress{
+		Line1:      quote.AddressLine1,
+		Line2:      quote.AddressLine2,
+		City:       quote.City,
+		State:      quote.State,
+		PostalCode: quote.PostalCode,
+		Country:    quote.Country,
 	}
-	paymentIntent, err := sc.PaymentIntents.New(params)
+	pricing, err := h.priceCart(owner.UserID, cartItems, address, quote.ShippingMethodID, quote.CouponCode)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to create payment intent: "+err.Error())
+		if msg, ok := err.(checkoutError); ok {
+			respondWithError(w, http.StatusConflict, string(msg))
+		} else {
+			respondWithError(w, http.StatusInternalServerError, "Failed to price cart: "+err.Error())
+		}
 		return
 	}
 
+	if pricing.Total != quote.Total {
+		respondWithError(w, http.StatusConflict, "Order total changed since the quote was created, please review your order again")
+		return
+	}
+	total := pricing.Total
+
+	// The payment provider cannot charge nothing
+	paymentIntent := &stripe.PaymentIntent{}
+	if total > 0 {
+		// Initialize Stripe client
+		sc, err := stripeClient()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// Create payment intent
+		params := &stripe.PaymentIntentParams{
+			Amount:   stripe.Int64(total),
+			Currency: stripe.String(string(stripe.CurrencyUSD)),
+		}
+		if owner.UserID != 0 {
+			params.AddMetadata("userId", strconv.FormatUint(uint64(owner.UserID), 10))
+		} else {
+			params.AddMetadata("guestEmail", quote.GuestEmail)
+			params.ReceiptEmail = stripe.String(quote.GuestEmail)
+		}
+		paymentIntent, err = sc.PaymentIntents.New(params)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to create payment intent: "+err.Error())
+			return
+		}
+	}
+
 	// Create order (temporary placement; ideally use webhook)
 	order := models.Order{
-		UserID:       uint(userId),
+		UserID:       quote.UserID,
+		GuestEmail:   quote.GuestEmail,
+		GuestName:    quote.GuestName,
 		Total:        total,
-		AddressLine1: req.Address.Line1,
-		AddressLine2: req.Address.Line2,
-		City:         req.Address.City,
-		State:        req.Address.State,
-		PostalCode:   req.Address.PostalCode,
-		Country:      req.Address.Country,
-		Status:       "pending",
+		AddressLine1: address.Line1,
+		AddressLine2: address.Line2,
+		City:         address.City,
+		State:        address.State,
+		PostalCode:   address.PostalCode,
+		Country:      address.Country,
+		Status:       models.OrderPending,
+		Tax:          pricing.Tax.Total,
+
+		ShippingMethodName: pricing.Shipping.Name,
+		Shipping:           pricing.Shipping.Cost,
+		Discount:           pricing.Discount.Total,
+		PaymentIntentID:    paymentIntent.ID,
 	}
-	for _, item := range cartItems {
+	if pricing.Shipping.MethodID != 0 {
+		order.ShippingMethodID = &pricing.Shipping.MethodID
+	}
+	for i, item := range cartItems {
 		order.Items = append(order.Items, models.OrderItem{
-			ProductID: item.ProductID,
-			Quantity:  item.Quantity,
-			Price:     int64(item.Product.Price * 100), // Store in cents
-			Name:      item.Product.Name,
+			ProductID:   item.ProductID,
+			Quantity:    item.Quantity,
+			Price:       toCents(item.Product.Price), // Store in cents
+			Name:        item.Product.Name,
+			Tax:         pricing.Tax.Lines[i].Tax,
+			TaxRate:     pricing.Tax.Lines[i].Rate,
+			TaxIncluded: pricing.Tax.Lines[i].Inclusive,
+			Discount:    pricing.Discount.LineDiscounts[i],
 		})
 	}
-	if err := h.db.Create(&order).Error; err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to create order: "+err.Error())
-		return
+	for _, discount := range pricing.Discount.Discounts {
+		order.Discounts = append(order.Discounts, models.OrderDiscount{
+			PromotionID:  discount.PromotionID,
+			Code:         discount.Code,
+			Name:         discount.Name,
+			Type:         discount.Type,
+			Amount:       discount.Amount,
+			FreeShipping: discount.FreeShipping,
+		})
 	}
 
-	// Clear cart after order creation
-	if err := h.db.Where("user_id = ?", userId).Delete(&models.Cart{}).Error; err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to clear cart: "+err.Error())
+	if req.GiftMessage != "" {
+		order.Notes = append(order.Notes, models.OrderNote{
+			Visibility: models.NoteCustomer,
+			Kind:       giftMessageNote,
+			Body:       req.GiftMessage,
+			AuthorID:   order.UserID,
+			AuthorRole: actorCustomer,
+		})
+	}
+
+	// Use up the quote, create the order, hold its stock until payment, record
+	// promotion usage and clear the cart together
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&quote).Where("used_at IS NULL").Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return checkoutError("Quote has already been paid")
+		}
+
+		if err := tx.Create(&order).Error; err != nil {
+			return err
+		}
+		if err := recordOrderEvent(tx, order.ID, "", models.OrderPending, owner.UserID, actorCustomer, "Order placed"); err != nil {
+			return err
+		}
+		if err := reserveStock(tx, &order, time.Now().Add(reservationTTL())); err != nil {
+			return err
+		}
+		if err := redeemPromotions(tx, pricing.Discount.Discounts, owner.UserID, order.ID); err != nil {
+			return err
+		}
+		if err := markCartRecovered(tx, owner, order.ID); err != nil {
+			return err
+		}
+		if total == 0 {
+			if err := transitionOrder(tx, &order, models.OrderPaid, owner.UserID, actorCustomer, "Nothing to pay"); err != nil {
+				return err
+			}
+		}
+		return owner.scope(tx).Delete(&models.Cart{}).Error
+	})
+	if err != nil {
+		// Nothing will be charged for an order that was not created
+		if paymentIntent.ID != "" {
+			if cancelErr := cancelPayment(paymentIntent.ID); cancelErr != nil {
+				log.Printf("Error cancelling payment intent %s: %v", paymentIntent.ID, cancelErr)
+			}
+		}
+
+		if msg, ok := err.(checkoutError); ok {
+			respondWithError(w, http.StatusConflict, string(msg))
+		} else {
+			respondWithError(w, http.StatusInternalServerError, "Failed to create order: "+err.Error())
+		}
 		return
 	}
 
-	respondWithJson(w, http.StatusOK, map[string]interface{}{
+	response := map[string]interface{}{
 		"message":      "Payment intent created",
 		"clientSecret": paymentIntent.ClientSecret,
-"orderId":      order.ID,
+		"orderId":      order.ID,
+		"paid":         order.Status == models.OrderPaid,
+	}
+	if total == 0 {
+		response["message"] = "Order placed, nothing to pay"
+	}
+	// Guests have no order history, the signed link is how they get back to the order
+	if order.UserID == nil {
+		response["lookupToken"] = orderLookupToken(order.ID)
+		response["lookupUrl"] = orderLookupURL(order.ID)
+	}
+	respondWithJson(w, http.StatusOK, response)
+}
+
+// cartFingerprint - Hashes the products, quantities and prices in a cart
+func cartFingerprint(cartItems []models.Cart) string {
+	lines := make([]string, 0, len(cartItems))
+	for _, item := range cartItems {
+		lines = append(lines, fmt.Sprintf("%d:%d:%d", item.ProductID, item.Quantity, toCents(item.Product.Price)))
+	}
+	sort.Strings(lines)
+
+	hash := sha256.Sum256([]byte(strings.Join(lines, ",")))
+	return hex.EncodeToString(hash[:])
+}
+
+// CreateCheckoutQuote - Prices the user's or guest's cart server side and
+// stores the quote that checkout will charge. Guests must give an email.
+func (h *HandlerContext) CreateCheckoutQuote(w http.ResponseWriter, r *http.Request) {
+	owner, ok := h.resolveCartOwner(w, r, false)
+	if !ok {
+		return
+	}
+
+	var req CheckoutQuoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	address := req.Address
+	if address.Line1 == "" || address.City == "" || address.State == "" || address.PostalCode == "" || address.Country == "" {
+		respondWithError(w, http.StatusBadRequest, "Address is incomplete")
+		return
+	}
+
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	req.Name = strings.TrimSpace(req.Name)
+	if owner.UserID == 0 {
+		if _, err := mail.ParseAddress(req.Email); err != nil || req.Email == "" {
+			respondWithError(w, http.StatusBadRequest, "A valid email is required for guest checkout")
+			return
+		}
+		if req.Name == "" {
+			respondWithError(w, http.StatusBadRequest, "Name is required for guest checkout")
+			return
+		}
+	}
+
+	var cartItems []models.Cart
+	if err := owner.scope(h.db.Preload("Product")).Order("id").Find(&cartItems).Error; err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch cart items")
+		return
+	}
+
+	if len(cartItems) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Cart is empty")
+		return
+	}
+
+	if err := fillCartAvailable(&h.db, cartItems); err != nil {
+		log.Printf("Error fetching reserved stock: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch cart items")
+		return
+	}
+	for _, item := range cartItems {
+		if item.Product.ArchivedAt != nil {
+			respondWithError(w, http.StatusBadRequest, item.Product.Name+" is no longer available")
+			return
+		}
+		if sellable(item.Product) < item.Quantity {
+			respondWithError(w, http.StatusBadRequest, "Insufficient stock for "+item.Product.Name)
+			return
+		}
+	}
+
+	pricing, err := h.priceCart(owner.UserID, cartItems, address, req.ShippingMethodID, req.CouponCode)
+	if err != nil {
+		if msg, ok := err.(checkoutError); ok {
+			respondWithError(w, http.StatusBadRequest, string(msg))
+		} else {
+			log.Printf("Error pricing cart: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to price cart")
+		}
+		return
+	}
+
+	quote := models.CheckoutQuote{
+		CartHash:         cartFingerprint(cartItems),
+		AddressLine1:     address.Line1,
+		AddressLine2:     address.Line2,
+		City:             address.City,
+		State:            address.State,
+		PostalCode:       address.PostalCode,
+		Country:          address.Country,
+		ShippingMethodID: pricing.Shipping.MethodID,
+		CouponCode:       strings.TrimSpace(req.CouponCode),
+		Subtotal:         pricing.Subtotal,
+		Discount:         pricing.Discount.Total,
+		Shipping:         pricing.Shipping.Cost,
+		Tax:              pricing.Tax.Added,
+		Total:            pricing.Total,
+		ExpiresAt:        time.Now().Add(checkoutQuoteTTL),
+	}
+	if owner.UserID != 0 {
+		quote.UserID = &owner.UserID
+	} else {
+		quote.GuestCartID = &owner.GuestCartID
+		quote.GuestEmail = req.Email
+		quote.GuestName = req.Name
+	}
+	if err := h.db.Create(&quote).Error; err != nil {
+		log.Printf("Error creating checkout quote: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create quote")
+		return
+	}
+
+	respondWithJson(w, http.StatusCreated, map[string]any{
+		"message": "Quote created successfully",
+		"quote":   quote,
+		"pricing": pricing,
 	})
 }
@@ -0,0 +1,710 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net/http"
+	"net/smtp"
+	"os"
+	"server/models"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Email worker tuning
+const (
+	emailPollInterval = 10 * time.Second
+	emailBatchSize    = 20
+	emailMaxAttempts  = 6
+	emailBaseBackoff  = 30 * time.Second
+	emailMaxBackoff   = time.Hour
+	emailSendLease    = 5 * time.Minute
+	defaultLocale     = "en"
+)
+
+// orderStatusEmails - Template sent to the customer when an order enters a status
+var orderStatusEmails = map[models.OrderStatus]string{
+	models.OrderPending:   "order_placed",
+	models.OrderPaid:      "order_paid",
+	models.OrderCancelled: "order_cancelled",
+}
+
+// emailTemplate - Subject, plain text and HTML versions of one email
+type emailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// emailItem - An order line as shown in emails
+type emailItem struct {
+	Name     string
+	Quantity int
+	Amount   string
+}
+
+// orderEmailData - Everything the order templates can use
+type orderEmailData struct {
+	StoreName      string
+	Name           string
+	OrderID        uint
+	Items          []emailItem
+	Shipping       string
+	Tax            string
+	Discount       string
+	Total          string
+	Note           string
+	Carrier        string
+	TrackingNumber string
+	TrackingURL    string
+	LookupURL      string // Guest orders only, where to follow the order
+}
+
+// wishlistEmailData - Values available to the wishlist alert templates
+type wishlistEmailData struct {
+	StoreName  string
+	Name       string
+	Product    string
+	Price      string
+	OldPrice   string // Price drops only
+	ProductURL string
+}
+
+// storeURL - Link to a page of the storefront
+func storeURL(path string) string {
+	return strings.TrimRight(envOr("STORE_URL", "http://localhost:5173"), "/") + path
+}
+
+func mustEmailTemplate(subject, text, html string) emailTemplate {
+	return emailTemplate{
+		subject: texttemplate.Must(texttemplate.New("subject").Parse(subject)),
+		text:    texttemplate.Must(texttemplate.New("text").Parse(text)),
+		html:    htmltemplate.Must(htmltemplate.New("html").Parse(emailLayoutStart + html + emailLayoutEnd)),
+	}
+}
+
+const emailLayoutStart = `<!DOCTYPE html><html><body style="margin:0;padding:24px;background:#f4f4f5;font-family:Arial,sans-serif;color:#18181b">
+<div style="max-width:560px;margin:0 auto;background:#fff;border-radius:8px;padding:24px">
+<h2 style="margin-top:0">{{.StoreName}}</h2>
+`
+
+const emailLayoutEnd = `
+</div></body></html>`
+
+const emailItemsText = `{{range .Items}}- {{.Name}} x{{.Quantity}}: {{.Amount}}
+{{end}}`
+
+const emailItemsHTML = `<table style="width:100%;border-collapse:collapse;margin:16px 0">
+{{range .Items}}<tr><td style="padding:4px 0">{{.Name}} &times; {{.Quantity}}</td><td style="padding:4px 0;text-align:right">{{.Amount}}</td></tr>
+{{end}}</table>`
+
+// emailTemplates - Templates by locale then name, defaultLocale has them all
+var emailTemplates = map[string]map[string]emailTemplate{
+	"en": {
+		"order_placed": mustEmailTemplate(
+			"Order #{{.OrderID}} received",
+			`Hi {{.Name}},
+
+Thanks for your order #{{.OrderID}}. We will let you know as soon as the payment is confirmed.
+
+`+emailItemsText+`
+Shipping: {{.Shipping}}
+Tax: {{.Tax}}
+{{if .Discount}}Discount: -{{.Discount}}
+{{end}}Total: {{.Total}}
+{{if .LookupURL}}
+Follow your order at {{.LookupURL}}
+{{end}}
+{{.StoreName}}
+`,
+			`<p>Hi {{.Name}},</p>
+<p>Thanks for your order <b>#{{.OrderID}}</b>. We will let you know as soon as the payment is confirmed.</p>
+`+emailItemsHTML+`
+<p>Shipping: {{.Shipping}}<br>Tax: {{.Tax}}<br>{{if .Discount}}Discount: -{{.Discount}}<br>{{end}}<b>Total: {{.Total}}</b></p>
+{{if .LookupURL}}<p><a href="{{.LookupURL}}" style="color:#2563eb">Follow your order</a></p>{{end}}`),
+		"order_paid": mustEmailTemplate(
+			"Payment received for order #{{.OrderID}}",
+			`Hi {{.Name}},
+
+We received your payment of {{.Total}} for order #{{.OrderID}} and are preparing it for shipment.
+
+{{.StoreName}}
+`,
+			`<p>Hi {{.Name}},</p>
+<p>We received your payment of <b>{{.Total}}</b> for order <b>#{{.OrderID}}</b> and are preparing it for shipment.</p>`),
+		"order_shipped": mustEmailTemplate(
+			"Order #{{.OrderID}} is on its way",
+			`Hi {{.Name}},
+
+A parcel from order #{{.OrderID}} has shipped with {{.Carrier}}.
+{{if .TrackingNumber}}Tracking number: {{.TrackingNumber}}
+{{end}}{{if .TrackingURL}}Track it at {{.TrackingURL}}
+{{end}}
+`+emailItemsText+`
+{{.StoreName}}
+`,
+			`<p>Hi {{.Name}},</p>
+<p>A parcel from order <b>#{{.OrderID}}</b> has shipped with {{.Carrier}}.</p>
+{{if .TrackingNumber}}<p>Tracking number: {{.TrackingNumber}}</p>{{end}}
+{{if .TrackingURL}}<p><a href="{{.TrackingURL}}" style="color:#2563eb">Track your parcel</a></p>{{end}}
+`+emailItemsHTML),
+		"order_cancelled": mustEmailTemplate(
+			"Order #{{.OrderID}} was cancelled",
+			`Hi {{.Name}},
+
+Your order #{{.OrderID}} was cancelled.{{if .Note}} Reason: {{.Note}}{{end}}
+Any payment you made will be refunded to your original payment method.
+
+{{.StoreName}}
+`,
+			`<p>Hi {{.Name}},</p>
+<p>Your order <b>#{{.OrderID}}</b> was cancelled.{{if .Note}} Reason: {{.Note}}{{end}}</p>
+<p>Any payment you made will be refunded to your original payment method.</p>`),
+		"wishlist_back_in_stock": mustEmailTemplate(
+			"{{.Product}} is back in stock",
+			`Hi {{.Name}},
+
+{{.Product}} from your wishlist is back in stock at {{.Price}}.
+Get it before it sells out again: {{.ProductURL}}
+
+{{.StoreName}}
+`,
+			`<p>Hi {{.Name}},</p>
+<p><b>{{.Product}}</b> from your wishlist is back in stock at <b>{{.Price}}</b>.</p>
+<p><a href="{{.ProductURL}}" style="color:#2563eb">Get it before it sells out again</a></p>`),
+		"wishlist_price_drop": mustEmailTemplate(
+			"Price drop on {{.Product}}",
+			`Hi {{.Name}},
+
+{{.Product}} from your wishlist is now {{.Price}}{{if .OldPrice}} instead of {{.OldPrice}}{{end}}.
+Take a look: {{.ProductURL}}
+
+{{.StoreName}}
+`,
+			`<p>Hi {{.Name}},</p>
+<p><b>{{.Product}}</b> from your wishlist is now <b>{{.Price}}</b>{{if .OldPrice}} instead of <s>{{.OldPrice}}</s>{{end}}.</p>
+<p><a href="{{.ProductURL}}" style="color:#2563eb">Take a look</a></p>`),
+		"cart_recovery": mustEmailTemplate(
+			"You left something in your cart",
+			`Hi{{if .Name}} {{.Name}}{{end}},
+
+You left these in your cart:
+`+emailItemsText+`
+Subtotal: {{.Subtotal}}
+
+Pick up where you left off: {{.RecoveryURL}}
+
+{{.StoreName}}
+`,
+			`<p>Hi{{if .Name}} {{.Name}}{{end}},</p>
+<p>You left these in your cart:</p>
+`+emailItemsHTML+`
+<p>Subtotal: <b>{{.Subtotal}}</b></p>
+<p><a href="{{.RecoveryURL}}" style="color:#2563eb">Pick up where you left off</a></p>`),
+		"back_in_stock": mustEmailTemplate(
+			"{{.Product}} is back in stock",
+			`Hi{{if .Name}} {{.Name}}{{end}},
+
+{{.Product}} is back in stock at {{.Price}}, you asked us to let you know.
+Get it before it sells out again: {{.ProductURL}}
+
+{{.StoreName}}
+`,
+			`<p>Hi{{if .Name}} {{.Name}}{{end}},</p>
+<p><b>{{.Product}}</b> is back in stock at <b>{{.Price}}</b>, you asked us to let you know.</p>
+<p><a href="{{.ProductURL}}" style="color:#2563eb">Get it before it sells out again</a></p>`),
+		"stock_alert_digest": mustEmailTemplate(
+			"{{len .Alerts}} new stock alerts",
+			`Stock needs attention:
+
+{{range .Alerts}}- {{.Product}}: {{if eq .Type "out_of_stock"}}out of stock{{else}}{{.Stock}} left, reorder at {{.Threshold}}{{end}}
+{{end}}
+Review stock: {{.AlertsURL}}
+
+{{.StoreName}}
+`,
+			`<p>Stock needs attention:</p>
+<table style="width:100%;border-collapse:collapse;margin:16px 0">
+{{range .Alerts}}<tr><td style="padding:4px 0">{{.Product}}</td><td style="padding:4px 0;text-align:right">{{if eq .Type "out_of_stock"}}<b style="color:#dc2626">Out of stock</b>{{else}}{{.Stock}} left, reorder at {{.Threshold}}{{end}}</td></tr>
+{{end}}</table>
+<p><a href="{{.AlertsURL}}" style="color:#2563eb">Review stock</a></p>`),
+	},
+	"vi": {
+		"order_placed": mustEmailTemplate(
+			"Đã nhận đơn hàng #{{.OrderID}}",
+			`Xin chào {{.Name}},
+
+Cảm ơn bạn đã đặt đơn hàng #{{.OrderID}}. Chúng tôi sẽ thông báo ngay khi thanh toán được xác nhận.
+
+`+emailItemsText+`
+Phí vận chuyển: {{.Shipping}}
+Thuế: {{.Tax}}
+{{if .Discount}}Giảm giá: -{{.Discount}}
+{{end}}Tổng cộng: {{.Total}}
+{{if .LookupURL}}
+Theo dõi đơn hàng tại {{.LookupURL}}
+{{end}}
+{{.StoreName}}
+`,
+			`<p>Xin chào {{.Name}},</p>
+<p>Cảm ơn bạn đã đặt đơn hàng <b>#{{.OrderID}}</b>. Chúng tôi sẽ thông báo ngay khi thanh toán được xác nhận.</p>
+`+emailItemsHTML+`
+<p>Phí vận chuyển: {{.Shipping}}<br>Thuế: {{.Tax}}<br>{{if .Discount}}Giảm giá: -{{.Discount}}<br>{{end}}<b>Tổng cộng: {{.Total}}</b></p>
+{{if .LookupURL}}<p><a href="{{.LookupURL}}" style="color:#2563eb">Theo dõi đơn hàng</a></p>{{end}}`),
+		"order_paid": mustEmailTemplate(
+			"Đã nhận thanh toán cho đơn hàng #{{.OrderID}}",
+			`Xin chào {{.Name}},
+
+Chúng tôi đã nhận khoản thanh toán {{.Total}} cho đơn hàng #{{.OrderID}} và đang chuẩn bị giao hàng.
+
+{{.StoreName}}
+`,
+			`<p>Xin chào {{.Name}},</p>
+<p>Chúng tôi đã nhận khoản thanh toán <b>{{.Total}}</b> cho đơn hàng <b>#{{.OrderID}}</b> và đang chuẩn bị giao hàng.</p>`),
+		"order_shipped": mustEmailTemplate(
+			"Đơn hàng #{{.OrderID}} đang được giao",
+			`Xin chào {{.Name}},
+
+Một kiện hàng của đơn #{{.OrderID}} đã được gửi qua {{.Carrier}}.
+{{if .TrackingNumber}}Mã vận đơn: {{.TrackingNumber}}
+{{end}}{{if .TrackingURL}}Theo dõi tại {{.TrackingURL}}
+{{end}}
+`+emailItemsText+`
+{{.StoreName}}
+`,
+			`<p>Xin chào {{.Name}},</p>
+<p>Một kiện hàng của đơn <b>#{{.OrderID}}</b> đã được gửi qua {{.Carrier}}.</p>
+{{if .TrackingNumber}}<p>Mã vận đơn: {{.TrackingNumber}}</p>{{end}}
+{{if .TrackingURL}}<p><a href="{{.TrackingURL}}" style="color:#2563eb">Theo dõi kiện hàng</a></p>{{end}}
+`+emailItemsHTML),
+		"order_cancelled": mustEmailTemplate(
+			"Đơn hàng #{{.OrderID}} đã bị hủy",
+			`Xin chào {{.Name}},
+
+Đơn hàng #{{.OrderID}} của bạn đã bị hủy.{{if .Note}} Lý do: {{.Note}}{{end}}
+Khoản thanh toán (nếu có) sẽ được hoàn về phương thức thanh toán ban đầu.
+
+{{.StoreName}}
+`,
+			`<p>Xin chào {{.Name}},</p>
+<p>Đơn hàng <b>#{{.OrderID}}</b> của bạn đã bị hủy.{{if .Note}} Lý do: {{.Note}}{{end}}</p>
+<p>Khoản thanh toán (nếu có) sẽ được hoàn về phương thức thanh toán ban đầu.</p>`),
+		"wishlist_back_in_stock": mustEmailTemplate(
+			"{{.Product}} đã có hàng trở lại",
+			`Xin chào {{.Name}},
+
+{{.Product}} trong danh sách yêu thích của bạn đã có hàng trở lại với giá {{.Price}}.
+Mua ngay trước khi hết hàng: {{.ProductURL}}
+
+{{.StoreName}}
+`,
+			`<p>Xin chào {{.Name}},</p>
+<p><b>{{.Product}}</b> trong danh sách yêu thích của bạn đã có hàng trở lại với giá <b>{{.Price}}</b>.</p>
+<p><a href="{{.ProductURL}}" style="color:#2563eb">Mua ngay trước khi hết hàng</a></p>`),
+		"wishlist_price_drop": mustEmailTemplate(
+			"{{.Product}} đã giảm giá",
+			`Xin chào {{.Name}},
+
+{{.Product}} trong danh sách yêu thích của bạn hiện chỉ còn {{.Price}}{{if .OldPrice}} thay vì {{.OldPrice}}{{end}}.
+Xem ngay: {{.ProductURL}}
+
+{{.StoreName}}
+`,
+			`<p>Xin chào {{.Name}},</p>
+<p><b>{{.Product}}</b> trong danh sách yêu thích của bạn hiện chỉ còn <b>{{.Price}}</b>{{if .OldPrice}} thay vì <s>{{.OldPrice}}</s>{{end}}.</p>
+<p><a href="{{.ProductURL}}" style="color:#2563eb">Xem ngay</a></p>`),
+		"cart_recovery": mustEmailTemplate(
+			"Bạn còn sản phẩm trong giỏ hàng",
+			`Xin chào{{if .Name}} {{.Name}}{{end}},
+
+Bạn vẫn còn các sản phẩm sau trong giỏ hàng:
+`+emailItemsText+`
+Tạm tính: {{.Subtotal}}
+
+Tiếp tục mua sắm: {{.RecoveryURL}}
+
+{{.StoreName}}
+`,
+			`<p>Xin chào{{if .Name}} {{.Name}}{{end}},</p>
+<p>Bạn vẫn còn các sản phẩm sau trong giỏ hàng:</p>
+`+emailItemsHTML+`
+<p>Tạm tính: <b>{{.Subtotal}}</b></p>
+<p><a href="{{.RecoveryURL}}" style="color:#2563eb">Tiếp tục mua sắm</a></p>`),
+		"back_in_stock": mustEmailTemplate(
+			"{{.Product}} đã có hàng trở lại",
+			`Xin chào{{if .Name}} {{.Name}}{{end}},
+
+{{.Product}} mà bạn đang chờ đã có hàng trở lại với giá {{.Price}}.
+Mua ngay trước khi hết hàng: {{.ProductURL}}
+
+{{.StoreName}}
+`,
+			`<p>Xin chào{{if .Name}} {{.Name}}{{end}},</p>
+<p><b>{{.Product}}</b> mà bạn đang chờ đã có hàng trở lại với giá <b>{{.Price}}</b>.</p>
+<p><a href="{{.ProductURL}}" style="color:#2563eb">Mua ngay trước khi hết hàng</a></p>`),
+		"stock_alert_digest": mustEmailTemplate(
+			"{{len .Alerts}} cảnh báo tồn kho mới",
+			`Các sản phẩm cần chú ý:
+
+{{range .Alerts}}- {{.Product}}: {{if eq .Type "out_of_stock"}}hết hàng{{else}}còn {{.Stock}}, ngưỡng nhập thêm {{.Threshold}}{{end}}
+{{end}}
+Xem tồn kho: {{.AlertsURL}}
+
+{{.StoreName}}
+`,
+			`<p>Các sản phẩm cần chú ý:</p>
+<table style="width:100%;border-collapse:collapse;margin:16px 0">
+{{range .Alerts}}<tr><td style="padding:4px 0">{{.Product}}</td><td style="padding:4px 0;text-align:right">{{if eq .Type "out_of_stock"}}<b style="color:#dc2626">Hết hàng</b>{{else}}Còn {{.Stock}}, ngưỡng nhập thêm {{.Threshold}}{{end}}</td></tr>
+{{end}}</table>
+<p><a href="{{.AlertsURL}}" style="color:#2563eb">Xem tồn kho</a></p>`),
+	},
+}
+
+// emailLocale - Supported locale closest to the requested one
+func emailLocale(locale string) string {
+	locale = strings.ToLower(strings.TrimSpace(locale))
+	if _, ok := emailTemplates[locale]; ok {
+		return locale
+	}
+	// "vi-VN" falls back to "vi"
+	if base, _, found := strings.Cut(locale, "-"); found {
+		if _, ok := emailTemplates[base]; ok {
+			return base
+		}
+	}
+	return defaultLocale
+}
+
+// renderEmail - Subject, text and HTML of a template in a locale
+func renderEmail(locale, name string, data any) (subject, text, html string, err error) {
+	tmpl, ok := emailTemplates[locale][name]
+	if !ok {
+		if tmpl, ok = emailTemplates[defaultLocale][name]; !ok {
+			return "", "", "", fmt.Errorf("unknown email template %q", name)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = tmpl.subject.Execute(&buf, data); err != nil {
+		return
+	}
+	subject = buf.String()
+
+	buf.Reset()
+	if err = tmpl.text.Execute(&buf, data); err != nil {
+		return
+	}
+	text = buf.String()
+
+	buf.Reset()
+	if err = tmpl.html.Execute(&buf, data); err != nil {
+		return
+	}
+	html = buf.String()
+	return
+}
+
+// enqueueOrderEmail - Queues an email about an order to its customer in the
+// caller's transaction, so it is only sent if the change commits. Template
+// problems are logged rather than failing the change.
+func enqueueOrderEmail(tx *gorm.DB, orderID uint, name, note string, shipment *models.Shipment) error {
+	var order models.Order
+	if err := tx.Preload("Items").Preload("User").First(&order, orderID).Error; err != nil {
+		return err
+	}
+	to, fullName, locale := orderContact(order)
+	if to == "" {
+		return nil
+	}
+	firstName, _, _ := strings.Cut(fullName, " ")
+
+	data := orderEmailData{
+		StoreName: envOr("SELLER_NAME", "Two Idiots Store"),
+		Name:      firstName,
+		OrderID:   order.ID,
+		Shipping:  formatCents(order.Shipping),
+		Tax:       formatCents(order.Tax),
+		Total:     formatCents(order.Total),
+		Note:      note,
+	}
+	if order.Discount > 0 {
+		data.Discount = formatCents(order.Discount)
+	}
+	if order.UserID == nil {
+		data.LookupURL = orderLookupURL(order.ID)
+	}
+
+	items := order.Items
+	if shipment != nil {
+		data.Carrier = shipment.Carrier
+		data.TrackingNumber = shipment.TrackingNumber
+		data.TrackingURL = shipment.TrackingURL
+
+		// Only list what is in this parcel
+		items = nil
+		for _, shipped := range shipment.Items {
+			for _, item := range order.Items {
+				if item.ID == shipped.OrderItemID {
+					item.Quantity = shipped.Quantity
+					items = append(items, item)
+				}
+			}
+		}
+	}
+	for _, item := range items {
+		data.Items = append(data.Items, emailItem{
+			Name:     item.Name,
+			Quantity: item.Quantity,
+			Amount:   formatCents(item.Price * int64(item.Quantity)),
+		})
+	}
+
+	locale = emailLocale(locale)
+	subject, text, html, err := renderEmail(locale, name, data)
+	if err != nil {
+		log.Printf("Error rendering %s email for order %d: %v", name, order.ID, err)
+		return nil
+	}
+
+	return tx.Create(&models.EmailJob{
+		UserID:        order.UserID,
+		OrderID:       &order.ID,
+		Template:      name,
+		Locale:        locale,
+		To:            to,
+		Subject:       subject,
+		TextBody:      text,
+		HTMLBody:      html,
+		Status:        models.EmailPending,
+		NextAttemptAt: time.Now(),
+	}).Error
+}
+
+// mailer - Delivers a rendered email
+type mailer interface {
+	Send(job models.EmailJob) error
+}
+
+// smtpMailer - Sends through the SMTP server in SMTP_HOST
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// logMailer - Logs emails instead of sending them, used when SMTP is not configured
+type logMailer struct{}
+
+func (logMailer) Send(job models.EmailJob) error {
+	log.Printf("Email to %s (SMTP not configured): %s", job.To, job.Subject)
+	return nil
+}
+
+// newMailer - Mailer configured from SMTP_* environment variables
+func newMailer() mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return logMailer{}
+	}
+
+	m := &smtpMailer{
+		addr: host + ":" + envOr("SMTP_PORT", "587"),
+		from: envOr("SMTP_FROM", os.Getenv("SMTP_USER")),
+	}
+	if user := os.Getenv("SMTP_USER"); user != "" {
+		m.auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return m
+}
+
+func (m *smtpMailer) Send(job models.EmailJob) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{job.To}, buildMIMEMessage(m.from, job))
+}
+
+// buildMIMEMessage - multipart/alternative message with text and HTML parts
+func buildMIMEMessage(from string, job models.EmailJob) []byte {
+	boundaryBytes := make([]byte, 12)
+	rand.Read(boundaryBytes)
+	boundary := hex.EncodeToString(boundaryBytes)
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", job.To)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", job.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", boundary)
+
+	for _, part := range []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain", job.TextBody},
+		{"text/html", job.HTMLBody},
+	} {
+		fmt.Fprintf(&msg, "--%s\r\n", boundary)
+		fmt.Fprintf(&msg, "Content-Type: %s; charset=utf-8\r\n", part.contentType)
+		msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		qp := quotedprintable.NewWriter(&msg)
+		qp.Write([]byte(part.body))
+		qp.Close()
+		msg.WriteString("\r\n")
+	}
+	fmt.Fprintf(&msg, "--%s--\r\n", boundary)
+	return msg.Bytes()
+}
+
+// emailBackoff - Delay before retrying after the given number of attempts
+func emailBackoff(attempts int) time.Duration {
+	delay := emailBaseBackoff << (attempts - 1)
+	if delay <= 0 || delay > emailMaxBackoff {
+		return emailMaxBackoff
+	}
+	return delay
+}
+
+// RunEmailWorker - Delivers queued emails until the process exits, run it in
+// its own goroutine. Several servers can run it, jobs are claimed with a lease.
+func (h *HandlerContext) RunEmailWorker() {
+	m := newMailer()
+	ticker := time.NewTicker(emailPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Keep going while full batches come back
+		for {
+			sent, err := h.deliverEmails(m)
+			if err != nil {
+				log.Printf("Error delivering emails: %v", err)
+			}
+			if err != nil || sent < emailBatchSize {
+				break
+			}
+		}
+	}
+}
+
+// claimEmails - Leases one batch of due emails to this worker and counts the
+// attempt. Jobs whose worker died mid-send come due again once the lease ends.
+func (h *HandlerContext) claimEmails() ([]models.EmailJob, error) {
+	var jobs []models.EmailJob
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status IN ? AND next_attempt_at <= ?",
+				[]models.EmailJobStatus{models.EmailPending, models.EmailSending}, time.Now()).
+			Order("next_attempt_at, id").
+			Limit(emailBatchSize).
+			Find(&jobs).Error; err != nil {
+			return err
+		}
+		if len(jobs) == 0 {
+			return nil
+		}
+
+		ids := make([]uint, 0, len(jobs))
+		for i := range jobs {
+			ids = append(ids, jobs[i].ID)
+			jobs[i].Attempts++
+		}
+		return tx.Model(&models.EmailJob{}).Where("id IN ?", ids).Updates(map[string]any{
+			"status":          models.EmailSending,
+			"attempts":        gorm.Expr("attempts + 1"),
+			"next_attempt_at": time.Now().Add(emailSendLease),
+		}).Error
+	})
+	return jobs, err
+}
+
+// deliverEmails - Sends one batch of due emails outside any transaction so a
+// failed update never sends a mail twice, returns how many were processed
+func (h *HandlerContext) deliverEmails(m mailer) (int, error) {
+	jobs, err := h.claimEmails()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, job := range jobs {
+		updates := map[string]any{}
+		if err := m.Send(job); err != nil {
+			updates["last_error"] = err.Error()
+			if job.Attempts >= emailMaxAttempts {
+				updates["status"] = models.EmailFailed
+				log.Printf("Giving up on email %d to %s: %v", job.ID, job.To, err)
+			} else {
+				updates["status"] = models.EmailPending
+				updates["next_attempt_at"] = time.Now().Add(emailBackoff(job.Attempts))
+			}
+		} else {
+			updates["status"] = models.EmailSent
+			updates["sent_at"] = time.Now()
+		}
+
+		// A job left leased by a failed update is only retried once the lease ends
+		if err := h.db.Model(&models.EmailJob{}).Where("id = ?", job.ID).Updates(updates).Error; err != nil {
+			log.Printf("Error recording delivery of email %d: %v", job.ID, err)
+		}
+	}
+	return len(jobs), nil
+}
+
+// GetEmailJobs - Lists queued emails, optionally by status, newest first
+func (h *HandlerContext) GetEmailJobs(w http.ResponseWriter, r *http.Request) {
+	query := h.db.Order("created_at DESC").Limit(100)
+	if status := r.URL.Query().Get("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var jobs []models.EmailJob
+	if err := query.Find(&jobs).Error; err != nil {
+		log.Printf("Error fetching email jobs: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch emails")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"emails": jobs,
+	})
+}
+
+// RetryEmailJob - Puts a failed email back in the queue with fresh attempts
+func (h *HandlerContext) RetryEmailJob(w http.ResponseWriter, r *http.Request) {
+	jobIDStr := chi.URLParam(r, "id")
+	jobID, err := strconv.ParseUint(jobIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid email ID")
+		return
+	}
+
+	result := h.db.Model(&models.EmailJob{}).
+		Where("id = ? AND status = ?", jobID, models.EmailFailed).
+		Updates(map[string]any{
+			"status":          models.EmailPending,
+			"attempts":        0,
+			"next_attempt_at": time.Now(),
+		})
+	if result.Error != nil {
+		log.Printf("Error retrying email: %v", result.Error)
+		respondWithError(w, http.StatusInternalServerError, "Failed to retry email")
+		return
+	}
+	if result.RowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "No failed email with that ID")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message": "Email queued for retry",
+	})
+}
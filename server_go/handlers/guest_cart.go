@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"server/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Guest carts travel in a cookie for same-site clients and in a header for the
+// SPA, which talks to the API cross-origin without credentials
+const (
+	cartTokenCookie = "cart_token"
+	cartTokenHeader = "X-Cart-Token"
+	guestCartTTL    = 30 * 24 * time.Hour
+)
+
+// cartOwner - Whose cart a request works on, exactly one ID is set unless the
+// visitor has no cart yet
+type cartOwner struct {
+	UserID      uint
+	GuestCartID uint
+}
+
+// empty reports whether the visitor has no cart at all
+func (o cartOwner) empty() bool {
+	return o.UserID == 0 && o.GuestCartID == 0
+}
+
+// scope - Restricts a cart query to the owner's items
+func (o cartOwner) scope(db *gorm.DB) *gorm.DB {
+	if o.UserID != 0 {
+		return db.Where("user_id = ?", o.UserID)
+	}
+	return db.Where("guest_cart_id = ?", o.GuestCartID)
+}
+
+// newItem - An empty cart row belonging to the owner
+func (o cartOwner) newItem() models.Cart {
+	item := models.Cart{}
+	if o.UserID != 0 {
+		userID := o.UserID
+		item.UserID = &userID
+	} else {
+		guestCartID := o.GuestCartID
+		item.GuestCartID = &guestCartID
+	}
+	return item
+}
+
+// signingSecret - Key signing guest cart and order lookup tokens
+func signingSecret() []byte {
+	return []byte(envOr("SIGNING_SECRET", jwtSecret))
+}
+
+// signID - Token binding an ID to a purpose, forgeries and tokens issued for
+// another purpose fail the HMAC check
+func signID(purpose string, id uint) string {
+	payload := strconv.FormatUint(uint64(id), 36)
+	mac := hmac.New(sha256.New, signingSecret())
+	mac.Write([]byte(purpose + ":" + payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseSignedID - ID of a valid token signed for purpose
+func parseSignedID(purpose, token string) (uint, bool) {
+	payload, _, found := strings.Cut(token, ".")
+	if !found {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(payload, 36, 32)
+	if err != nil || !hmac.Equal([]byte(signID(purpose, uint(id))), []byte(token)) {
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// cartTokenFromRequest - Guest cart token sent in the header or the cookie
+func cartTokenFromRequest(r *http.Request) string {
+	if token := r.Header.Get(cartTokenHeader); token != "" {
+		return token
+	}
+	if cookie, err := r.Cookie(cartTokenCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// setCartToken - Hands a guest cart token to the client
+func setCartToken(w http.ResponseWriter, token string) {
+	w.Header().Set(cartTokenHeader, token)
+	http.SetCookie(w, &http.Cookie{
+		Name:     cartTokenCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(guestCartTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearCartToken - Tells the client to forget its guest cart
+func clearCartToken(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cartTokenCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// guestCartFromRequest - The live guest cart named by the request's token
+func (h *HandlerContext) guestCartFromRequest(r *http.Request) (uint, bool) {
+	guestCartID, ok := parseSignedID("guest-cart", cartTokenFromRequest(r))
+	if !ok {
+		return 0, false
+	}
+
+	result := h.db.Model(&models.GuestCart{}).
+		Where("id = ? AND last_seen_at > ?", guestCartID, time.Now().Add(-guestCartTTL)).
+		Update("last_seen_at", time.Now())
+	if result.Error != nil {
+		log.Printf("Error touching guest cart %d: %v", guestCartID, result.Error)
+		return 0, false
+	}
+	return guestCartID, result.RowsAffected > 0
+}
+
+// resolveCartOwner - The signed-in user from the userId query, otherwise the
+// guest cart from the cart token. With create, a visitor without a cart gets
+// a new guest cart and token. Responds with an error when it fails.
+func (h *HandlerContext) resolveCartOwner(w http.ResponseWriter, r *http.Request, create bool) (cartOwner, bool) {
+	if userIDStr := r.URL.Query().Get("userId"); userIDStr != "" {
+		userID, err := strconv.ParseUint(userIDStr, 10, 32)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid userId")
+			return cartOwner{}, false
+		}
+		return cartOwner{UserID: uint(userID)}, true
+	}
+
+	if guestCartID, ok := h.guestCartFromRequest(r); ok {
+		return cartOwner{GuestCartID: guestCartID}, true
+	}
+	if !create {
+		return cartOwner{}, true
+	}
+
+	guestCart := models.GuestCart{LastSeenAt: time.Now()}
+	if err := h.db.Create(&guestCart).Error; err != nil {
+		log.Printf("Error creating guest cart: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create cart")
+		return cartOwner{}, false
+	}
+	setCartToken(w, signID("guest-cart", guestCart.ID))
+	return cartOwner{GuestCartID: guestCart.ID}, true
+}
+
+// cartAdjustment - A guest cart line that could not be merged as it was
+type cartAdjustment struct {
+	ProductID uint   `json:"productId"`
+	Name      string `json:"name"`
+	Requested int    `json:"requested"` // Quantity the merged line would have had
+	Quantity  int    `json:"quantity"`  // Quantity now in the cart
+	Reason    string `json:"reason"`
+}
+
+// cartMergeReport - Outcome of merging a guest cart at sign in
+type cartMergeReport struct {
+	Merged      int              `json:"merged"` // Lines moved into the user's cart
+	Adjustments []cartAdjustment `json:"adjustments"`
+}
+
+// mergeGuestCart - Moves a guest cart into the user's cart, adding quantities
+// of products already there and capping every line at what can be sold:
+// unreserved stock plus the units left to backorder or pre-order.
+// The guest cart is deleted.
+func (h *HandlerContext) mergeGuestCart(userID, guestCartID uint) (cartMergeReport, error) {
+	report := cartMergeReport{Adjustments: []cartAdjustment{}}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var guestItems []models.Cart
+		if err := tx.Preload("Product").Where("guest_cart_id = ?", guestCartID).Order("id").Find(&guestItems).Error; err != nil {
+			return err
+		}
+		if err := fillCartAvailable(tx, guestItems); err != nil {
+			return err
+		}
+
+		for _, guestItem := range guestItems {
+			var userItem models.Cart
+			err := tx.Where("user_id = ? AND product_id = ?", userID, guestItem.ProductID).First(&userItem).Error
+			if err != nil && err != gorm.ErrRecordNotFound {
+				return err
+			}
+			exists := err == nil
+
+			// Held units are not for sale, backorders and pre-orders are
+			stock := sellable(guestItem.Product)
+			if guestItem.Product.ArchivedAt != nil {
+				stock = 0
+			}
+			requested := userItem.Quantity + guestItem.Quantity
+			quantity := min(requested, stock)
+			if quantity < requested {
+				adjustment := cartAdjustment{
+					ProductID: guestItem.ProductID,
+					Name:      guestItem.Product.Name,
+					Requested: requested,
+					Quantity:  max(quantity, userItem.Quantity),
+					Reason:    fmt.Sprintf("Only %d available", max(stock, 0)),
+				}
+				if guestItem.Product.ArchivedAt != nil {
+					adjustment.Reason = "No longer available"
+				} else if stock <= 0 {
+					adjustment.Reason = "Out of stock"
+				}
+				report.Adjustments = append(report.Adjustments, adjustment)
+			}
+			// Never shrink what the user already had
+			if quantity <= userItem.Quantity {
+				continue
+			}
+
+			if exists {
+				if err := tx.Model(&userItem).Update("quantity", quantity).Error; err != nil {
+					return err
+				}
+			} else {
+				item := cartOwner{UserID: userID}.newItem()
+				item.ProductID = guestItem.ProductID
+				item.Quantity = quantity
+				item.PriceAtAdd = guestItem.PriceAtAdd
+				if err := tx.Create(&item).Error; err != nil {
+					return err
+				}
+			}
+			report.Merged++
+		}
+
+		if err := tx.Where("guest_cart_id = ?", guestCartID).Delete(&models.Cart{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.GuestCart{}, guestCartID).Error
+	})
+	return report, err
+}
+
+// mergeGuestCartOnSignin - Merges the request's guest cart, if any, into the
+// user's cart. Failures are logged, they never block signing in.
+func (h *HandlerContext) mergeGuestCartOnSignin(w http.ResponseWriter, r *http.Request, userID uint) *cartMergeReport {
+	guestCartID, ok := h.guestCartFromRequest(r)
+	if !ok {
+		return nil
+	}
+
+	report, err := h.mergeGuestCart(userID, guestCartID)
+	if err != nil {
+		log.Printf("Error merging guest cart %d into user %d: %v", guestCartID, userID, err)
+		return nil
+	}
+	clearCartToken(w)
+	return &report
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"server/models"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// orderLookupToken - Signed token letting whoever holds it view one order
+// without signing in
+func orderLookupToken(orderID uint) string {
+	return signID("order-lookup", orderID)
+}
+
+// orderLookupURL - Storefront page showing the order for a lookup token
+func orderLookupURL(orderID uint) string {
+	return storeURL("/orders/lookup/" + orderLookupToken(orderID))
+}
+
+// orderContact - Who to address about an order, the account holder once the
+// order belongs to one and the guest checkout details otherwise. The order
+// needs its User preloaded.
+func orderContact(order models.Order) (email, name, locale string) {
+	if order.UserID != nil && order.User.Email != "" {
+		return order.User.Email, strings.TrimSpace(order.User.FirstName + " " + order.User.LastName), order.User.Locale
+	}
+	return order.GuestEmail, order.GuestName, defaultLocale
+}
+
+// GetGuestOrder - An order and its timeline for the holder of its signed
+// lookup link, how guests follow their orders
+func (h *HandlerContext) GetGuestOrder(w http.ResponseWriter, r *http.Request) {
+	orderID, ok := parseSignedID("order-lookup", chi.URLParam(r, "token"))
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	var order models.Order
+	if err := h.customerOrderQuery().Where("id = ?", orderID).First(&order).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Order not found")
+		} else {
+			log.Printf("Error fetching order: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Error fetching order")
+		}
+		return
+	}
+
+	events, err := h.orderTimeline(order.ID)
+	if err != nil {
+		log.Printf("Error fetching order events: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch order timeline")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message": "Order retrieved successfully",
+		"order":   order,
+		"events":  events,
+	})
+}
+
+// ClaimGuestOrder - Moves the guest order behind a signed lookup link into the
+// signed-in user's account. Only the link, which went to the guest's email,
+// proves the order is theirs, matching emails are not enough.
+func (h *HandlerContext) ClaimGuestOrder(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromRequest(r)
+	if userID == 0 {
+		respondWithError(w, http.StatusUnauthorized, "Missing authorization token")
+		return
+	}
+
+	orderID, ok := parseSignedID("order-lookup", chi.URLParam(r, "token"))
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Order not found")
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var order models.Order
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "user_id").First(&order, orderID).Error; err != nil {
+			return err
+		}
+		if order.UserID != nil {
+			if *order.UserID == userID {
+				return nil
+			}
+			return orderStatusError("Order already belongs to an account")
+		}
+
+		if err := tx.Model(&models.Order{}).Where("id = ?", orderID).Update("user_id", userID).Error; err != nil {
+			return err
+		}
+		// Coupon usage moves along so per customer limits count the claimed order
+		if err := tx.Model(&models.PromotionRedemption{}).
+			Where("order_id = ? AND user_id IS NULL", orderID).
+			Update("user_id", userID).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.EmailJob{}).
+			Where("order_id = ? AND user_id IS NULL", orderID).
+			Update("user_id", userID).Error
+	})
+	if err != nil {
+		if msg, ok := err.(orderStatusError); ok {
+			respondWithError(w, http.StatusConflict, string(msg))
+		} else if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Order not found")
+		} else {
+			log.Printf("Error claiming guest order %d for user %d: %v", orderID, userID, err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to claim order")
+		}
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message": "Order added to your account",
+		"orderId": orderID,
+	})
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"server/models"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	idempotencyKeyTTL    = 24 * time.Hour
+	// A first request still unfinished after this crashed, its key can be used again
+	idempotencyStaleAfter = 2 * time.Minute
+)
+
+// idempotencyRecorder - Captures the response so it can be stored for replays
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *idempotencyRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(data)
+	return rec.ResponseWriter.Write(data)
+}
+
+// IdempotencyMiddleware - Replays the stored response when a mutating request
+// is retried with the same Idempotency-Key header
+func (h *HandlerContext) IdempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > 255 {
+			respondWithError(w, http.StatusBadRequest, "Idempotency key is too long")
+			return
+		}
+
+		// Keys are scoped per user, and per guest cart for anonymous requests.
+		// Routes behind AuthMiddleware take the user from the token.
+		userID, _ := strconv.ParseUint(r.URL.Query().Get("userId"), 10, 32)
+		if tokenUserID := getUserIDFromRequest(r); tokenUserID != 0 {
+			userID = uint64(tokenUserID)
+		}
+		guestScope := ""
+		if token := cartTokenFromRequest(r); userID == 0 && token != "" {
+			sum := sha256.Sum256([]byte(token))
+			guestScope = hex.EncodeToString(sum[:])
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		hash.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		// Forget keys that are past their retention window, and those whose
+		// first request never finished
+		if err := h.db.Where("\"key\" = ? AND user_id = ? AND guest_scope = ?", key, userID, guestScope).
+			Where("created_at < ? OR (status_code = 0 AND created_at < ?)", time.Now().Add(-idempotencyKeyTTL), time.Now().Add(-idempotencyStaleAfter)).
+			Delete(&models.IdempotencyKey{}).Error; err != nil {
+			log.Printf("Error expiring idempotency key: %v", err)
+		}
+
+		record := models.IdempotencyKey{
+			Key:         key,
+			UserID:      uint(userID),
+			GuestScope:  guestScope,
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			RequestHash: requestHash,
+		}
+		result := h.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+		if result.Error != nil {
+			log.Printf("Error storing idempotency key: %v", result.Error)
+			respondWithError(w, http.StatusInternalServerError, "Failed to store idempotency key")
+			return
+		}
+
+		// The key was already used, replay or reject
+		if result.RowsAffected == 0 {
+			var existing models.IdempotencyKey
+			if err := h.db.Where("\"key\" = ? AND user_id = ? AND guest_scope = ?", key, userID, guestScope).First(&existing).Error; err != nil {
+				log.Printf("Error fetching idempotency key: %v", err)
+				respondWithError(w, http.StatusInternalServerError, "Failed to fetch idempotency key")
+				return
+			}
+
+			if existing.RequestHash != requestHash {
+				respondWithError(w, http.StatusConflict, "Idempotency key was already used with a different request")
+				return
+			}
+
+			if existing.StatusCode == 0 {
+				respondWithError(w, http.StatusConflict, "A request with this idempotency key is still being processed")
+				return
+			}
+
+			if existing.ContentType != "" {
+				w.Header().Set("Content-Type", existing.ContentType)
+			}
+			// A guest whose first request created the cart needs its token again
+			if existing.CartToken != "" {
+				setCartToken(w, existing.CartToken)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(existing.StatusCode)
+			w.Write(existing.ResponseBody)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		// Server errors are not stored so the client can safely retry
+		if rec.status >= 500 {
+			if err := h.db.Delete(&record).Error; err != nil {
+				log.Printf("Error releasing idempotency key: %v", err)
+			}
+			return
+		}
+
+		if err := h.db.Model(&record).Updates(map[string]any{
+			"status_code":   rec.status,
+			"content_type":  w.Header().Get("Content-Type"),
+			"response_body": rec.body.Bytes(),
+			"cart_token":    w.Header().Get(cartTokenHeader),
+		}).Error; err != nil {
+			log.Printf("Error saving idempotent response: %v", err)
+		}
+	})
+}
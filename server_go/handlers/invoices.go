@@ -0,0 +1,490 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"server/models"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// Key of the advisory lock serializing invoice numbering
+const invoiceSequenceLock = 360036
+
+// invoiceError - An order that cannot be invoiced yet
+type invoiceError string
+
+func (e invoiceError) Error() string {
+	return string(e)
+}
+
+// envOr - Environment variable or a fallback when unset
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envDuration - A Go duration such as 30m from the environment, fallback when
+// unset or invalid
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		return d
+	}
+	log.Printf("Invalid %s %q, using %s", key, value, fallback)
+	return fallback
+}
+
+// issueInvoice - Issues the invoice of an order with the next number and
+// the totals charged, orders that have one keep it. Run it in the transaction
+// that marks the order paid so numbers follow payments.
+func issueInvoice(tx *gorm.DB, orderID uint) (*models.Invoice, error) {
+	// Numbers must be gapless, so issuing is serialized instead of using a sequence
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", invoiceSequenceLock).Error; err != nil {
+		return nil, err
+	}
+	var invoice models.Invoice
+	err := tx.Where("order_id = ?", orderID).First(&invoice).Error
+	if err == nil {
+		return &invoice, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	var order models.Order
+	if err := tx.Select("id", "discount", "shipping", "tax", "total").First(&order, orderID).Error; err != nil {
+		return nil, err
+	}
+	var last int64
+	if err := tx.Model(&models.Invoice{}).Select("COALESCE(MAX(sequence), 0)").Scan(&last).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	invoice = models.Invoice{
+		OrderID:       order.ID,
+		Sequence:      last + 1,
+		Number:        fmt.Sprintf("%s-%d-%06d", envOr("INVOICE_PREFIX", "INV"), now.Year(), last+1),
+		SellerName:    envOr("SELLER_NAME", "Two Idiots Store"),
+		SellerAddress: os.Getenv("SELLER_ADDRESS"),
+		SellerTaxID:   os.Getenv("SELLER_TAX_ID"),
+		SellerEmail:   os.Getenv("SELLER_EMAIL"),
+		Discount:      order.Discount,
+		Shipping:      order.Shipping,
+		Tax:           order.Tax,
+		Total:         order.Total,
+		IssuedAt:      now,
+	}
+	if err := tx.Create(&invoice).Error; err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+// orderInvoice - The order's invoice. Orders paid before invoices were issued
+// on payment get theirs now, unpaid orders are refused with an invoiceError.
+func (h *HandlerContext) orderInvoice(order models.Order) (*models.Invoice, error) {
+	var invoice models.Invoice
+	err := h.db.Where("order_id = ?", order.ID).First(&invoice).Error
+	if err == nil {
+		// Invoices issued before totals were kept take them from the order once
+		if invoice.Total == 0 && order.Total != 0 {
+			invoice.Discount, invoice.Shipping, invoice.Tax, invoice.Total = order.Discount, order.Shipping, order.Tax, order.Total
+			if err := h.db.Model(&invoice).Updates(map[string]any{
+				"discount": invoice.Discount,
+				"shipping": invoice.Shipping,
+				"tax":      invoice.Tax,
+				"total":    invoice.Total,
+			}).Error; err != nil {
+				return nil, err
+			}
+		}
+		return &invoice, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	if order.Status == models.OrderPending || (order.Status == models.OrderCancelled && order.Refunded == 0) {
+		return nil, invoiceError("Order has not been paid")
+	}
+
+	var issued *models.Invoice
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		issued, err = issueInvoice(tx, order.ID)
+		return err
+	})
+	return issued, err
+}
+
+// addressLines - Non-empty lines of an order's shipping address
+func addressLines(order models.Order) []string {
+	var lines []string
+	for _, line := range []string{
+		order.AddressLine1,
+		order.AddressLine2,
+		strings.TrimSpace(strings.Join([]string{order.City, order.State, order.PostalCode}, " ")),
+		order.Country,
+	} {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// renderInvoice - Invoice PDF of an order with the totals charged as of
+// issuing, refunds made since do not change it. Items and user must be
+// preloaded.
+func renderInvoice(order models.Order, invoice models.Invoice) []byte {
+	doc := newPDFDocument()
+	right := pdfPageWidth - pdfMargin
+
+	doc.text(pdfMargin, 22, true, "INVOICE")
+	doc.textRight(right, 10, true, invoice.Number)
+	doc.newline(16)
+	doc.textRight(right, 10, false, "Issued "+invoice.IssuedAt.Format("January 2, 2006"))
+	doc.newline(14)
+	doc.textRight(right, 10, false, fmt.Sprintf("Order #%d, placed %s", order.ID, order.CreatedAt.Format("January 2, 2006")))
+	doc.newline(28)
+
+	// Seller on the left, customer on the right
+	seller := []string{invoice.SellerName}
+	seller = append(seller, strings.Split(strings.ReplaceAll(invoice.SellerAddress, `\n`, "\n"), "\n")...)
+	if invoice.SellerTaxID != "" {
+		seller = append(seller, "Tax ID: "+invoice.SellerTaxID)
+	}
+	if invoice.SellerEmail != "" {
+		seller = append(seller, invoice.SellerEmail)
+	}
+	email, name, _ := orderContact(order)
+	customer := []string{name}
+	customer = append(customer, addressLines(order)...)
+	customer = append(customer, email)
+
+	doc.text(pdfMargin, 10, true, "From")
+	doc.text(320, 10, true, "Bill to")
+	doc.newline(14)
+	for i := 0; i < max(len(seller), len(customer)); i++ {
+		if i < len(seller) && strings.TrimSpace(seller[i]) != "" {
+			doc.text(pdfMargin, 10, false, strings.TrimSpace(seller[i]))
+		}
+		if i < len(customer) && customer[i] != "" {
+			doc.text(320, 10, false, customer[i])
+		}
+		doc.newline(13)
+	}
+	doc.newline(16)
+
+	header := func() {
+		doc.text(pdfMargin, 9, true, "Item")
+		doc.textRight(330, 9, true, "Qty")
+		doc.textRight(400, 9, true, "Unit price")
+		doc.textRight(460, 9, true, "Discount")
+		doc.textRight(510, 9, true, "Tax")
+		doc.textRight(right, 9, true, "Amount")
+		doc.rule()
+		doc.newline(16)
+	}
+	header()
+
+	var subtotal, itemTax, includedTax int64
+	taxByRate := make(map[float64][2]int64) // Taxable amount and tax per rate
+	for _, item := range order.Items {
+		if doc.y-14 < pdfMargin {
+			doc.addPage()
+			header()
+		}
+
+		amount := item.Price*int64(item.Quantity) - item.Discount
+		subtotal += item.Price * int64(item.Quantity)
+		itemTax += item.Tax
+
+		name := item.Name
+		if len(name) > 45 {
+			name = name[:42] + "..."
+		}
+		doc.text(pdfMargin, 9, false, name)
+		doc.textRight(330, 9, false, strconv.Itoa(item.Quantity))
+		doc.textRight(400, 9, false, formatCents(item.Price))
+		if item.Discount > 0 {
+			doc.textRight(460, 9, false, "-"+formatCents(item.Discount))
+		}
+		doc.textRight(510, 9, false, fmt.Sprintf("%.2f%%", item.TaxRate*100))
+		doc.textRight(right, 9, false, formatCents(amount))
+		doc.newline(14)
+
+		taxable := amount
+		if item.TaxIncluded {
+			taxable -= item.Tax
+			includedTax += item.Tax
+		}
+		totals := taxByRate[item.TaxRate]
+		taxByRate[item.TaxRate] = [2]int64{totals[0] + taxable, totals[1] + item.Tax}
+	}
+	doc.rule()
+	doc.newline(20)
+
+	type summaryLine struct {
+		label  string
+		amount int64
+		bold   bool
+	}
+	shippingLabel := "Shipping"
+	if order.ShippingMethodName != "" {
+		shippingLabel += " (" + order.ShippingMethodName + ")"
+	}
+	// Tax inside prices is already part of the subtotal, it is only shown
+	summary := []summaryLine{
+		{"Subtotal", subtotal, false},
+		{"Discounts", -invoice.Discount, false},
+		{shippingLabel, invoice.Shipping, false},
+		{"Tax", invoice.Tax - includedTax, false},
+		{"Total", invoice.Total, true},
+	}
+	if includedTax > 0 {
+		summary = append(summary, summaryLine{"Tax included in prices", includedTax, false})
+	}
+	for _, line := range summary {
+		if line.amount == 0 && !line.bold && line.label != "Subtotal" {
+			continue
+		}
+		doc.ensureSpace(14)
+		doc.textRight(460, 10, line.bold, line.label)
+		value := formatCents(line.amount)
+		if line.amount < 0 {
+			value = "-" + formatCents(-line.amount)
+		}
+		doc.textRight(right, 10, line.bold, value)
+		doc.newline(14)
+	}
+
+	// Tax breakdown for accounting, shipping tax is whatever the lines do not carry
+	doc.newline(16)
+	doc.ensureSpace(60)
+	doc.text(pdfMargin, 10, true, "Tax breakdown")
+	doc.newline(14)
+	rates := make([]float64, 0, len(taxByRate))
+	for rate := range taxByRate {
+		rates = append(rates, rate)
+	}
+	sort.Float64s(rates)
+	for _, rate := range rates {
+		totals := taxByRate[rate]
+		doc.ensureSpace(13)
+		doc.text(pdfMargin, 9, false, fmt.Sprintf("%.2f%% on %s", rate*100, formatCents(totals[0])))
+		doc.textRight(260, 9, false, formatCents(totals[1]))
+		doc.newline(13)
+	}
+	if shippingTax := invoice.Tax - itemTax; shippingTax > 0 {
+		doc.ensureSpace(13)
+		doc.text(pdfMargin, 9, false, "Shipping")
+		doc.textRight(260, 9, false, formatCents(shippingTax))
+		doc.newline(13)
+	}
+
+	return doc.bytes()
+}
+
+// renderPackingSlip - Packing slip PDF of an order, without prices, with the
+// gift message to print for the recipient. Items, user, shipments and gift
+// message notes must be preloaded.
+func renderPackingSlip(order models.Order) []byte {
+	doc := newPDFDocument()
+	right := pdfPageWidth - pdfMargin
+
+	doc.text(pdfMargin, 22, true, "PACKING SLIP")
+	doc.textRight(right, 10, true, fmt.Sprintf("Order #%d", order.ID))
+	doc.newline(16)
+	doc.textRight(right, 10, false, "Placed "+order.CreatedAt.Format("January 2, 2006"))
+	doc.newline(28)
+
+	doc.text(pdfMargin, 10, true, "Ship to")
+	if order.ShippingMethodName != "" {
+		doc.text(320, 10, true, "Shipping method")
+	}
+	doc.newline(14)
+	_, name, _ := orderContact(order)
+	shipTo := append([]string{name}, addressLines(order)...)
+	for i, line := range shipTo {
+		doc.text(pdfMargin, 10, false, line)
+		if i == 0 && order.ShippingMethodName != "" {
+			doc.text(320, 10, false, order.ShippingMethodName)
+		}
+		doc.newline(13)
+	}
+	doc.newline(16)
+
+	header := func() {
+		doc.text(pdfMargin, 9, true, "Item")
+		doc.textRight(380, 9, true, "Product #")
+		doc.textRight(450, 9, true, "Ordered")
+		doc.textRight(right, 9, true, "To pack")
+		doc.rule()
+		doc.newline(16)
+	}
+	header()
+
+	for _, item := range order.Items {
+		if doc.y-14 < pdfMargin {
+			doc.addPage()
+			header()
+		}
+
+		name := item.Name
+		if len(name) > 55 {
+			name = name[:52] + "..."
+		}
+		toPack := max(item.Quantity-item.CancelledQuantity-item.ShippedQuantity-item.BackorderedQuantity, 0)
+		doc.text(pdfMargin, 9, false, name)
+		doc.textRight(380, 9, false, strconv.FormatUint(uint64(item.ProductID), 10))
+		doc.textRight(450, 9, false, strconv.Itoa(item.Quantity))
+		doc.textRight(right, 9, true, strconv.Itoa(toPack))
+		doc.newline(14)
+	}
+	doc.rule()
+	doc.newline(20)
+
+	for _, note := range order.Notes {
+		if note.Kind != giftMessageNote {
+			continue
+		}
+		doc.ensureSpace(40)
+		doc.text(pdfMargin, 10, true, "Gift message")
+		doc.newline(14)
+		for _, line := range pdfWrap(note.Body, 10, right-pdfMargin) {
+			doc.ensureSpace(13)
+			doc.text(pdfMargin, 10, false, line)
+			doc.newline(13)
+		}
+		doc.newline(16)
+	}
+
+	if len(order.Shipments) > 0 {
+		doc.ensureSpace(40)
+		doc.text(pdfMargin, 10, true, "Already shipped")
+		doc.newline(14)
+		for _, shipment := range order.Shipments {
+			doc.ensureSpace(13)
+			doc.text(pdfMargin, 9, false, fmt.Sprintf("%s %s on %s", shipment.Carrier, shipment.TrackingNumber,
+				shipment.ShippedAt.Format("January 2, 2006")))
+			doc.newline(13)
+		}
+	}
+
+	return doc.bytes()
+}
+
+// respondWithPDF - Sends a PDF as a download
+func respondWithPDF(w http.ResponseWriter, filename string, data []byte) {
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// loadDocumentOrder - Fetches the order in the URL for a document, restricted
+// to the signed in customer unless asAdmin, responding with an error when it cannot
+func (h *HandlerContext) loadDocumentOrder(w http.ResponseWriter, r *http.Request, asAdmin bool) (*models.Order, bool) {
+	orderIDStr := chi.URLParam(r, "id")
+	orderID, err := strconv.ParseUint(orderIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order ID")
+		return nil, false
+	}
+
+	query := h.db.Preload("Items").Preload("User").Preload("Shipments").
+		Preload("Notes", "kind = ?", giftMessageNote).
+		Where("id = ?", orderID)
+	if !asAdmin {
+		userId := getUserIDFromRequest(r)
+		if userId == 0 {
+			respondWithError(w, http.StatusUnauthorized, "Missing authorization token")
+			return nil, false
+		}
+		query = query.Where("user_id = ?", userId)
+	}
+
+	var order models.Order
+	if err := query.First(&order).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Order not found")
+		} else {
+			log.Printf("Error fetching order: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Error fetching order")
+		}
+		return nil, false
+	}
+	return &order, true
+}
+
+// sendInvoice - Responds with the invoice PDF of the order in the URL
+func (h *HandlerContext) sendInvoice(w http.ResponseWriter, r *http.Request, asAdmin bool) {
+	order, ok := h.loadDocumentOrder(w, r, asAdmin)
+	if !ok {
+		return
+	}
+
+	invoice, err := h.orderInvoice(*order)
+	if err != nil {
+		if msg, ok := err.(invoiceError); ok {
+			respondWithError(w, http.StatusConflict, string(msg))
+		} else {
+			log.Printf("Error issuing invoice for order %d: %v", order.ID, err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to issue invoice")
+		}
+		return
+	}
+
+	respondWithPDF(w, invoice.Number+".pdf", renderInvoice(*order, *invoice))
+}
+
+// sendPackingSlip - Responds with the packing slip PDF of the order in the URL
+func (h *HandlerContext) sendPackingSlip(w http.ResponseWriter, r *http.Request, asAdmin bool) {
+	order, ok := h.loadDocumentOrder(w, r, asAdmin)
+	if !ok {
+		return
+	}
+
+	if order.Status == models.OrderPending || order.Status == models.OrderCancelled {
+		respondWithError(w, http.StatusConflict, "Order has nothing to pack")
+		return
+	}
+
+	respondWithPDF(w, fmt.Sprintf("packing-slip-%d.pdf", order.ID), renderPackingSlip(*order))
+}
+
+// GetInvoice - Invoice PDF of one of the user's orders
+func (h *HandlerContext) GetInvoice(w http.ResponseWriter, r *http.Request) {
+	h.sendInvoice(w, r, false)
+}
+
+// GetPackingSlip - Packing slip PDF of one of the user's orders
+func (h *HandlerContext) GetPackingSlip(w http.ResponseWriter, r *http.Request) {
+	h.sendPackingSlip(w, r, false)
+}
+
+// GetInvoiceAdmin - Invoice PDF of any order
+func (h *HandlerContext) GetInvoiceAdmin(w http.ResponseWriter, r *http.Request) {
+	h.sendInvoice(w, r, true)
+}
+
+// GetPackingSlipAdmin - Packing slip PDF of any order
+func (h *HandlerContext) GetPackingSlipAdmin(w http.ResponseWriter, r *http.Request) {
+	h.sendPackingSlip(w, r, true)
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"server/models"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// Kinds of order notes
+const (
+	staffNote       = "note"
+	giftMessageNote = "gift_message" // From the customer at checkout, printed on the packing slip
+)
+
+// GetOrderNotes - Lists every note on an order, oldest first
+func (h *HandlerContext) GetOrderNotes(w http.ResponseWriter, r *http.Request) {
+	orderIDStr := chi.URLParam(r, "id")
+	orderID, err := strconv.ParseUint(orderIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var notes []models.OrderNote
+	if err := h.db.Where("order_id = ?", orderID).Order("created_at, id").Find(&notes).Error; err != nil {
+		log.Printf("Error fetching order notes: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch notes")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"notes": notes,
+	})
+}
+
+// CreateOrderNote - Adds a staff note to an order, internal unless the
+// visibility is "customer"
+func (h *HandlerContext) CreateOrderNote(w http.ResponseWriter, r *http.Request) {
+	orderIDStr := chi.URLParam(r, "id")
+	orderID, err := strconv.ParseUint(orderIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	adminID, _ := strconv.ParseUint(r.URL.Query().Get("userId"), 10, 32)
+
+	var reqBody struct {
+		Body       string                     `json:"body"`
+		Visibility models.OrderNoteVisibility `json:"visibility"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	reqBody.Body = strings.TrimSpace(reqBody.Body)
+	if reqBody.Body == "" {
+		respondWithError(w, http.StatusBadRequest, "Note body is required")
+		return
+	}
+	switch reqBody.Visibility {
+	case "":
+		reqBody.Visibility = models.NoteInternal
+	case models.NoteInternal, models.NoteCustomer:
+	default:
+		respondWithError(w, http.StatusBadRequest, "Visibility must be internal or customer")
+		return
+	}
+
+	var order models.Order
+	if err := h.db.Select("id").First(&order, orderID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Order not found")
+		} else {
+			log.Printf("Error fetching order: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Error fetching order")
+		}
+		return
+	}
+
+	note := models.OrderNote{
+		OrderID:    order.ID,
+		Visibility: reqBody.Visibility,
+		Kind:       staffNote,
+		Body:       reqBody.Body,
+		AuthorRole: actorAdmin,
+	}
+	if adminID != 0 {
+		adminUserID := uint(adminID)
+		note.AuthorID = &adminUserID
+	}
+	if err := h.db.Create(&note).Error; err != nil {
+		log.Printf("Error creating order note: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create note")
+		return
+	}
+
+	respondWithJson(w, http.StatusCreated, map[string]any{
+		"message": "Note added successfully",
+		"note":    note,
+	})
+}
+
+// DeleteOrderNote - Removes a note from an order
+func (h *HandlerContext) DeleteOrderNote(w http.ResponseWriter, r *http.Request) {
+	orderIDStr := chi.URLParam(r, "id")
+	orderID, err := strconv.ParseUint(orderIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	noteIDStr := chi.URLParam(r, "noteId")
+	noteID, err := strconv.ParseUint(noteIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid note ID")
+		return
+	}
+
+	result := h.db.Where("id = ? AND order_id = ?", noteID, orderID).Delete(&models.OrderNote{})
+	if result.Error != nil {
+		log.Printf("Error deleting order note: %v", result.Error)
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete note")
+		return
+	}
+	if result.RowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "Note not found")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message": "Note deleted successfully",
+	})
+}
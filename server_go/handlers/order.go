@@ -1,27 +1,438 @@
 package handlers
 
 import (
+	"encoding/json"
+	"log"
 	"net/http"
 	"server/models"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
 )
 
-func (h *HandlerContext) GetOrders(w http.ResponseWriter, r *http.Request) {
-	userIdQuery := r.URL.Query().Get("userId")
-	userId, err := strconv.ParseUint(userIdQuery, 10, 32)
+// Who changed an order, recorded on its events
+const (
+	actorCustomer = "customer"
+	actorAdmin    = "admin"
+	actorSystem   = "system"
+)
+
+// orderStatusError - A status change that is not allowed for the order
+type orderStatusError string
+
+func (e orderStatusError) Error() string {
+	return string(e)
+}
+
+// recordOrderEvent - Appends an entry to the order's timeline and queues the
+// customer email for the new status, if any
+func recordOrderEvent(tx *gorm.DB, orderID uint, from, to models.OrderStatus, actorID uint, actorRole, note string) error {
+	event := models.OrderEvent{
+		OrderID:    orderID,
+		FromStatus: from,
+		ToStatus:   to,
+		ActorRole:  actorRole,
+		Note:       note,
+	}
+	if actorID != 0 {
+		event.ActorID = &actorID
+	}
+	if err := tx.Create(&event).Error; err != nil {
+		return err
+	}
+
+	if name, ok := orderStatusEmails[to]; ok && from != to {
+		return enqueueOrderEmail(tx, orderID, name, note, nil)
+	}
+	return nil
+}
+
+// transitionOrder - Moves an order to a new status and records the event.
+// Disallowed or concurrent changes are returned as an orderStatusError.
+func transitionOrder(tx *gorm.DB, order *models.Order, to models.OrderStatus, actorID uint, actorRole, note string) error {
+	from := order.Status
+	if !from.CanTransitionTo(to) {
+		return orderStatusError("Cannot change order status from " + string(from) + " to " + string(to))
+	}
+
+	result := tx.Model(&models.Order{}).
+		Where("id = ? AND status = ?", order.ID, from).
+		Update("status", to)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return orderStatusError("Order status was changed by someone else, please reload")
+	}
+	order.Status = to
+
+	// Payment turns the units held at checkout into a sale, backordered units
+	// take any stock that came in meanwhile, and issues the invoice
+	if from == models.OrderPending && to == models.OrderPaid {
+		if err := convertReservations(tx, order.ID); err != nil {
+			return err
+		}
+		if err := fillOrderBackorders(tx, order.ID); err != nil {
+			return err
+		}
+		if _, err := issueInvoice(tx, order.ID); err != nil {
+			return err
+		}
+	}
+
+	return recordOrderEvent(tx, order.ID, from, to, actorID, actorRole, note)
+}
+
+// restock - Puts quantities back into stock, or takes them out again when
+// negative, by default at the warehouse the order's units were sold from.
+// Units of deleted products are dropped.
+func restock(tx *gorm.DB, change stockChange) error {
+	if change.WarehouseID == nil && change.OrderID != nil {
+		warehouseID, err := saleWarehouse(tx, *change.OrderID, change.ProductID)
+		if err != nil {
+			return err
+		}
+		change.WarehouseID = warehouseID
+	}
+	if _, err := moveStock(tx, change); err != nil && err != gorm.ErrRecordNotFound {
+		return err
+	}
+	return nil
+}
+
+// cancelOrder - Cancels an order that has not shipped, restocks its items or
+// releases their reservations and records a refund of a paid order, or gives
+// back the promotion uses of an unpaid one. Items, discounts and refunds must
+// be preloaded. Call it inside a transaction and settlePayments once it
+// commits to refund or void the payment.
+func cancelOrder(tx *gorm.DB, order *models.Order, actorID uint, actorRole, reason string) error {
+	wasPaid := order.Status != models.OrderPending
+
+	if err := transitionOrder(tx, order, models.OrderCancelled, actorID, actorRole, reason); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if err := tx.Model(&models.Order{}).Where("id = ?", order.ID).Updates(map[string]any{
+		"cancel_reason": reason,
+		"cancelled_at":  now,
+	}).Error; err != nil {
+		return err
+	}
+	order.CancelReason = reason
+	order.CancelledAt = &now
+
+	// Only units the ledger shows leaving stock go back. Reserved units never
+	// left, nor did those of orders placed before checkout took stock. Units
+	// refunded earlier were restocked, or not, by that refund, and
+	// backordered units never left stock.
+	sold, err := soldStock(tx, order.ID)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid userId")
+		return err
+	}
+	if err := releaseReservations(tx, order.ID); err != nil {
+		return err
+	}
+	items := append([]models.OrderItem(nil), order.Items...)
+	if err := clearBackorders(tx, order); err != nil {
+		return err
+	}
+	for _, item := range items {
+		remaining := min(item.Quantity-item.RefundedQuantity-item.BackorderedQuantity, sold[item.ProductID])
+		if remaining > 0 {
+			sold[item.ProductID] -= remaining
+			if err := restock(tx, stockChange{
+				ProductID: item.ProductID,
+				Quantity:  remaining,
+				Type:      models.StockCancellation,
+				Reason:    reason,
+				OrderID:   &order.ID,
+				ActorID:   actorRef(actorID),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	// An unpaid order never used its coupons
+	if !wasPaid {
+		if err := releasePromotions(tx, order.ID); err != nil {
+			return err
+		}
+	}
+
+	// Orders placed before payment intents were stored have nothing to
+	// reverse, unpaid ones are voided by settlePayments
+	if order.PaymentIntentID == "" || !wasPaid {
+		return nil
+	}
+
+	_, err = issueRefund(tx, order, refundRequest{Full: true, Reason: reason}, actorID, actorRole)
+	return err
+}
+
+// orderTimeline - Fetches an order's events, oldest first
+func (h *HandlerContext) orderTimeline(orderID uint) ([]models.OrderEvent, error) {
+	var events []models.OrderEvent
+	err := h.db.Where("order_id = ?", orderID).Order("created_at, id").Find(&events).Error
+	return events, err
+}
+
+// Page size of the customer order history
+const (
+	defaultOrdersPageSize = 10
+	maxOrdersPageSize     = 50
+)
+
+// preloadOrderItemImages - Loads order items with their product's images,
+// primary image first, for display
+func preloadOrderItemImages(db *gorm.DB) *gorm.DB {
+	return db.Preload("Items.Product.Images", func(db *gorm.DB) *gorm.DB {
+		return db.Order(`is_primary DESC, "order", id`)
+	})
+}
+
+// customerOrderQuery - Loads an order the way its customer sees it, with items,
+// discounts, refunds, shipments and customer-visible notes
+func (h *HandlerContext) customerOrderQuery() *gorm.DB {
+	return preloadOrderItemImages(h.db.Model(&models.Order{})).
+		Preload("Discounts").
+		Preload("Refunds.Items").
+		Preload("Shipments.Items").
+		Preload("Notes", func(db *gorm.DB) *gorm.DB {
+			return db.Where("visibility = ?", models.NoteCustomer).Order("created_at, id")
+		})
+}
+
+// GetOrders - The authenticated user's orders, newest first, filterable by
+// status (comma separated) and a from/to date range (YYYY-MM-DD, inclusive)
+func (h *HandlerContext) GetOrders(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIDFromRequest(r)
+	if userId == 0 {
+		respondWithError(w, http.StatusUnauthorized, "Missing authorization token")
+		return
+	}
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		limit = defaultOrdersPageSize
+	}
+	limit = min(limit, maxOrdersPageSize)
+	offset := (page - 1) * limit
+
+	query := h.db.Model(&models.Order{}).Where("user_id = ?", userId)
+
+	if statusParam := r.URL.Query().Get("status"); statusParam != "" {
+		var statuses []models.OrderStatus
+		for _, s := range strings.Split(statusParam, ",") {
+			status := models.OrderStatus(strings.TrimSpace(s))
+			if !status.Valid() {
+				respondWithError(w, http.StatusBadRequest, "Invalid status: "+string(status))
+				return
+			}
+			statuses = append(statuses, status)
+		}
+		query = query.Where("status IN ?", statuses)
+	}
+
+	if fromParam := r.URL.Query().Get("from"); fromParam != "" {
+		from, err := time.Parse(time.DateOnly, fromParam)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid from date, expected YYYY-MM-DD")
+			return
+		}
+		query = query.Where("created_at >= ?", from)
+	}
+	if toParam := r.URL.Query().Get("to"); toParam != "" {
+		to, err := time.Parse(time.DateOnly, toParam)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid to date, expected YYYY-MM-DD")
+			return
+		}
+		query = query.Where("created_at < ?", to.AddDate(0, 0, 1))
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		log.Printf("Failed to count orders: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch orders")
 		return
 	}
 
 	var orders []models.Order
-	if err := h.db.Preload("Items").Where("user_id = ?", userId).Find(&orders).Error; err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to fetch orders: "+err.Error())
+	if err := preloadOrderItemImages(query).
+		Preload("Shipments.Items").
+		Order("created_at DESC, id DESC").
+		Limit(limit).
+		Offset(offset).
+		Find(&orders).Error; err != nil {
+		log.Printf("Failed to fetch orders: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch orders")
+		return
+	}
+
+	totalPages := (int(total) + limit - 1) / limit
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message":     "Orders retrieved successfully",
+		"orders":      orders,
+		"totalPages":  totalPages,
+		"currentPage": page,
+		"totalItems":  total,
+	})
+}
+
+// GetUserOrder - One of the authenticated user's orders with its items,
+// discounts, refunds, shipments and customer-visible notes
+func (h *HandlerContext) GetUserOrder(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIDFromRequest(r)
+	if userId == 0 {
+		respondWithError(w, http.StatusUnauthorized, "Missing authorization token")
+		return
+	}
+
+	orderIDStr := chi.URLParam(r, "id")
+	orderID, err := strconv.ParseUint(orderIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var order models.Order
+	if err := h.customerOrderQuery().Where("id = ? AND user_id = ?", orderID, userId).First(&order).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Order not found")
+		} else {
+			log.Printf("Error fetching order: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Error fetching order")
+		}
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message": "Order retrieved successfully",
+		"order":   order,
+	})
+}
+
+// GetOrderTimeline - Status history of one of the user's orders
+func (h *HandlerContext) GetOrderTimeline(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIDFromRequest(r)
+	if userId == 0 {
+		respondWithError(w, http.StatusUnauthorized, "Missing authorization token")
+		return
+	}
+
+	orderIDStr := chi.URLParam(r, "id")
+	orderID, err := strconv.ParseUint(orderIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var order models.Order
+	if err := h.db.Where("id = ? AND user_id = ?", orderID, userId).First(&order).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Order not found")
+		} else {
+			respondWithError(w, http.StatusInternalServerError, "Error fetching order")
+		}
+		return
+	}
+
+	events, err := h.orderTimeline(order.ID)
+	if err != nil {
+		log.Printf("Error fetching order events: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch order timeline")
 		return
 	}
 
-	respondWithJson(w, http.StatusOK, map[string]interface{}{
-		"message": "Orders retrieved successfully",
-		"orders":  orders,
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message": "Order timeline retrieved successfully",
+		"status":  order.Status,
+		"events":  events,
 	})
 }
+
+// CancelOrder - Lets a customer cancel their own order before it ships
+func (h *HandlerContext) CancelOrder(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIDFromRequest(r)
+	if userId == 0 {
+		respondWithError(w, http.StatusUnauthorized, "Missing authorization token")
+		return
+	}
+
+	orderIDStr := chi.URLParam(r, "id")
+	orderID, err := strconv.ParseUint(orderIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var reqBody struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	reqBody.Reason = strings.TrimSpace(reqBody.Reason)
+	if reqBody.Reason == "" {
+		respondWithError(w, http.StatusBadRequest, "Reason is required")
+		return
+	}
+
+	var order models.Order
+	if err := h.db.Preload("Items").Preload("Discounts").Preload("Refunds").
+		Where("id = ? AND user_id = ?", orderID, userId).First(&order).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Order not found")
+		} else {
+			respondWithError(w, http.StatusInternalServerError, "Error fetching order")
+		}
+		return
+	}
+
+	if !order.Status.CanTransitionTo(models.OrderCancelled) {
+		respondWithError(w, http.StatusConflict, "Order can no longer be cancelled")
+		return
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		return cancelOrder(tx, &order, uint(userId), actorCustomer, reqBody.Reason)
+	})
+	if err != nil {
+		respondWithCancelError(w, err)
+		return
+	}
+	if err := settlePayments(&h.db, &order); err != nil {
+		// The refund worker retries, a payment that goes through anyway is refunded
+		log.Printf("Error settling payment of cancelled order %d: %v", order.ID, err)
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message": "Order cancelled successfully",
+		"order":   order,
+	})
+}
+
+// respondWithCancelError - Maps errors from cancelOrder to a response
+func respondWithCancelError(w http.ResponseWriter, err error) {
+	switch e := err.(type) {
+	case orderStatusError:
+		respondWithError(w, http.StatusConflict, string(e))
+	case refundError:
+		respondWithError(w, http.StatusConflict, string(e))
+	default:
+		log.Printf("Error cancelling order: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to cancel order")
+	}
+}
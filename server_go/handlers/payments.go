@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"server/models"
+	"strconv"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/client"
+	"github.com/stripe/stripe-go/v76/webhook"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Largest webhook payload accepted, Stripe events are far smaller
+const maxWebhookBody = 64 << 10
+
+// paymentError - A failed call to the payment provider
+type paymentError struct {
+	err error
+}
+
+func (e paymentError) Error() string {
+	return "Payment provider error: " + e.err.Error()
+}
+
+func (e paymentError) Unwrap() error {
+	return e.err
+}
+
+// paymentRefused - Whether the provider turned a request down, retrying it
+// cannot succeed
+func paymentRefused(err error) bool {
+	var stripeErr *stripe.Error
+	if !errors.As(err, &stripeErr) {
+		return false
+	}
+	return stripeErr.HTTPStatusCode >= 400 && stripeErr.HTTPStatusCode < 500 &&
+		stripeErr.HTTPStatusCode != http.StatusTooManyRequests
+}
+
+// stripeClient - Stripe API client using the STRIPE_SECRET key
+func stripeClient() (*client.API, error) {
+	stripeKey := os.Getenv("STRIPE_SECRET")
+	if stripeKey == "" {
+		return nil, errors.New("Stripe secret key not configured")
+	}
+	stripe.Key = stripeKey
+	sc := &client.API{}
+	sc.Init(stripe.Key, nil)
+	return sc, nil
+}
+
+// refundPayment - Refunds an amount in cents of a payment, returns the
+// provider's refund ID. The refund ID is the idempotency key, retries of the
+// same refund never pay out twice.
+func refundPayment(paymentIntentID string, amount int64, orderID, refundID uint) (string, error) {
+	sc, err := stripeClient()
+	if err != nil {
+		return "", paymentError{err}
+	}
+
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(paymentIntentID),
+		Amount:        stripe.Int64(amount),
+		Reason:        stripe.String(string(stripe.RefundReasonRequestedByCustomer)),
+	}
+	params.AddMetadata("orderId", strconv.FormatUint(uint64(orderID), 10))
+	params.SetIdempotencyKey("refund-" + strconv.FormatUint(uint64(refundID), 10))
+
+	refund, err := sc.Refunds.New(params)
+	if err != nil {
+		return "", paymentError{err}
+	}
+	return refund.ID, nil
+}
+
+// paymentStatus - Current status of a payment intent
+func paymentStatus(paymentIntentID string) (stripe.PaymentIntentStatus, error) {
+	sc, err := stripeClient()
+	if err != nil {
+		return "", paymentError{err}
+	}
+
+	paymentIntent, err := sc.PaymentIntents.Get(paymentIntentID, nil)
+	if err != nil {
+		return "", paymentError{err}
+	}
+	return paymentIntent.Status, nil
+}
+
+// cancelPayment - Voids a payment intent that has not been paid yet
+func cancelPayment(paymentIntentID string) error {
+	sc, err := stripeClient()
+	if err != nil {
+		return paymentError{err}
+	}
+
+	if _, err := sc.PaymentIntents.Cancel(paymentIntentID, nil); err != nil {
+		return paymentError{err}
+	}
+	return nil
+}
+
+// HandlePaymentWebhook - Receives Stripe payment events signed with
+// STRIPE_WEBHOOK_SECRET. A successful payment marks the order paid, which sells
+// its reserved stock, or is refunded when the order was cancelled meanwhile.
+// Failed or cancelled payments make the reservations due so the reservation
+// sweeper cancels the order.
+func (h *HandlerContext) HandlePaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	secret := os.Getenv("STRIPE_WEBHOOK_SECRET")
+	if secret == "" {
+		respondWithError(w, http.StatusServiceUnavailable, "Stripe webhook secret not configured")
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	event, err := webhook.ConstructEventWithOptions(payload, r.Header.Get("Stripe-Signature"), secret,
+		webhook.ConstructEventOptions{IgnoreAPIVersionMismatch: true})
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook signature")
+		return
+	}
+
+	switch event.Type {
+	case "payment_intent.succeeded", "payment_intent.payment_failed", "payment_intent.canceled":
+	default:
+		respondWithJson(w, http.StatusOK, map[string]any{"received": true})
+		return
+	}
+
+	var paymentIntent stripe.PaymentIntent
+	if err := json.Unmarshal(event.Data.Raw, &paymentIntent); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid payment intent")
+		return
+	}
+
+	if event.Type == "payment_intent.succeeded" {
+		var order models.Order
+		refunded := false
+		err = h.db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Preload("Items").Preload("Discounts").Preload("Refunds").
+				Where("payment_intent_id = ?", paymentIntent.ID).
+				First(&order).Error; err != nil {
+				return err
+			}
+			// Money for an order cancelled before it arrived goes back,
+			// retried deliveries find it refunded or the order paid already
+			if order.Status == models.OrderCancelled && order.Refunded == 0 {
+				log.Printf("Payment %s succeeded for cancelled order %d, refunding it", paymentIntent.ID, order.ID)
+				refunded = true
+				_, err := issueRefund(tx, &order, refundRequest{Full: true, Reason: "Payment arrived after the order was cancelled"}, 0, actorSystem)
+				return err
+			}
+			if order.Status != models.OrderPending {
+				return nil
+			}
+			return transitionOrder(tx, &order, models.OrderPaid, 0, actorSystem, "Payment received")
+		})
+		if err == nil && refunded {
+			if err := settlePayments(&h.db, &order); err != nil {
+				// The refund worker retries it
+				log.Printf("Error refunding payment %s of cancelled order %d: %v", paymentIntent.ID, order.ID, err)
+			}
+		}
+	} else {
+		var orderID uint
+		err = h.db.Model(&models.Order{}).
+			Where("payment_intent_id = ? AND status = ?", paymentIntent.ID, models.OrderPending).
+			Limit(1).
+			Pluck("id", &orderID).Error
+		if err == nil && orderID != 0 {
+			err = expireReservations(&h.db, orderID)
+		}
+	}
+	if err != nil && err != gorm.ErrRecordNotFound {
+		// Stripe retries failed deliveries
+		log.Printf("Error handling %s for payment %s: %v", event.Type, paymentIntent.ID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to handle webhook")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{"received": true})
+}
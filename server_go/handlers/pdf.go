@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// US Letter in points
+const (
+	pdfPageWidth  = 612.0
+	pdfPageHeight = 792.0
+	pdfMargin     = 50.0
+)
+
+// pdfDocument - Minimal PDF writer for text documents using the standard
+// Helvetica fonts, so nothing has to be embedded
+type pdfDocument struct {
+	pages []*bytes.Buffer
+	y     float64 // Baseline of the next line on the current page
+}
+
+func newPDFDocument() *pdfDocument {
+	doc := &pdfDocument{}
+	doc.addPage()
+	return doc
+}
+
+// addPage - Starts a new page and moves the cursor to its top
+func (d *pdfDocument) addPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.y = pdfPageHeight - pdfMargin
+}
+
+// ensureSpace - Breaks the page when less than height is left above the margin
+func (d *pdfDocument) ensureSpace(height float64) {
+	if d.y-height < pdfMargin {
+		d.addPage()
+	}
+}
+
+// text - Draws a line of text with its left edge at x on the current baseline
+func (d *pdfDocument) text(x float64, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.pages[len(d.pages)-1], "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, d.y, pdfEscape(s))
+}
+
+// textRight - Draws a line of text with its right edge at x
+func (d *pdfDocument) textRight(x float64, size float64, bold bool, s string) {
+	d.text(x-pdfTextWidth(s, size), size, bold, s)
+}
+
+// rule - Draws a horizontal line across the page just below the baseline
+func (d *pdfDocument) rule() {
+	fmt.Fprintf(d.pages[len(d.pages)-1], "0.5 w %.2f %.2f m %.2f %.2f l S\n",
+		pdfMargin, d.y-4, pdfPageWidth-pdfMargin, d.y-4)
+}
+
+// newline - Moves the cursor down, breaking the page when needed
+func (d *pdfDocument) newline(height float64) {
+	d.y -= height
+	d.ensureSpace(0)
+}
+
+// bytes - Serializes the document
+func (d *pdfDocument) bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n")
+
+	// 1 catalog, 2 page tree, 3 and 4 fonts, then a page and its content per page
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+i*2)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, page := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, 6+i*2))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+// pdfEscape - Escapes a string for a PDF literal, characters outside the
+// standard fonts' Latin-1 range are replaced
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 32 && r < 127:
+			b.WriteRune(r)
+		case r >= 160 && r <= 255:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// Helvetica glyph widths in thousandths of the font size, other characters
+// are approximated by pdfDefaultWidth
+var pdfGlyphWidths = map[rune]int{
+	' ': 278, '.': 278, ',': 278, ':': 278, '-': 333, '/': 278, '#': 556, '$': 556, '%': 889,
+	'(': 333, ')': 333, 'i': 222, 'j': 222, 'l': 222, 'f': 278, 't': 278, 'r': 333, 'I': 278,
+	'm': 833, 'w': 722, 'M': 833, 'W': 944,
+}
+
+const pdfDefaultWidth = 556
+
+// pdfTextWidth - Approximate width of Helvetica text in points
+func pdfTextWidth(s string, size float64) float64 {
+	total := 0
+	for _, r := range s {
+		if w, ok := pdfGlyphWidths[r]; ok {
+			total += w
+		} else {
+			total += pdfDefaultWidth
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+// pdfWrap - Breaks text into lines no wider than width, at spaces where it can
+func pdfWrap(s string, size, width float64) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(s, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			for pdfTextWidth(word, size) > width {
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				cut := len([]rune(word)) - 1
+				for cut > 1 && pdfTextWidth(string([]rune(word)[:cut]), size) > width {
+					cut--
+				}
+				lines = append(lines, string([]rune(word)[:cut]))
+				word = string([]rune(word)[cut:])
+			}
+			if line != "" && pdfTextWidth(line+" "+word, size) > width {
+				lines = append(lines, line)
+				line = ""
+			}
+			if line != "" {
+				line += " "
+			}
+			line += word
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
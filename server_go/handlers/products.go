@@ -6,19 +6,30 @@ import (
 	"net/http"
 	"server/models"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"gorm.io/gorm"
 )
 
 type CreateProductRequest struct {
-	Name        string                `json:"name"`
-	Price       float64               `json:"price"`
-	Description string                `json:"description"`
-	CategoryID  uint                  `json:"categoryId"`
-	Stock       int                   `json:"stock"`
-	Images      []models.ProductImage `json:"images"`
-	Specs       []models.ProductSpec  `json:"specs"`
+	Name             string                `json:"name"`
+	Price            float64               `json:"price"`
+	Description      string                `json:"description"`
+	CategoryID       uint                  `json:"categoryId"`
+	Stock            int                   `json:"stock"`
+	WeightGrams      int                   `json:"weightGrams"`
+	ReorderThreshold *int                  `json:"reorderThreshold"` // Optional, defaults to 5
+	BackorderMode    models.BackorderMode  `json:"backorderMode"`    // Optional, backorder or preorder
+	BackorderLimit   int                   `json:"backorderLimit"`   // Units that may wait for stock, required with a mode
+	AvailableOn      string                `json:"availableOn"`      // Optional expected date, YYYY-MM-DD
+	BackorderMessage string                `json:"backorderMessage"` // Optional, replaces the default notice
+	LengthCm         float64               `json:"lengthCm"`
+	WidthCm          float64               `json:"widthCm"`
+	HeightCm         float64               `json:"heightCm"`
+	Images           []models.ProductImage `json:"images"`
+	Specs            []models.ProductSpec  `json:"specs"`
 }
 
 func (h *HandlerContext) CreateProduct(w http.ResponseWriter, r *http.Request) {
@@ -45,6 +56,23 @@ func (h *HandlerContext) CreateProduct(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Category ID is required")
 		return
 	}
+	if req.Stock < 0 {
+		respondWithError(w, http.StatusBadRequest, "Stock cannot be negative")
+		return
+	}
+	if req.ReorderThreshold != nil && *req.ReorderThreshold < 0 {
+		respondWithError(w, http.StatusBadRequest, "Reorder threshold cannot be negative")
+		return
+	}
+	availableOn, err := validBackorder(req.BackorderMode, req.BackorderLimit, req.AvailableOn)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.WeightGrams < 0 || req.LengthCm < 0 || req.WidthCm < 0 || req.HeightCm < 0 {
+		respondWithError(w, http.StatusBadRequest, "Weight and dimensions cannot be negative")
+		return
+	}
 	if len(req.Images) == 0 {
 		respondWithError(w, http.StatusBadRequest, "At least one image is required")
 		return
@@ -73,18 +101,51 @@ func (h *HandlerContext) CreateProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Create product
+	// Create product, the initial stock goes through the ledger as a receipt
 	product := models.Product{
 		Name:        req.Name,
 		Price:       req.Price,
 		Description: req.Description,
 		CategoryID:  req.CategoryID,
-		Stock:       req.Stock,
+		WeightGrams: req.WeightGrams,
+		LengthCm:    req.LengthCm,
+		WidthCm:     req.WidthCm,
+		HeightCm:    req.HeightCm,
 		Images:      req.Images,
 		Specs:       req.Specs,
 	}
+	if req.ReorderThreshold != nil {
+		product.ReorderThreshold = *req.ReorderThreshold
+	}
+	product.BackorderMode = req.BackorderMode
+	product.BackorderLimit = req.BackorderLimit
+	product.AvailableOn = availableOn
+	product.BackorderMessage = strings.TrimSpace(req.BackorderMessage)
 
-	if err := h.db.Create(&product).Error; err != nil {
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&product).Error; err != nil {
+			return err
+		}
+		// A zero threshold would be replaced by the column default on create
+		if product.ReorderThreshold == 0 && req.ReorderThreshold != nil {
+			if err := tx.Model(&product).Update("reorder_threshold", 0).Error; err != nil {
+				return err
+			}
+		}
+		if req.Stock == 0 {
+			return nil
+		}
+		movement, err := moveStock(tx, stockChange{
+			ProductID: product.ID,
+			Quantity:  req.Stock,
+			Type:      models.StockReceipt,
+			Reason:    "Initial stock",
+		})
+		product.Stock = movement.Balance
+		return err
+	})
+	if err != nil {
+		log.Printf("Error creating product: %v", err)
 		respondWithError(w, http.StatusInternalServerError, "Failed to create product")
 		return
 	}
@@ -97,7 +158,8 @@ func (h *HandlerContext) CreateProduct(w http.ResponseWriter, r *http.Request) {
 
 // GetProducts - Retrieve products with filtering, sorting, and pagination
 func (h *HandlerContext) GetProducts(w http.ResponseWriter, r *http.Request) {
-	query := h.db.Session(&gorm.Session{PrepareStmt: false}).Preload("Images").Preload("Specs").Preload("Category")
+	query := h.db.Session(&gorm.Session{PrepareStmt: false}).Preload("Images").Preload("Specs").Preload("Category").
+		Where("products.archived_at IS NULL")
 
 	// Search filter
 	if search := r.URL.Query().Get("search"); search != "" {
@@ -163,7 +225,8 @@ func (h *HandlerContext) GetProducts(w http.ResponseWriter, r *http.Request) {
 
 	// Get total count for pagination
 	var total int64
-	countQuery := h.db.Model(&models.Product{}).Session(&gorm.Session{PrepareStmt: false})
+	countQuery := h.db.Model(&models.Product{}).Session(&gorm.Session{PrepareStmt: false}).
+		Where("products.archived_at IS NULL")
 	// Apply same filters to count query (search, category, price, stock)
 	if search := r.URL.Query().Get("search"); search != "" {
 		searchTerm := "%" + search + "%"
@@ -201,6 +264,15 @@ func (h *HandlerContext) GetProducts(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, http.StatusInternalServerError, "Failed to fetch products")
 		return
 	}
+	productRefs := make([]*models.Product, len(products))
+	for i := range products {
+		productRefs[i] = &products[i]
+	}
+	if err := fillAvailable(&h.db, productRefs...); err != nil {
+		log.Printf("Failed to fetch reserved stock: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch products")
+		return
+	}
 
 	totalPages := (int(total) + limit - 1) / limit
 
@@ -238,13 +310,20 @@ func (h *HandlerContext) GetProductByID(w http.ResponseWriter, r *http.Request)
 	var related []models.Product
 	if err := h.db.
 		Preload("Images").
-		Where("category_id = ? AND id != ?", product.CategoryID, product.ID).
+		Where("category_id = ? AND id != ? AND archived_at IS NULL", product.CategoryID, product.ID).
 		Limit(3).
 		Find(&related).Error; err != nil {
 		log.Printf("Failed to fetch related products for product %d: %v", id, err)
 		// Don't fail the request, just log and proceed without related products
 	}
 
+	// Units held by checkouts cannot be bought
+	if err := fillAvailable(&h.db, &product); err != nil {
+		log.Printf("Failed to fetch reserved stock for product %d: %v", id, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch product")
+		return
+	}
+
 	// Populate RelatedIDs
 	relatedIDs := make([]uint, len(related))
 	for i, rel := range related {
@@ -253,27 +332,49 @@ func (h *HandlerContext) GetProductByID(w http.ResponseWriter, r *http.Request)
 
 	// Response structure with related IDs
 	type ProductResponse struct {
-		ID          uint                  `json:"id"`
-		Name        string                `json:"name"`
-		Price       float64               `json:"price"`
-		Description string                `json:"description"`
-		Category    models.Category       `json:"category"`
-		Stock       int                   `json:"stock"`
-		Images      []models.ProductImage `json:"images"`
-		Specs       []models.ProductSpec  `json:"specs"`
-		RelatedIDs  []uint                `json:"related"`
+		ID               uint                  `json:"id"`
+		Name             string                `json:"name"`
+		Price            float64               `json:"price"`
+		Description      string                `json:"description"`
+		Category         models.Category       `json:"category"`
+		Stock            int                   `json:"stock"`
+		Available        int                   `json:"available"` // Stock not held by reservations
+		ReorderThreshold int                   `json:"reorderThreshold"`
+		BackorderMode    models.BackorderMode  `json:"backorderMode"`
+		AvailableOn      *time.Time            `json:"availableOn,omitempty"`
+		Backorderable    int                   `json:"backorderable"`             // Units left to sell beyond stock
+		BackorderNotice  string                `json:"backorderNotice,omitempty"` // Pre-order or backorder messaging
+		WeightGrams      int                   `json:"weightGrams"`
+		LengthCm         float64               `json:"lengthCm"`
+		WidthCm          float64               `json:"widthCm"`
+		HeightCm         float64               `json:"heightCm"`
+		ArchivedAt       *time.Time            `json:"archivedAt,omitempty"`
+		Images           []models.ProductImage `json:"images"`
+		Specs            []models.ProductSpec  `json:"specs"`
+		RelatedIDs       []uint                `json:"related"`
 	}
 
 	response := ProductResponse{
-		ID:          product.ID,
-		Name:        product.Name,
-		Price:       product.Price,
-		Description: product.Description,
-		Category:    product.Category,
-		Stock:       product.Stock,
-		Images:      product.Images,
-		Specs:       product.Specs,
-		RelatedIDs:  relatedIDs,
+		ID:               product.ID,
+		Name:             product.Name,
+		Price:            product.Price,
+		Description:      product.Description,
+		Category:         product.Category,
+		Stock:            product.Stock,
+		Available:        product.Available,
+		ReorderThreshold: product.ReorderThreshold,
+		BackorderMode:    product.BackorderMode,
+		AvailableOn:      product.AvailableOn,
+		Backorderable:    product.Backorderable,
+		BackorderNotice:  product.BackorderNotice,
+		WeightGrams:      product.WeightGrams,
+		LengthCm:         product.LengthCm,
+		WidthCm:          product.WidthCm,
+		HeightCm:         product.HeightCm,
+		ArchivedAt:       product.ArchivedAt,
+		Images:           product.Images,
+		Specs:            product.Specs,
+		RelatedIDs:       relatedIDs,
 	}
 
 	respondWithJson(w, http.StatusOK, map[string]interface{}{
@@ -0,0 +1,536 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"server/models"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DiscountLine - A promotion applied to a cart, amount in cents
+type DiscountLine struct {
+	PromotionID  uint                 `json:"promotionId"`
+	Code         string               `json:"code,omitempty"`
+	Name         string               `json:"name"`
+	Type         models.PromotionType `json:"type"`
+	Amount       int64                `json:"amount"`
+	FreeShipping bool                 `json:"freeShipping"`
+}
+
+// DiscountQuote - Promotions applied to a cart, all amounts in cents
+type DiscountQuote struct {
+	Discounts        []DiscountLine `json:"discounts"`
+	ItemDiscount     int64          `json:"itemDiscount"`
+	ShippingDiscount int64          `json:"shippingDiscount"`
+	Total            int64          `json:"total"`
+	LineDiscounts    []int64        `json:"-"` // Per cart line, in the same order as the lines
+}
+
+type promotionRequest struct {
+	Name         string               `json:"name"`
+	Code         string               `json:"code"`
+	Type         models.PromotionType `json:"type"`
+	PercentOff   float64              `json:"percentOff"`
+	AmountOff    int64                `json:"amountOff"`
+	BuyQuantity  int                  `json:"buyQuantity"`
+	GetQuantity  int                  `json:"getQuantity"`
+	ProductID    *uint                `json:"productId"`
+	CategoryID   *uint                `json:"categoryId"`
+	MinSubtotal  int64                `json:"minSubtotal"`
+	UsageLimit   int                  `json:"usageLimit"`
+	PerUserLimit int                  `json:"perUserLimit"`
+	StartsAt     *time.Time           `json:"startsAt"`
+	EndsAt       *time.Time           `json:"endsAt"`
+	Active       *bool                `json:"active"`
+}
+
+// promotionApplies - Reports whether a promotion is scoped to the line
+func promotionApplies(promotion models.Promotion, line taxableLine) bool {
+	if promotion.ProductID != nil && *promotion.ProductID != line.ProductID {
+		return false
+	}
+	if promotion.CategoryID != nil && *promotion.CategoryID != line.CategoryID {
+		return false
+	}
+	return true
+}
+
+// promotionInWindow - Reports whether a promotion is active at the given time
+func promotionInWindow(promotion models.Promotion, now time.Time) bool {
+	if !promotion.Active {
+		return false
+	}
+	if promotion.StartsAt != nil && now.Before(*promotion.StartsAt) {
+		return false
+	}
+	if promotion.EndsAt != nil && now.After(*promotion.EndsAt) {
+		return false
+	}
+	return true
+}
+
+// allocateDiscount - Splits an amount across lines in proportion to their weights
+func allocateDiscount(amount int64, weights []int64) []int64 {
+	shares := make([]int64, len(weights))
+	total := int64(0)
+	last := -1
+	for i, weight := range weights {
+		total += weight
+		if weight > 0 {
+			last = i
+		}
+	}
+	if total <= 0 || amount <= 0 {
+		return shares
+	}
+	if amount > total {
+		amount = total
+	}
+
+	allocated := int64(0)
+	for i, weight := range weights {
+		if i == last {
+			shares[i] = amount - allocated
+			break
+		}
+		shares[i] = amount * weight / total
+		allocated += shares[i]
+	}
+	return shares
+}
+
+// applyPromotions - Calculates the discount of each promotion in order, later
+// promotions discount what is left after earlier ones
+func applyPromotions(promotions []models.Promotion, lines []taxableLine, shipping int64) DiscountQuote {
+	quote := DiscountQuote{Discounts: []DiscountLine{}, LineDiscounts: make([]int64, len(lines))}
+
+	subtotal := int64(0)
+	for _, line := range lines {
+		subtotal += line.Amount
+	}
+
+	for _, promotion := range promotions {
+		if promotion.MinSubtotal > 0 && subtotal < promotion.MinSubtotal {
+			continue
+		}
+
+		// What each eligible line has left to discount
+		remaining := make([]int64, len(lines))
+		eligible := false
+		for i, line := range lines {
+			if promotionApplies(promotion, line) {
+				remaining[i] = line.Amount - quote.LineDiscounts[i]
+				eligible = true
+			}
+		}
+
+		discount := DiscountLine{
+			PromotionID: promotion.ID,
+			Name:        promotion.Name,
+			Type:        promotion.Type,
+		}
+		if promotion.Code != nil {
+			discount.Code = *promotion.Code
+		}
+
+		shares := make([]int64, len(lines))
+		switch promotion.Type {
+		case models.PromotionPercentage:
+			for i := range lines {
+				shares[i] = int64(math.Round(float64(remaining[i]) * promotion.PercentOff / 100))
+			}
+		case models.PromotionFixed:
+			shares = allocateDiscount(promotion.AmountOff, remaining)
+		case models.PromotionBuyXGetY:
+			shares = buyXGetYShares(promotion, lines, remaining)
+		case models.PromotionFreeShipping:
+			if !eligible || quote.ShippingDiscount > 0 || shipping <= 0 {
+				continue
+			}
+			discount.FreeShipping = true
+			discount.Amount = shipping
+			quote.ShippingDiscount = shipping
+		}
+
+		for i, share := range shares {
+			share = min(share, remaining[i])
+			quote.LineDiscounts[i] += share
+			quote.ItemDiscount += share
+			discount.Amount += share
+		}
+
+		if discount.Amount > 0 {
+			quote.Discounts = append(quote.Discounts, discount)
+		}
+	}
+
+	quote.Total = quote.ItemDiscount + quote.ShippingDiscount
+	return quote
+}
+
+// buyXGetYShares - Makes the cheapest eligible units free, GetQuantity for every
+// BuyQuantity + GetQuantity units in the cart
+func buyXGetYShares(promotion models.Promotion, lines []taxableLine, remaining []int64) []int64 {
+	shares := make([]int64, len(lines))
+	if promotion.BuyQuantity <= 0 || promotion.GetQuantity <= 0 {
+		return shares
+	}
+
+	type unit struct {
+		line  int
+		price int64
+	}
+	var units []unit
+	for i, line := range lines {
+		if remaining[i] <= 0 {
+			continue
+		}
+		for range line.Quantity {
+			units = append(units, unit{line: i, price: line.UnitPrice})
+		}
+	}
+
+	free := len(units) / (promotion.BuyQuantity + promotion.GetQuantity) * promotion.GetQuantity
+	sort.SliceStable(units, func(i, j int) bool {
+		return units[i].price < units[j].price
+	})
+	for _, u := range units[:free] {
+		shares[u.line] += u.price
+	}
+	return shares
+}
+
+// activePromotions - Automatic promotions plus the coupon for the code, filtered
+// by validity window and usage limits. Problems with the coupon are returned
+// as a checkoutError.
+func (h *HandlerContext) activePromotions(userID uint, couponCode string) ([]models.Promotion, error) {
+	now := time.Now()
+
+	var automatic []models.Promotion
+	if err := h.db.Where("code IS NULL AND active = ?", true).
+		Where("(usage_limit = 0 OR used_count < usage_limit)").
+		Order("id").Find(&automatic).Error; err != nil {
+		return nil, err
+	}
+
+	promotions := []models.Promotion{}
+	for _, promotion := range automatic {
+		if !promotionInWindow(promotion, now) {
+			continue
+		}
+		if promotion.PerUserLimit > 0 {
+			used, err := h.promotionUsesByUser(promotion.ID, userID)
+			if err != nil {
+				return nil, err
+			}
+			if used >= int64(promotion.PerUserLimit) {
+				continue
+			}
+		}
+		promotions = append(promotions, promotion)
+	}
+
+	couponCode = strings.TrimSpace(couponCode)
+	if couponCode == "" {
+		return promotions, nil
+	}
+
+	var coupon models.Promotion
+	if err := h.db.Where("UPPER(code) = ?", strings.ToUpper(couponCode)).First(&coupon).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, checkoutError("Invalid coupon code")
+		}
+		return nil, err
+	}
+	if !promotionInWindow(coupon, now) {
+		return nil, checkoutError("Coupon code is not active")
+	}
+	if coupon.UsageLimit > 0 && coupon.UsedCount >= coupon.UsageLimit {
+		return nil, checkoutError("Coupon code has reached its usage limit")
+	}
+	if coupon.PerUserLimit > 0 {
+		// Guests cannot be told apart, so per customer limits need an account
+		if userID == 0 {
+			return nil, checkoutError("Sign in to use this coupon code")
+		}
+		used, err := h.promotionUsesByUser(coupon.ID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if used >= int64(coupon.PerUserLimit) {
+			return nil, checkoutError("You have already used this coupon code")
+		}
+	}
+
+	return append(promotions, coupon), nil
+}
+
+// promotionUsesByUser - Counts how many orders of a user used a promotion
+func (h *HandlerContext) promotionUsesByUser(promotionID uint, userID uint) (int64, error) {
+	var used int64
+	err := h.db.Model(&models.PromotionRedemption{}).
+		Where("promotion_id = ? AND user_id = ?", promotionID, userID).
+		Count(&used).Error
+	return used, err
+}
+
+// redeemPromotions - Records the promotions used by an order, failing if a
+// usage limit or the customer's own limit was reached in the meantime.
+// Promotions are locked in ID order so concurrent checkouts by the same
+// customer are counted one after the other and cannot deadlock.
+func redeemPromotions(tx *gorm.DB, discounts []DiscountLine, userID uint, orderID uint) error {
+	discounts = append([]DiscountLine(nil), discounts...)
+	sort.Slice(discounts, func(i, j int) bool { return discounts[i].PromotionID < discounts[j].PromotionID })
+
+	for _, discount := range discounts {
+		var promotion models.Promotion
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id", "usage_limit", "used_count", "per_user_limit").
+			First(&promotion, discount.PromotionID).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return checkoutError("Promotion " + discount.Name + " is no longer available")
+			}
+			return err
+		}
+		if promotion.UsageLimit > 0 && promotion.UsedCount >= promotion.UsageLimit {
+			return checkoutError("Promotion " + discount.Name + " has reached its usage limit")
+		}
+		if promotion.PerUserLimit > 0 && userID != 0 {
+			var used int64
+			if err := tx.Model(&models.PromotionRedemption{}).
+				Where("promotion_id = ? AND user_id = ?", promotion.ID, userID).
+				Count(&used).Error; err != nil {
+				return err
+			}
+			if used >= int64(promotion.PerUserLimit) {
+				return checkoutError("You have already used promotion " + discount.Name)
+			}
+		}
+		if err := tx.Model(&models.Promotion{}).Where("id = ?", promotion.ID).
+			UpdateColumn("used_count", gorm.Expr("used_count + 1")).Error; err != nil {
+			return err
+		}
+
+		redemption := models.PromotionRedemption{
+			PromotionID: discount.PromotionID,
+			OrderID:     orderID,
+		}
+		if userID != 0 {
+			redemption.UserID = &userID
+		}
+		if err := tx.Create(&redemption).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releasePromotions - Gives back the promotion uses of an order cancelled
+// before it was paid, so its coupons can be used again
+func releasePromotions(tx *gorm.DB, orderID uint) error {
+	var redemptions []models.PromotionRedemption
+	if err := tx.Where("order_id = ?", orderID).Find(&redemptions).Error; err != nil {
+		return err
+	}
+	for _, redemption := range redemptions {
+		if err := tx.Model(&models.Promotion{}).
+			Where("id = ? AND used_count > 0", redemption.PromotionID).
+			UpdateColumn("used_count", gorm.Expr("used_count - 1")).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Where("order_id = ?", orderID).Delete(&models.PromotionRedemption{}).Error
+}
+
+// GetPromotions - Lists all promotions
+func (h *HandlerContext) GetPromotions(w http.ResponseWriter, r *http.Request) {
+	var promotions []models.Promotion
+	if err := h.db.Order("created_at DESC").Find(&promotions).Error; err != nil {
+		log.Printf("Error fetching promotions: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch promotions")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"promotions": promotions,
+	})
+}
+
+// validatePromotion - Checks a promotion request, returns an error message if invalid
+func validatePromotion(req promotionRequest) string {
+	if req.Name == "" {
+		return "Name is required"
+	}
+	switch req.Type {
+	case models.PromotionPercentage:
+		if req.PercentOff <= 0 || req.PercentOff > 100 {
+			return "Percent off must be between 0 and 100"
+		}
+	case models.PromotionFixed:
+		if req.AmountOff <= 0 {
+			return "Amount off must be greater than 0"
+		}
+	case models.PromotionBuyXGetY:
+		if req.BuyQuantity <= 0 || req.GetQuantity <= 0 {
+			return "Buy and get quantities must be greater than 0"
+		}
+	case models.PromotionFreeShipping:
+	default:
+		return "Invalid promotion type"
+	}
+	if req.MinSubtotal < 0 || req.UsageLimit < 0 || req.PerUserLimit < 0 {
+		return "Limits cannot be negative"
+	}
+	if req.StartsAt != nil && req.EndsAt != nil && req.EndsAt.Before(*req.StartsAt) {
+		return "End date must be after start date"
+	}
+	return ""
+}
+
+// applyPromotionRequest - Copies a request onto a promotion
+func applyPromotionRequest(promotion *models.Promotion, req promotionRequest) {
+	promotion.Name = req.Name
+	promotion.Code = nil
+	if code := strings.TrimSpace(req.Code); code != "" {
+		code = strings.ToUpper(code)
+		promotion.Code = &code
+	}
+	promotion.Type = req.Type
+	promotion.PercentOff = req.PercentOff
+	promotion.AmountOff = req.AmountOff
+	promotion.BuyQuantity = req.BuyQuantity
+	promotion.GetQuantity = req.GetQuantity
+	promotion.ProductID = req.ProductID
+	promotion.CategoryID = req.CategoryID
+	promotion.MinSubtotal = req.MinSubtotal
+	promotion.UsageLimit = req.UsageLimit
+	promotion.PerUserLimit = req.PerUserLimit
+	promotion.StartsAt = req.StartsAt
+	promotion.EndsAt = req.EndsAt
+	if req.Active != nil {
+		promotion.Active = *req.Active
+	}
+}
+
+// CreatePromotion - Creates a promotion or coupon code
+func (h *HandlerContext) CreatePromotion(w http.ResponseWriter, r *http.Request) {
+	var req promotionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if msg := validatePromotion(req); msg != "" {
+		respondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	promotion := models.Promotion{Active: true}
+	applyPromotionRequest(&promotion, req)
+
+	if promotion.Code != nil {
+		var existing models.Promotion
+		if err := h.db.Where("code = ?", *promotion.Code).First(&existing).Error; err == nil {
+			respondWithError(w, http.StatusConflict, "Coupon code already exists")
+			return
+		}
+	}
+
+	if err := h.db.Create(&promotion).Error; err != nil {
+		log.Printf("Error creating promotion: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create promotion")
+		return
+	}
+
+	respondWithJson(w, http.StatusCreated, map[string]any{
+		"message":   "Promotion created successfully",
+		"promotion": promotion,
+	})
+}
+
+// UpdatePromotion - Updates a promotion
+func (h *HandlerContext) UpdatePromotion(w http.ResponseWriter, r *http.Request) {
+	promotionIDStr := chi.URLParam(r, "id")
+	promotionID, err := strconv.ParseUint(promotionIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid promotion ID")
+		return
+	}
+
+	var req promotionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if msg := validatePromotion(req); msg != "" {
+		respondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	var promotion models.Promotion
+	if err := h.db.First(&promotion, promotionID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Promotion not found")
+		} else {
+			log.Printf("Error fetching promotion: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Error fetching promotion")
+		}
+		return
+	}
+
+	applyPromotionRequest(&promotion, req)
+
+	if promotion.Code != nil {
+		var existing models.Promotion
+		if err := h.db.Where("code = ? AND id != ?", *promotion.Code, promotion.ID).First(&existing).Error; err == nil {
+			respondWithError(w, http.StatusConflict, "Coupon code already exists")
+			return
+		}
+	}
+
+	if err := h.db.Save(&promotion).Error; err != nil {
+		log.Printf("Error updating promotion: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to update promotion")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message":   "Promotion updated successfully",
+		"promotion": promotion,
+	})
+}
+
+// DeletePromotion - Deletes a promotion
+func (h *HandlerContext) DeletePromotion(w http.ResponseWriter, r *http.Request) {
+	promotionIDStr := chi.URLParam(r, "id")
+	promotionID, err := strconv.ParseUint(promotionIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid promotion ID")
+		return
+	}
+
+	result := h.db.Delete(&models.Promotion{}, promotionID)
+	if result.Error != nil {
+		log.Printf("Error deleting promotion: %v", result.Error)
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete promotion")
+		return
+	}
+	if result.RowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "Promotion not found")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]string{
+		"message": "Promotion deleted successfully",
+	})
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"server/models"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAllocateDiscount(t *testing.T) {
+	tests := []struct {
+		name    string
+		amount  int64
+		weights []int64
+		want    []int64
+	}{
+		{"even split", 300, []int64{100, 100, 100}, []int64{100, 100, 100}},
+		{"remainder goes to the last line", 100, []int64{100, 100, 100}, []int64{33, 33, 34}},
+		{"proportional", 1000, []int64{1800, 2700}, []int64{400, 600}},
+		{"capped at the weights", 500, []int64{100, 200}, []int64{100, 200}},
+		{"remainder skips trailing zero weights", 51, []int64{40, 40, 0}, []int64{25, 26, 0}},
+		{"only one weighted line", 10, []int64{0, 30, 0}, []int64{0, 10, 0}},
+		{"no weights", 100, []int64{0, 0}, []int64{0, 0}},
+		{"no amount", 0, []int64{100}, []int64{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allocateDiscount(tt.amount, tt.weights); !slices.Equal(got, tt.want) {
+				t.Fatalf("allocateDiscount(%d, %v) = %v, want %v", tt.amount, tt.weights, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuyXGetYShares(t *testing.T) {
+	buy2get1 := models.Promotion{Type: models.PromotionBuyXGetY, BuyQuantity: 2, GetQuantity: 1}
+	buy1get1 := models.Promotion{Type: models.PromotionBuyXGetY, BuyQuantity: 1, GetQuantity: 1}
+
+	tests := []struct {
+		name      string
+		promotion models.Promotion
+		lines     []taxableLine
+		remaining []int64
+		want      []int64
+	}{
+		{
+			"cheapest unit is free",
+			buy2get1,
+			[]taxableLine{{Quantity: 2, UnitPrice: 1000, Amount: 2000}, {Quantity: 1, UnitPrice: 500, Amount: 500}},
+			[]int64{2000, 500},
+			[]int64{0, 500},
+		},
+		{
+			"free units across one line",
+			buy1get1,
+			[]taxableLine{{Quantity: 3, UnitPrice: 1000, Amount: 3000}, {Quantity: 2, UnitPrice: 300, Amount: 600}},
+			[]int64{3000, 600},
+			[]int64{0, 600},
+		},
+		{
+			"free units across lines",
+			buy1get1,
+			[]taxableLine{{Quantity: 3, UnitPrice: 1000, Amount: 3000}, {Quantity: 1, UnitPrice: 300, Amount: 300}},
+			[]int64{3000, 300},
+			[]int64{1000, 300},
+		},
+		{
+			"not enough units",
+			buy2get1,
+			[]taxableLine{{Quantity: 2, UnitPrice: 1000, Amount: 2000}},
+			[]int64{2000},
+			[]int64{0},
+		},
+		{
+			"ineligible lines do not count",
+			buy2get1,
+			[]taxableLine{{Quantity: 2, UnitPrice: 1000, Amount: 2000}, {Quantity: 1, UnitPrice: 500, Amount: 500}},
+			[]int64{2000, 0},
+			[]int64{0, 0},
+		},
+		{
+			"misconfigured promotion",
+			models.Promotion{Type: models.PromotionBuyXGetY, BuyQuantity: 2},
+			[]taxableLine{{Quantity: 6, UnitPrice: 1000, Amount: 6000}},
+			[]int64{6000},
+			[]int64{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buyXGetYShares(tt.promotion, tt.lines, tt.remaining); !slices.Equal(got, tt.want) {
+				t.Fatalf("buyXGetYShares() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyPromotions(t *testing.T) {
+	shoes := uint(1)
+	lines := []taxableLine{
+		{ProductID: 1, CategoryID: shoes, Quantity: 2, UnitPrice: 1000, Amount: 2000},
+		{ProductID: 2, CategoryID: 2, Quantity: 1, UnitPrice: 3000, Amount: 3000},
+	}
+	tenPercent := models.Promotion{ID: 1, Type: models.PromotionPercentage, PercentOff: 10}
+	tenOff := models.Promotion{ID: 2, Type: models.PromotionFixed, AmountOff: 1000}
+	freeShipping := models.Promotion{ID: 3, Type: models.PromotionFreeShipping}
+
+	tests := []struct {
+		name         string
+		promotions   []models.Promotion
+		shipping     int64
+		wantLines    []int64
+		wantShipping int64
+		wantApplied  []uint
+	}{
+		{"percentage", []models.Promotion{tenPercent}, 500, []int64{200, 300}, 0, []uint{1}},
+		{"stacked on what is left", []models.Promotion{tenPercent, tenOff}, 500, []int64{600, 900}, 0, []uint{1, 2}},
+		{
+			"minimum subtotal not met",
+			[]models.Promotion{{ID: 4, Type: models.PromotionFixed, AmountOff: 1000, MinSubtotal: 5001}},
+			500, []int64{0, 0}, 0, []uint{},
+		},
+		{
+			"scoped to a category and capped at its lines",
+			[]models.Promotion{{ID: 5, Type: models.PromotionFixed, AmountOff: 5000, CategoryID: &shoes}},
+			500, []int64{2000, 0}, 0, []uint{5},
+		},
+		{"free shipping", []models.Promotion{freeShipping}, 500, []int64{0, 0}, 500, []uint{3}},
+		{"free shipping once", []models.Promotion{freeShipping, {ID: 6, Type: models.PromotionFreeShipping}}, 500, []int64{0, 0}, 500, []uint{3}},
+		{"free shipping without shipping", []models.Promotion{freeShipping}, 0, []int64{0, 0}, 0, []uint{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quote := applyPromotions(tt.promotions, lines, tt.shipping)
+			if !slices.Equal(quote.LineDiscounts, tt.wantLines) {
+				t.Fatalf("line discounts = %v, want %v", quote.LineDiscounts, tt.wantLines)
+			}
+			if quote.ShippingDiscount != tt.wantShipping {
+				t.Fatalf("shipping discount = %d, want %d", quote.ShippingDiscount, tt.wantShipping)
+			}
+
+			itemDiscount := int64(0)
+			for _, share := range tt.wantLines {
+				itemDiscount += share
+			}
+			if quote.ItemDiscount != itemDiscount || quote.Total != itemDiscount+tt.wantShipping {
+				t.Fatalf("item discount = %d, total = %d, want %d, %d", quote.ItemDiscount, quote.Total, itemDiscount, itemDiscount+tt.wantShipping)
+			}
+
+			applied := []uint{}
+			for _, discount := range quote.Discounts {
+				applied = append(applied, discount.PromotionID)
+			}
+			if !slices.Equal(applied, tt.wantApplied) {
+				t.Fatalf("applied promotions = %v, want %v", applied, tt.wantApplied)
+			}
+		})
+	}
+}
+
+func TestPromotionInWindow(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	before := now.Add(-time.Hour)
+	after := now.Add(time.Hour)
+
+	tests := []struct {
+		name      string
+		promotion models.Promotion
+		want      bool
+	}{
+		{"open ended", models.Promotion{Active: true}, true},
+		{"inactive", models.Promotion{Active: false}, false},
+		{"started", models.Promotion{Active: true, StartsAt: &before, EndsAt: &after}, true},
+		{"not started", models.Promotion{Active: true, StartsAt: &after}, false},
+		{"ended", models.Promotion{Active: true, EndsAt: &before}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := promotionInWindow(tt.promotion, now); got != tt.want {
+				t.Fatalf("promotionInWindow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
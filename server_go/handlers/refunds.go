@@ -0,0 +1,542 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"server/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Refund retry tuning
+const (
+	refundRetryInterval = time.Minute
+	refundRetryBatch    = 50
+	maxRefundAttempts   = 10
+)
+
+// refundError - A refund request that cannot be applied to the order
+type refundError string
+
+func (e refundError) Error() string {
+	return string(e)
+}
+
+// refundLine - Units of an order item to refund
+type refundLine struct {
+	OrderItemID uint `json:"orderItemId"`
+	Quantity    int  `json:"quantity"`
+}
+
+// refundRequest - What to refund; Full refunds everything not refunded yet.
+// Units are taken from those not shipped yet first unless Shipped says they
+// came back from the customer.
+type refundRequest struct {
+	Full     bool         `json:"full"`
+	Items    []refundLine `json:"items"`
+	Shipping bool         `json:"shipping"`
+	Restock  bool         `json:"restock"`
+	Shipped  bool         `json:"shipped"`
+	Reason   string       `json:"reason"`
+}
+
+// orderItemPaid - What the customer paid for a whole order item, in cents
+func orderItemPaid(item models.OrderItem) int64 {
+	paid := item.Price*int64(item.Quantity) - item.Discount
+	if !item.TaxIncluded {
+		paid += item.Tax
+	}
+	return paid
+}
+
+// orderShippingPaid - What the customer paid for shipping including its tax,
+// in cents. Items and discounts must be preloaded.
+func orderShippingPaid(order models.Order) int64 {
+	shippingTax := order.Tax
+	for _, item := range order.Items {
+		shippingTax -= item.Tax
+	}
+
+	paid := order.Shipping + shippingTax
+	for _, discount := range order.Discounts {
+		if discount.FreeShipping {
+			paid -= discount.Amount
+		}
+	}
+	return max(paid, 0)
+}
+
+// refundShare - What refunding units of an item returns when refunded units of
+// it were already refunded. Computed cumulatively so rounding never leaves
+// cents behind and refunding every unit returns exactly what was paid.
+func refundShare(paid int64, quantity, refunded, units int) int64 {
+	return paid*int64(refunded+units)/int64(quantity) - paid*int64(refunded)/int64(quantity)
+}
+
+// refundCancellation - How many of the units refunded of an item that has not
+// come back were backordered and how many were still to ship. Backordered
+// units go first, they never left stock, then units still to ship.
+func refundCancellation(item models.OrderItem, units int) (int, int) {
+	unfilled := min(item.BackorderedQuantity, units)
+	toShip := item.Quantity - item.ShippedQuantity - item.CancelledQuantity - item.BackorderedQuantity
+	return unfilled, min(max(toShip, 0), units-unfilled)
+}
+
+// formatCents - Formats an amount in cents as dollars
+func formatCents(amount int64) string {
+	return fmt.Sprintf("$%d.%02d", amount/100, amount%100)
+}
+
+// issueRefund - Records a pending refund of order item units and optionally
+// shipping, settleRefund sends it to the payment provider once the
+// transaction commits. Items, discounts and refunds must be preloaded.
+// Invalid requests are returned as a refundError.
+func issueRefund(tx *gorm.DB, order *models.Order, req refundRequest, actorID uint, actorRole string) (*models.Refund, error) {
+	if order.PaymentIntentID == "" {
+		return nil, refundError("Order has no payment to refund")
+	}
+
+	shippingRefunded := false
+	for _, existing := range order.Refunds {
+		if existing.Shipping > 0 && existing.Status != models.RefundFailed {
+			shippingRefunded = true
+		}
+	}
+
+	lines := req.Items
+	includeShipping := req.Shipping
+	if req.Full {
+		lines = nil
+		for _, item := range order.Items {
+			if remaining := item.Quantity - item.RefundedQuantity; remaining > 0 {
+				lines = append(lines, refundLine{OrderItemID: item.ID, Quantity: remaining})
+			}
+		}
+		includeShipping = !shippingRefunded
+	}
+
+	refund := models.Refund{
+		OrderID: order.ID,
+		Reason:  req.Reason,
+		Status:  models.RefundPending,
+	}
+	if actorID != 0 {
+		refund.CreatedByID = &actorID
+	}
+
+	for _, line := range lines {
+		var item *models.OrderItem
+		for i := range order.Items {
+			if order.Items[i].ID == line.OrderItemID {
+				item = &order.Items[i]
+			}
+		}
+		if item == nil {
+			return nil, refundError(fmt.Sprintf("Order item %d not found", line.OrderItemID))
+		}
+		if line.Quantity <= 0 || item.RefundedQuantity+line.Quantity > item.Quantity {
+			return nil, refundError("Invalid refund quantity for " + item.Name)
+		}
+
+		amount := refundShare(orderItemPaid(*item), item.Quantity, item.RefundedQuantity, line.Quantity)
+
+		result := tx.Model(&models.OrderItem{}).
+			Where("id = ? AND refunded_quantity + ? <= quantity", item.ID, line.Quantity).
+			UpdateColumn("refunded_quantity", gorm.Expr("refunded_quantity + ?", line.Quantity))
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil, refundError("Invalid refund quantity for " + item.Name)
+		}
+		item.RefundedQuantity += line.Quantity
+
+		// Either kind of unit is taken off what ships
+		unfilled, unshipped := 0, 0
+		if !req.Shipped {
+			unfilled, unshipped = refundCancellation(*item, line.Quantity)
+		}
+		if unfilled > 0 || unshipped > 0 {
+			if err := tx.Model(&models.OrderItem{}).Where("id = ?", item.ID).Updates(map[string]any{
+				"backordered_quantity": gorm.Expr("backordered_quantity - ?", unfilled),
+				"cancelled_quantity":   gorm.Expr("cancelled_quantity + ?", unfilled+unshipped),
+			}).Error; err != nil {
+				return nil, err
+			}
+			item.BackorderedQuantity -= unfilled
+			item.CancelledQuantity += unfilled + unshipped
+		}
+		if unfilled > 0 {
+			if err := syncAwaitingStock(tx, order.ID); err != nil {
+				return nil, err
+			}
+		}
+
+		if req.Restock && line.Quantity > unfilled {
+			if err := restock(tx, stockChange{
+				ProductID: item.ProductID,
+				Quantity:  line.Quantity - unfilled,
+				Type:      models.StockReturn,
+				Reason:    "Restocked by refund",
+				OrderID:   &order.ID,
+				ActorID:   actorRef(actorID),
+			}); err != nil {
+				return nil, err
+			}
+		}
+
+		refund.Items = append(refund.Items, models.RefundItem{
+			OrderItemID: item.ID,
+			Quantity:    line.Quantity,
+			Amount:      amount,
+			Cancelled:   unfilled + unshipped,
+			Backordered: unfilled,
+		})
+		refund.Amount += amount
+	}
+
+	if includeShipping {
+		if shippingRefunded {
+			return nil, refundError("Shipping was already refunded")
+		}
+		refund.Shipping = orderShippingPaid(*order)
+		refund.Amount += refund.Shipping
+	}
+
+	// Never refund more than was charged
+	remaining := order.Total - order.Refunded
+	if req.Full || refund.Amount > remaining {
+		refund.Amount = remaining
+	}
+	if refund.Amount <= 0 {
+		return nil, refundError("Nothing left to refund")
+	}
+
+	if err := tx.Model(&models.Order{}).Where("id = ?", order.ID).
+		UpdateColumn("refunded", gorm.Expr("refunded + ?", refund.Amount)).Error; err != nil {
+		return nil, err
+	}
+	order.Refunded += refund.Amount
+
+	note := "Refunded " + formatCents(refund.Amount)
+	if refund.Reason != "" {
+		note += ": " + refund.Reason
+	}
+	if order.Refunded >= order.Total && order.Status.CanTransitionTo(models.OrderRefunded) {
+		if err := transitionOrder(tx, order, models.OrderRefunded, actorID, actorRole, note); err != nil {
+			return nil, err
+		}
+	} else if err := recordOrderEvent(tx, order.ID, order.Status, order.Status, actorID, actorRole, note); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Create(&refund).Error; err != nil {
+		return nil, err
+	}
+	order.Refunds = append(order.Refunds, refund)
+	return &refund, nil
+}
+
+// settleRefund - Sends a pending refund to the payment provider and records
+// the outcome, run it once the transaction that recorded the refund has
+// committed. Errors the provider may recover from leave the refund pending for
+// the refund worker, refusals and running out of attempts mark it failed and
+// reverse it on the order.
+func settleRefund(db *gorm.DB, refund *models.Refund) error {
+	var order models.Order
+	if err := db.Select("id", "status", "payment_intent_id").First(&order, refund.OrderID).Error; err != nil {
+		return err
+	}
+
+	providerRefundID, err := refundPayment(order.PaymentIntentID, refund.Amount, order.ID, refund.ID)
+	if err == nil {
+		refund.Status = models.RefundSucceeded
+		refund.ProviderRefundID = providerRefundID
+		if err := db.Model(&models.Refund{}).Where("id = ?", refund.ID).Updates(map[string]any{
+			"status":             refund.Status,
+			"provider_refund_id": providerRefundID,
+		}).Error; err != nil {
+			log.Printf("Refund %s for order %d was issued but not recorded: %v", providerRefundID, order.ID, err)
+			return err
+		}
+		return nil
+	}
+
+	refund.Attempts++
+	refund.LastError = err.Error()
+	updates := map[string]any{"attempts": refund.Attempts, "last_error": refund.LastError}
+	if !paymentRefused(err) && refund.Attempts < maxRefundAttempts {
+		if dbErr := db.Model(&models.Refund{}).Where("id = ?", refund.ID).Updates(updates).Error; dbErr != nil {
+			log.Printf("Error recording failed refund %d: %v", refund.ID, dbErr)
+		}
+		return err
+	}
+
+	// The order goes back to what it was so the refund can be issued again
+	updates["status"] = models.RefundFailed
+	if dbErr := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Refund{}).
+			Where("id = ? AND status = ?", refund.ID, models.RefundPending).
+			Updates(updates)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return reverseRefund(tx, refund, "Refund of "+formatCents(refund.Amount)+" failed: "+err.Error())
+	}); dbErr != nil {
+		log.Printf("Error recording failed refund %d: %v", refund.ID, dbErr)
+		return err
+	}
+	refund.Status = models.RefundFailed
+	return err
+}
+
+// reverseRefund - Undoes what recording a refund the provider did not send
+// changed: the refunded amount, which is recomputed from the refunds not
+// failed, the refunded and cancelled units, a refunded status and the return
+// it refunded. Units it restocked stay in stock, they are back either way.
+func reverseRefund(tx *gorm.DB, refund *models.Refund, note string) error {
+	var order models.Order
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id", "status", "total").
+		First(&order, refund.OrderID).Error; err != nil {
+		return err
+	}
+
+	var items []models.RefundItem
+	if err := tx.Where("refund_id = ?", refund.ID).Find(&items).Error; err != nil {
+		return err
+	}
+	backordered := false
+	for _, item := range items {
+		if err := tx.Model(&models.OrderItem{}).Where("id = ?", item.OrderItemID).Updates(map[string]any{
+			"refunded_quantity":    gorm.Expr("refunded_quantity - ?", item.Quantity),
+			"cancelled_quantity":   gorm.Expr("cancelled_quantity - ?", item.Cancelled),
+			"backordered_quantity": gorm.Expr("backordered_quantity + ?", item.Backordered),
+		}).Error; err != nil {
+			return err
+		}
+		backordered = backordered || item.Backordered > 0
+	}
+	if backordered {
+		if err := syncAwaitingStock(tx, order.ID); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Exec(`UPDATE orders SET refunded = COALESCE((SELECT SUM(amount) FROM refunds
+		WHERE refunds.order_id = orders.id AND refunds.status <> ?), 0) WHERE id = ?`,
+		models.RefundFailed, order.ID).Error; err != nil {
+		return err
+	}
+	if err := tx.Select("id", "status", "total", "refunded").First(&order, order.ID).Error; err != nil {
+		return err
+	}
+
+	// Returns refunded by it can be refunded again
+	var ret models.ReturnRequest
+	if err := tx.Where("refund_id = ? AND status = ?", refund.ID, models.ReturnRefunded).First(&ret).Error; err == nil {
+		if err := tx.Model(&models.ReturnRequest{}).Where("id = ?", ret.ID).Updates(map[string]any{
+			"status":    models.ReturnReceived,
+			"refund_id": nil,
+		}).Error; err != nil {
+			return err
+		}
+		if err := recordReturnEvent(tx, ret.ID, models.ReturnRefunded, models.ReturnReceived, 0, actorSystem, note); err != nil {
+			return err
+		}
+	} else if err != gorm.ErrRecordNotFound {
+		return err
+	}
+
+	// Back to the status before the order counted as refunded, without the
+	// emails that status sends
+	to := order.Status
+	if order.Status == models.OrderRefunded && order.Refunded < order.Total {
+		var previous models.OrderEvent
+		if err := tx.Where("order_id = ? AND to_status = ? AND from_status <> ?", order.ID, models.OrderRefunded, models.OrderRefunded).
+			Order("id DESC").
+			First(&previous).Error; err != nil && err != gorm.ErrRecordNotFound {
+			return err
+		}
+		if previous.FromStatus != "" {
+			to = previous.FromStatus
+			if err := tx.Model(&models.Order{}).Where("id = ?", order.ID).Update("status", to).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Create(&models.OrderEvent{
+		OrderID:    order.ID,
+		FromStatus: order.Status,
+		ToStatus:   to,
+		ActorRole:  actorSystem,
+		Note:       note,
+	}).Error
+}
+
+// settlePayments - Sends an order's pending refunds to the payment provider
+// and voids the payment of an order cancelled before it was paid. Run it once
+// the transaction that changed the order has committed so no money moves for
+// changes that were rolled back.
+func settlePayments(db *gorm.DB, order *models.Order) error {
+	var refunds []models.Refund
+	if err := db.Where("order_id = ? AND status = ?", order.ID, models.RefundPending).
+		Order("id").
+		Find(&refunds).Error; err != nil {
+		return err
+	}
+	for i := range refunds {
+		err := settleRefund(db, &refunds[i])
+		for j := range order.Refunds {
+			if order.Refunds[j].ID == refunds[i].ID {
+				order.Refunds[j].Status = refunds[i].Status
+				order.Refunds[j].ProviderRefundID = refunds[i].ProviderRefundID
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if order.Status == models.OrderCancelled && order.Refunded == 0 && order.PaymentIntentID != "" {
+		return cancelPayment(order.PaymentIntentID)
+	}
+	return nil
+}
+
+// RunRefundWorker - Retries refunds the payment provider has not confirmed
+// until the process exits, run it in its own goroutine
+func (h *HandlerContext) RunRefundWorker() {
+	ticker := time.NewTicker(refundRetryInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Refunds recorded just now are still being sent by their request
+		var refunds []models.Refund
+		if err := h.db.Where("status = ? AND created_at <= ?", models.RefundPending, time.Now().Add(-refundRetryInterval)).
+			Order("id").
+			Limit(refundRetryBatch).
+			Find(&refunds).Error; err != nil {
+			log.Printf("Error fetching pending refunds: %v", err)
+			continue
+		}
+		for i := range refunds {
+			if err := settleRefund(&h.db, &refunds[i]); err != nil {
+				log.Printf("Error sending refund %d of order %d: %v", refunds[i].ID, refunds[i].OrderID, err)
+			}
+		}
+	}
+}
+
+// respondWithRefund - Responds with a refund just recorded, telling the staff
+// member when the payment provider has not confirmed it
+func respondWithRefund(w http.ResponseWriter, refund *models.Refund, settleErr error, payload map[string]any) {
+	payload["refund"] = refund
+	switch refund.Status {
+	case models.RefundSucceeded:
+		respondWithJson(w, http.StatusCreated, payload)
+	case models.RefundFailed:
+		respondWithError(w, http.StatusBadGateway, "The payment provider refused the refund, nothing was refunded: "+settleErr.Error())
+	default:
+		if settleErr != nil {
+			log.Printf("Error sending refund %d of order %d: %v", refund.ID, refund.OrderID, settleErr)
+		}
+		payload["message"] = "Refund recorded, it will be sent to the payment provider again shortly"
+		respondWithJson(w, http.StatusAccepted, payload)
+	}
+}
+
+// CreateRefund - Refunds a whole order or selected item quantities
+func (h *HandlerContext) CreateRefund(w http.ResponseWriter, r *http.Request) {
+	orderIDStr := chi.URLParam(r, "id")
+	orderID, err := strconv.ParseUint(orderIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	adminID, _ := strconv.ParseUint(r.URL.Query().Get("userId"), 10, 32)
+
+	var req refundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Reason = strings.TrimSpace(req.Reason)
+	if !req.Full && len(req.Items) == 0 && !req.Shipping {
+		respondWithError(w, http.StatusBadRequest, "Nothing selected to refund")
+		return
+	}
+
+	var order models.Order
+	if err := h.db.Preload("Items").Preload("Discounts").Preload("Refunds").First(&order, orderID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Order not found")
+		} else {
+			log.Printf("Error fetching order: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Error fetching order")
+		}
+		return
+	}
+
+	if !order.Status.CanTransitionTo(models.OrderRefunded) {
+		respondWithError(w, http.StatusConflict, "Order cannot be refunded while "+string(order.Status))
+		return
+	}
+
+	var refund *models.Refund
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		refund, err = issueRefund(tx, &order, req, uint(adminID), actorAdmin)
+		return err
+	})
+	if err != nil {
+		switch e := err.(type) {
+		case refundError:
+			respondWithError(w, http.StatusBadRequest, string(e))
+		case orderStatusError:
+			respondWithError(w, http.StatusConflict, string(e))
+		default:
+			log.Printf("Error refunding order %d: %v", order.ID, err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to refund order")
+		}
+		return
+	}
+
+	settleErr := settleRefund(&h.db, refund)
+	respondWithRefund(w, refund, settleErr, map[string]any{
+		"message":  "Refund issued successfully",
+		"status":   order.Status,
+		"refunded": order.Refunded,
+		"net":      order.Total - order.Refunded,
+	})
+}
+
+// GetRefunds - Lists the refunds of an order
+func (h *HandlerContext) GetRefunds(w http.ResponseWriter, r *http.Request) {
+	orderIDStr := chi.URLParam(r, "id")
+	orderID, err := strconv.ParseUint(orderIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var refunds []models.Refund
+	if err := h.db.Preload("Items").Where("order_id = ?", orderID).Order("created_at").Find(&refunds).Error; err != nil {
+		log.Printf("Error fetching refunds: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch refunds")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"refunds": refunds,
+	})
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"server/models"
+	"testing"
+)
+
+func TestRefundShare(t *testing.T) {
+	tests := []struct {
+		name     string
+		paid     int64
+		quantity int
+		refunded int
+		units    int
+		want     int64
+	}{
+		{"whole item", 1000, 3, 0, 3, 1000},
+		{"first of three", 1000, 3, 0, 1, 333},
+		{"second of three", 1000, 3, 1, 1, 333},
+		{"last of three takes the remainder", 1000, 3, 2, 1, 334},
+		{"two of three", 1000, 3, 0, 2, 666},
+		{"rest after two of three", 1000, 3, 2, 1, 334},
+		{"even split", 1200, 4, 1, 2, 600},
+		{"single unit", 999, 1, 0, 1, 999},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := refundShare(tt.paid, tt.quantity, tt.refunded, tt.units); got != tt.want {
+				t.Fatalf("refundShare(%d, %d, %d, %d) = %d, want %d", tt.paid, tt.quantity, tt.refunded, tt.units, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefundShareAddsUpToPaid(t *testing.T) {
+	splits := [][]int{{1, 1, 1, 1, 1, 1, 1}, {3, 4}, {2, 2, 3}, {6, 1}, {7}}
+	for _, paid := range []int64{1, 100, 999, 1001, 123457} {
+		for _, split := range splits {
+			total, refunded := int64(0), 0
+			for _, units := range split {
+				total += refundShare(paid, 7, refunded, units)
+				refunded += units
+			}
+			if total != paid {
+				t.Fatalf("refunding %d cents as %v returned %d", paid, split, total)
+			}
+		}
+	}
+}
+
+func TestOrderItemPaid(t *testing.T) {
+	tests := []struct {
+		name string
+		item models.OrderItem
+		want int64
+	}{
+		{"tax added", models.OrderItem{Price: 1000, Quantity: 2, Discount: 200, Tax: 150}, 1950},
+		{"tax included", models.OrderItem{Price: 1000, Quantity: 2, Discount: 200, Tax: 300, TaxIncluded: true}, 1800},
+		{"no discount or tax", models.OrderItem{Price: 499, Quantity: 3}, 1497},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := orderItemPaid(tt.item); got != tt.want {
+				t.Fatalf("orderItemPaid() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrderShippingPaid(t *testing.T) {
+	items := []models.OrderItem{{Tax: 100}, {Tax: 50}}
+
+	tests := []struct {
+		name  string
+		order models.Order
+		want  int64
+	}{
+		{"shipping and its tax", models.Order{Shipping: 500, Tax: 190, Items: items}, 540},
+		{"untaxed shipping", models.Order{Shipping: 500, Tax: 150, Items: items}, 500},
+		{
+			"free shipping discount",
+			models.Order{Shipping: 500, Tax: 150, Items: items, Discounts: []models.OrderDiscount{{Amount: 500, FreeShipping: true}}},
+			0,
+		},
+		{
+			"item discounts do not count",
+			models.Order{Shipping: 500, Tax: 150, Items: items, Discounts: []models.OrderDiscount{{Amount: 300}}},
+			500,
+		},
+		{"no shipping", models.Order{Tax: 150, Items: items}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := orderShippingPaid(tt.order); got != tt.want {
+				t.Fatalf("orderShippingPaid() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefundCancellation(t *testing.T) {
+	tests := []struct {
+		name          string
+		item          models.OrderItem
+		units         int
+		wantUnfilled  int
+		wantUnshipped int
+	}{
+		{"nothing shipped", models.OrderItem{Quantity: 5}, 2, 0, 2},
+		{"all shipped", models.OrderItem{Quantity: 5, ShippedQuantity: 5}, 2, 0, 0},
+		{"some shipped", models.OrderItem{Quantity: 5, ShippedQuantity: 4}, 3, 0, 1},
+		{"backordered first", models.OrderItem{Quantity: 5, BackorderedQuantity: 3}, 2, 2, 0},
+		{"backordered then to ship", models.OrderItem{Quantity: 5, BackorderedQuantity: 3}, 4, 3, 1},
+		{"backordered and shipped", models.OrderItem{Quantity: 5, BackorderedQuantity: 2, ShippedQuantity: 3}, 4, 2, 0},
+		{"already cancelled", models.OrderItem{Quantity: 5, CancelledQuantity: 2, ShippedQuantity: 1}, 3, 0, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unfilled, unshipped := refundCancellation(tt.item, tt.units)
+			if unfilled != tt.wantUnfilled || unshipped != tt.wantUnshipped {
+				t.Fatalf("refundCancellation() = %d, %d, want %d, %d", unfilled, unshipped, tt.wantUnfilled, tt.wantUnshipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package handlers
+
+import (
+	"log"
+	"server/models"
+	"sort"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Reservation sweep tuning
+const (
+	reservationSweepInterval = time.Minute
+	reservationSweepBatch    = 50
+	defaultReservationTTL    = 30 * time.Minute
+)
+
+// reservationTTL - How long checkout holds stock for a payment,
+// STOCK_RESERVATION_TTL takes a Go duration
+func reservationTTL() time.Duration {
+	return envDuration("STOCK_RESERVATION_TTL", defaultReservationTTL)
+}
+
+// reservedStock - Units held by active reservations for each of the products
+func reservedStock(db *gorm.DB, productIDs []uint) (map[uint]int, error) {
+	reserved := make(map[uint]int, len(productIDs))
+	if len(productIDs) == 0 {
+		return reserved, nil
+	}
+
+	var rows []struct {
+		ProductID uint
+		Quantity  int
+	}
+	if err := db.Model(&models.StockReservation{}).
+		Select("product_id, SUM(quantity) AS quantity").
+		Where("product_id IN ? AND status = ?", productIDs, models.ReservationActive).
+		Group("product_id").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		reserved[row.ProductID] = row.Quantity
+	}
+	return reserved, nil
+}
+
+// fillAvailable - Sets Available on the products from their stock and
+// active reservations, and Backorderable and BackorderNotice for products
+// sold beyond stock
+func fillAvailable(db *gorm.DB, products ...*models.Product) error {
+	productIDs := make([]uint, 0, len(products))
+	for _, product := range products {
+		productIDs = append(productIDs, product.ID)
+	}
+	reserved, err := reservedStock(db, productIDs)
+	if err != nil {
+		return err
+	}
+	waiting, err := backorderedStock(db, productIDs)
+	if err != nil {
+		return err
+	}
+	for _, product := range products {
+		setAvailable(product, reserved[product.ID], waiting[product.ID])
+	}
+	return nil
+}
+
+// setAvailable - Sets Available, Backorderable and BackorderNotice on a
+// product given the units held by reservations and the units backordered
+func setAvailable(product *models.Product, reserved, backordered int) {
+	product.Available = max(product.Stock-reserved, 0)
+	if product.BackorderMode != models.BackorderNone {
+		product.Backorderable = max(product.BackorderLimit-backordered, 0)
+	}
+	// Backorders only need explaining once stock runs out, pre-orders always do
+	if product.Available <= 0 || product.BackorderMode == models.BackorderPreorder {
+		product.BackorderNotice = backorderNotice(*product)
+	}
+}
+
+// fillCartAvailable - Sets Available on the preloaded products of cart items
+func fillCartAvailable(db *gorm.DB, cartItems []models.Cart) error {
+	products := make([]*models.Product, 0, len(cartItems))
+	for i := range cartItems {
+		products = append(products, &cartItems[i].Product)
+	}
+	return fillAvailable(db, products...)
+}
+
+// reserveStock - Holds the order's units until expiresAt at the warehouses
+// allocateStock picks, failing with a checkoutError when a product has too
+// few units left. Units beyond stock of products that allow it are
+// backordered instead. Products are locked in ID order so concurrent checkouts
+// cannot deadlock.
+func reserveStock(tx *gorm.DB, order *models.Order, expiresAt time.Time) error {
+	items := append([]models.OrderItem(nil), order.Items...)
+	sort.Slice(items, func(i, j int) bool { return items[i].ProductID < items[j].ProductID })
+
+	for _, item := range items {
+		var product models.Product
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id", "stock", "backorder_mode", "backorder_limit", "available_on").
+			First(&product, item.ProductID).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return checkoutError("Insufficient stock for " + item.Name)
+			}
+			return err
+		}
+		if err := fillAvailable(tx, &product); err != nil {
+			return err
+		}
+		if sellable(product) < item.Quantity {
+			return checkoutError("Insufficient stock for " + item.Name)
+		}
+
+		// Units beyond stock wait for receipts rather than being held
+		reserved := min(item.Quantity, product.Available)
+		if backordered := item.Quantity - reserved; backordered > 0 {
+			if err := backorderItem(tx, order, item.ID, product, backordered); err != nil {
+				return err
+			}
+		}
+		if reserved == 0 {
+			continue
+		}
+		item.Quantity = reserved
+
+		// Without warehouses the whole line is held against the product
+		allocations, err := allocateStock(tx, item, order.Country, order.State)
+		if err != nil {
+			return err
+		}
+		if len(allocations) == 0 {
+			allocations = []warehouseAllocation{{Quantity: item.Quantity}}
+		}
+		for _, allocation := range allocations {
+			reservation := models.StockReservation{
+				ProductID: item.ProductID,
+				OrderID:   order.ID,
+				Quantity:  allocation.Quantity,
+				Status:    models.ReservationActive,
+				ExpiresAt: expiresAt,
+			}
+			if allocation.WarehouseID != 0 {
+				reservation.WarehouseID = &allocation.WarehouseID
+			}
+			if err := tx.Create(&reservation).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// convertReservations - Sells the units reserved for a paid order. Orders
+// placed before reservations took their stock at checkout and have none.
+// Reserved units that left stock some other way meanwhile are backordered,
+// the payment went through either way.
+func convertReservations(tx *gorm.DB, orderID uint) error {
+	var reservations []models.StockReservation
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("order_id = ? AND status = ?", orderID, models.ReservationActive).
+		Order("product_id").
+		Find(&reservations).Error; err != nil {
+		return err
+	}
+
+	for _, reservation := range reservations {
+		// A savepoint undoes a product level change when the warehouse falls short
+		err := tx.Transaction(func(tx *gorm.DB) error {
+			_, err := moveStock(tx, stockChange{
+				ProductID:   reservation.ProductID,
+				WarehouseID: reservation.WarehouseID,
+				Quantity:    -reservation.Quantity,
+				Type:        models.StockSale,
+				OrderID:     &orderID,
+			})
+			return err
+		})
+		if _, ok := err.(stockError); ok {
+			if err := backorderShortfall(tx, orderID, reservation.ProductID, reservation.Quantity); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil && err != gorm.ErrRecordNotFound {
+			return err
+		}
+	}
+	return resolveReservations(tx, orderID, models.ReservationConverted)
+}
+
+// releaseReservations - Frees the units still held for an order, telling
+// customers waiting on them
+func releaseReservations(tx *gorm.DB, orderID uint) error {
+	var productIDs []uint
+	if err := tx.Model(&models.StockReservation{}).
+		Distinct("product_id").
+		Where("order_id = ? AND status = ?", orderID, models.ReservationActive).
+		Pluck("product_id", &productIDs).Error; err != nil {
+		return err
+	}
+	if err := resolveReservations(tx, orderID, models.ReservationReleased); err != nil {
+		return err
+	}
+	for _, productID := range productIDs {
+		if err := syncStockAlerts(tx, productID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveReservations - Closes an order's active reservations with status
+func resolveReservations(tx *gorm.DB, orderID uint, status models.ReservationStatus) error {
+	return tx.Model(&models.StockReservation{}).
+		Where("order_id = ? AND status = ?", orderID, models.ReservationActive).
+		Updates(map[string]any{"status": status, "resolved_at": time.Now()}).Error
+}
+
+// expireReservations - Makes an order's reservations due now so the next sweep
+// releases them, used when its payment fails
+func expireReservations(db *gorm.DB, orderID uint) error {
+	return db.Model(&models.StockReservation{}).
+		Where("order_id = ? AND status = ? AND expires_at > ?", orderID, models.ReservationActive, time.Now()).
+		Update("expires_at", time.Now()).Error
+}
+
+// RunReservationWorker - Releases expired reservations until the process
+// exits, run it in its own goroutine
+func (h *HandlerContext) RunReservationWorker() {
+	ticker := time.NewTicker(reservationSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Keep going while full batches come back
+		for {
+			released, err := h.releaseExpiredReservations()
+			if err != nil {
+				log.Printf("Error releasing stock reservations: %v", err)
+			}
+			if err != nil || released < reservationSweepBatch {
+				break
+			}
+		}
+	}
+}
+
+// releaseExpiredReservations - Settles one batch of pending orders whose
+// reservations expired, or that were placed as long ago with everything
+// backordered so nothing was reserved: paid ones are marked paid, payments
+// still processing keep their stock a while longer and the rest are
+// cancelled, freeing the stock and then voiding the payment. The payment is
+// checked before the order is locked, and orders that could not be settled
+// wait a sweep so they do not hold up the rest. Returns how many orders
+// were handled.
+func (h *HandlerContext) releaseExpiredReservations() (int, error) {
+	var orderIDs []uint
+	if err := h.db.Model(&models.StockReservation{}).
+		Where("status = ? AND expires_at <= ?", models.ReservationActive, time.Now()).
+		Group("order_id").
+		Order("MIN(expires_at), order_id").
+		Limit(reservationSweepBatch).
+		Pluck("order_id", &orderIDs).Error; err != nil {
+		return 0, err
+	}
+	if room := reservationSweepBatch - len(orderIDs); room > 0 {
+		var backordered []uint
+		if err := h.db.Model(&models.Order{}).
+			Where("status = ? AND awaiting_stock AND created_at <= ?", models.OrderPending, time.Now().Add(-reservationTTL())).
+			Where("NOT EXISTS (SELECT 1 FROM stock_reservations WHERE stock_reservations.order_id = orders.id AND stock_reservations.status = ?)", models.ReservationActive).
+			Order("created_at, id").
+			Limit(room).
+			Pluck("id", &backordered).Error; err != nil {
+			return 0, err
+		}
+		orderIDs = append(orderIDs, backordered...)
+	}
+
+	handled := 0
+	for _, orderID := range orderIDs {
+		order, cancelled, err := h.settleExpiredOrder(orderID)
+		if err != nil {
+			// Left for a later sweep, the stock stays held meanwhile
+			log.Printf("Error releasing reservations of order %d: %v", orderID, err)
+			if err := h.db.Model(&models.StockReservation{}).
+				Where("order_id = ? AND status = ?", orderID, models.ReservationActive).
+				Update("expires_at", time.Now().Add(reservationSweepInterval)).Error; err != nil {
+				log.Printf("Error postponing reservations of order %d: %v", orderID, err)
+			}
+			continue
+		}
+		if cancelled {
+			// A payment that goes through anyway is refunded when it arrives
+			if err := settlePayments(&h.db, &order); err != nil {
+				log.Printf("Error voiding payment of order %d: %v", orderID, err)
+			}
+		}
+		handled++
+	}
+	return handled, nil
+}
+
+// settleExpiredOrder - Marks paid, extends or cancels one order picked by
+// the sweep, reporting whether it was cancelled
+func (h *HandlerContext) settleExpiredOrder(orderID uint) (models.Order, bool, error) {
+	var order models.Order
+	if err := h.db.Select("id", "status", "payment_intent_id").First(&order, orderID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return order, false, h.db.Transaction(func(tx *gorm.DB) error {
+				return releaseReservations(tx, orderID)
+			})
+		}
+		return order, false, err
+	}
+
+	// A missed webhook must not cancel a payment that went through
+	var status stripe.PaymentIntentStatus
+	if order.Status == models.OrderPending && order.PaymentIntentID != "" {
+		var err error
+		if status, err = paymentStatus(order.PaymentIntentID); err != nil {
+			return order, false, err
+		}
+	}
+
+	cancelled := false
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Preload("Items").Preload("Discounts").Preload("Refunds").
+			First(&order, orderID).Error; err != nil {
+			return err
+		}
+		// The webhook or a customer may have got there first
+		if order.Status != models.OrderPending {
+			return releaseReservations(tx, orderID)
+		}
+
+		switch status {
+		case stripe.PaymentIntentStatusSucceeded:
+			return transitionOrder(tx, &order, models.OrderPaid, 0, actorSystem, "Payment received")
+		case stripe.PaymentIntentStatusProcessing, stripe.PaymentIntentStatusRequiresCapture:
+			return tx.Model(&models.StockReservation{}).
+				Where("order_id = ? AND status = ?", orderID, models.ReservationActive).
+				Update("expires_at", time.Now().Add(reservationTTL())).Error
+		}
+		cancelled = true
+		return cancelOrder(tx, &order, 0, actorSystem, "Payment was not completed in time")
+	})
+	return order, cancelled && err == nil, err
+}
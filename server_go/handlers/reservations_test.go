@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"server/models"
+	"testing"
+	"time"
+)
+
+func TestSetAvailable(t *testing.T) {
+	tests := []struct {
+		name              string
+		product           models.Product
+		reserved          int
+		backordered       int
+		wantAvailable     int
+		wantBackorderable int
+		wantNotice        bool
+	}{
+		{"nothing reserved", models.Product{Stock: 10}, 0, 0, 10, 0, false},
+		{"reserved units are held", models.Product{Stock: 10}, 4, 0, 6, 0, false},
+		{"all units reserved", models.Product{Stock: 4}, 4, 0, 0, 0, false},
+		{"more reserved than in stock", models.Product{Stock: 2}, 5, 0, 0, 0, false},
+		{
+			"backorders in stock need no notice",
+			models.Product{Stock: 3, BackorderMode: models.BackorderAllowed, BackorderLimit: 5},
+			0, 2, 3, 3, false,
+		},
+		{
+			"backorders once sold out",
+			models.Product{Stock: 3, BackorderMode: models.BackorderAllowed, BackorderLimit: 5},
+			3, 0, 0, 5, true,
+		},
+		{
+			"backorder limit reached",
+			models.Product{BackorderMode: models.BackorderAllowed, BackorderLimit: 5},
+			0, 7, 0, 0, true,
+		},
+		{
+			"pre-orders always explain",
+			models.Product{Stock: 8, BackorderMode: models.BackorderPreorder, BackorderLimit: 20},
+			1, 6, 7, 14, true,
+		},
+		{"stock only products are not backorderable", models.Product{BackorderLimit: 5}, 0, 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			product := tt.product
+			setAvailable(&product, tt.reserved, tt.backordered)
+			if product.Available != tt.wantAvailable || product.Backorderable != tt.wantBackorderable {
+				t.Fatalf("available, backorderable = %d, %d, want %d, %d",
+					product.Available, product.Backorderable, tt.wantAvailable, tt.wantBackorderable)
+			}
+			if (product.BackorderNotice != "") != tt.wantNotice {
+				t.Fatalf("backorder notice = %q, want one: %v", product.BackorderNotice, tt.wantNotice)
+			}
+			if got := sellable(product); got != tt.wantAvailable+tt.wantBackorderable {
+				t.Fatalf("sellable() = %d, want %d", got, tt.wantAvailable+tt.wantBackorderable)
+			}
+		})
+	}
+}
+
+func TestReservationTTL(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{"default", "", defaultReservationTTL},
+		{"configured", "15m", 15 * time.Minute},
+		{"invalid", "soon", defaultReservationTTL},
+		{"not positive", "-5m", defaultReservationTTL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("STOCK_RESERVATION_TTL", tt.value)
+			if got := reservationTTL(); got != tt.want {
+				t.Fatalf("reservationTTL() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,579 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"server/models"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// returnError - A return request or action that cannot be applied
+type returnError string
+
+func (e returnError) Error() string {
+	return string(e)
+}
+
+// returnLine - Units of an order item the customer wants to send back
+type returnLine struct {
+	OrderItemID uint   `json:"orderItemId"`
+	Quantity    int    `json:"quantity"`
+	Reason      string `json:"reason"`
+}
+
+// inspectionLine - Outcome of inspecting a received return item
+type inspectionLine struct {
+	ReturnItemID uint   `json:"returnItemId"`
+	Condition    string `json:"condition"`
+	Restock      bool   `json:"restock"`
+}
+
+// recordReturnEvent - Appends an entry to the return's status history
+func recordReturnEvent(tx *gorm.DB, returnID uint, from, to models.ReturnStatus, actorID uint, actorRole, note string) error {
+	event := models.ReturnEvent{
+		ReturnRequestID: returnID,
+		FromStatus:      from,
+		ToStatus:        to,
+		ActorRole:       actorRole,
+		Note:            note,
+	}
+	if actorID != 0 {
+		event.ActorID = &actorID
+	}
+	return tx.Create(&event).Error
+}
+
+// transitionReturn - Moves a return to a new status and records the event.
+// Disallowed or concurrent changes are returned as a returnError.
+func transitionReturn(tx *gorm.DB, ret *models.ReturnRequest, to models.ReturnStatus, actorID uint, actorRole, note string) error {
+	from := ret.Status
+	if !from.CanTransitionTo(to) {
+		return returnError("Cannot change return status from " + string(from) + " to " + string(to))
+	}
+
+	updates := map[string]any{"status": to}
+	if actorRole == actorAdmin && note != "" {
+		updates["admin_note"] = note
+	}
+	result := tx.Model(&models.ReturnRequest{}).
+		Where("id = ? AND status = ?", ret.ID, from).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return returnError("Return status was changed by someone else, please reload")
+	}
+	ret.Status = to
+	if actorRole == actorAdmin && note != "" {
+		ret.AdminNote = note
+	}
+
+	return recordReturnEvent(tx, ret.ID, from, to, actorID, actorRole, note)
+}
+
+// returnedQuantities - Units per order item held by the order's open returns
+func (h *HandlerContext) returnedQuantities(orderID uint) (map[uint]int, error) {
+	var rows []struct {
+		OrderItemID uint
+		Quantity    int
+	}
+	err := h.db.Model(&models.ReturnItem{}).
+		Select("return_items.order_item_id, SUM(return_items.quantity) AS quantity").
+		Joins("JOIN return_requests ON return_requests.id = return_items.return_request_id").
+		Where("return_requests.order_id = ? AND return_requests.status NOT IN ?", orderID,
+			[]models.ReturnStatus{models.ReturnRejected, models.ReturnRefunded}).
+		Group("return_items.order_item_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	quantities := make(map[uint]int, len(rows))
+	for _, row := range rows {
+		quantities[row.OrderItemID] = row.Quantity
+	}
+	return quantities, nil
+}
+
+// decodeReturnNote - Reads the optional note of an admin action
+func decodeReturnNote(r *http.Request) (string, error) {
+	var reqBody struct {
+		Note string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(reqBody.Note), nil
+}
+
+// respondWithReturnError - Maps errors from return actions to a response
+func respondWithReturnError(w http.ResponseWriter, err error) {
+	switch e := err.(type) {
+	case returnError:
+		respondWithError(w, http.StatusConflict, string(e))
+	case refundError:
+		respondWithError(w, http.StatusConflict, string(e))
+	case orderStatusError:
+		respondWithError(w, http.StatusConflict, string(e))
+	default:
+		log.Printf("Error updating return: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to update return")
+	}
+}
+
+// CreateReturn - Lets a customer request a return of delivered items
+func (h *HandlerContext) CreateReturn(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIDFromRequest(r)
+	if userId == 0 {
+		respondWithError(w, http.StatusUnauthorized, "Missing authorization token")
+		return
+	}
+
+	orderIDStr := chi.URLParam(r, "id")
+	orderID, err := strconv.ParseUint(orderIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var reqBody struct {
+		Reason string       `json:"reason"`
+		Items  []returnLine `json:"items"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	reqBody.Reason = strings.TrimSpace(reqBody.Reason)
+	if reqBody.Reason == "" {
+		respondWithError(w, http.StatusBadRequest, "Reason is required")
+		return
+	}
+	if len(reqBody.Items) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Select at least one item to return")
+		return
+	}
+
+	var order models.Order
+	if err := h.db.Preload("Items").Where("id = ? AND user_id = ?", orderID, userId).First(&order).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Order not found")
+		} else {
+			respondWithError(w, http.StatusInternalServerError, "Error fetching order")
+		}
+		return
+	}
+
+	if order.Status != models.OrderDelivered {
+		respondWithError(w, http.StatusConflict, "Only delivered orders can be returned")
+		return
+	}
+
+	held, err := h.returnedQuantities(order.ID)
+	if err != nil {
+		log.Printf("Error fetching open returns: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create return")
+		return
+	}
+
+	ret := models.ReturnRequest{
+		OrderID: order.ID,
+		UserID:  uint(userId),
+		Status:  models.ReturnRequested,
+		Reason:  reqBody.Reason,
+	}
+	for _, line := range reqBody.Items {
+		var item *models.OrderItem
+		for i := range order.Items {
+			if order.Items[i].ID == line.OrderItemID {
+				item = &order.Items[i]
+			}
+		}
+		if item == nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Order item %d not found", line.OrderItemID))
+			return
+		}
+
+		returnable := item.Quantity - item.RefundedQuantity - held[item.ID]
+		if line.Quantity <= 0 || line.Quantity > returnable {
+			respondWithError(w, http.StatusBadRequest, "Invalid return quantity for "+item.Name)
+			return
+		}
+		held[item.ID] += line.Quantity
+
+		ret.Items = append(ret.Items, models.ReturnItem{
+			OrderItemID: item.ID,
+			Quantity:    line.Quantity,
+			Reason:      strings.TrimSpace(line.Reason),
+		})
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&ret).Error; err != nil {
+			return err
+		}
+		return recordReturnEvent(tx, ret.ID, "", models.ReturnRequested, uint(userId), actorCustomer, ret.Reason)
+	})
+	if err != nil {
+		log.Printf("Error creating return: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create return")
+		return
+	}
+
+	respondWithJson(w, http.StatusCreated, map[string]any{
+		"message": "Return requested successfully",
+		"return":  ret,
+	})
+}
+
+// GetOrderReturns - Returns requested for one of the user's orders
+func (h *HandlerContext) GetOrderReturns(w http.ResponseWriter, r *http.Request) {
+	userId := getUserIDFromRequest(r)
+	if userId == 0 {
+		respondWithError(w, http.StatusUnauthorized, "Missing authorization token")
+		return
+	}
+
+	orderIDStr := chi.URLParam(r, "id")
+	orderID, err := strconv.ParseUint(orderIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var returns []models.ReturnRequest
+	if err := h.db.Preload("Items").Preload("Events", func(db *gorm.DB) *gorm.DB {
+		return db.Order("created_at, id")
+	}).Where("order_id = ? AND user_id = ?", orderID, userId).Order("created_at").Find(&returns).Error; err != nil {
+		log.Printf("Error fetching returns: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch returns")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message": "Returns retrieved successfully",
+		"returns": returns,
+	})
+}
+
+// GetReturns - Lists return requests, optionally by status, newest first
+func (h *HandlerContext) GetReturns(w http.ResponseWriter, r *http.Request) {
+	query := h.db.Preload("Items").Order("created_at DESC")
+	if status := r.URL.Query().Get("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var returns []models.ReturnRequest
+	if err := query.Find(&returns).Error; err != nil {
+		log.Printf("Error fetching returns: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch returns")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"returns": returns,
+	})
+}
+
+// loadReturn - Fetches the return in the URL with its items and history,
+// responding with an error when it cannot
+func (h *HandlerContext) loadReturn(w http.ResponseWriter, r *http.Request) (*models.ReturnRequest, bool) {
+	returnIDStr := chi.URLParam(r, "id")
+	returnID, err := strconv.ParseUint(returnIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid return ID")
+		return nil, false
+	}
+
+	var ret models.ReturnRequest
+	if err := h.db.Preload("Items").Preload("Events", func(db *gorm.DB) *gorm.DB {
+		return db.Order("created_at, id")
+	}).First(&ret, returnID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Return not found")
+		} else {
+			log.Printf("Error fetching return: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Error fetching return")
+		}
+		return nil, false
+	}
+	return &ret, true
+}
+
+// GetReturn - A return request with its items and status history
+func (h *HandlerContext) GetReturn(w http.ResponseWriter, r *http.Request) {
+	ret, ok := h.loadReturn(w, r)
+	if !ok {
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"return": ret,
+	})
+}
+
+// ApproveReturn - Accepts a return so the customer can send the items back
+func (h *HandlerContext) ApproveReturn(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := strconv.ParseUint(r.URL.Query().Get("userId"), 10, 32)
+
+	note, err := decodeReturnNote(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	ret, ok := h.loadReturn(w, r)
+	if !ok {
+		return
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		return transitionReturn(tx, ret, models.ReturnApproved, uint(adminID), actorAdmin, note)
+	})
+	if err != nil {
+		respondWithReturnError(w, err)
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message": "Return approved",
+		"return":  ret,
+	})
+}
+
+// RejectReturn - Declines a return, a note for the customer is required.
+// Items of a received return that were restocked are taken out again.
+func (h *HandlerContext) RejectReturn(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := strconv.ParseUint(r.URL.Query().Get("userId"), 10, 32)
+
+	note, err := decodeReturnNote(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if note == "" {
+		respondWithError(w, http.StatusBadRequest, "Note is required")
+		return
+	}
+
+	ret, ok := h.loadReturn(w, r)
+	if !ok {
+		return
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		received := ret.Status == models.ReturnReceived
+		if err := transitionReturn(tx, ret, models.ReturnRejected, uint(adminID), actorAdmin, note); err != nil {
+			return err
+		}
+		if received {
+			return unstockReturn(tx, ret, uint(adminID))
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithReturnError(w, err)
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message": "Return rejected",
+		"return":  ret,
+	})
+}
+
+// unstockReturn - Takes the units a received return put back into stock out
+// again when it is rejected, the items go back to the customer
+func unstockReturn(tx *gorm.DB, ret *models.ReturnRequest, actorID uint) error {
+	for i := range ret.Items {
+		item := &ret.Items[i]
+		if !item.Restocked {
+			continue
+		}
+
+		var orderItem models.OrderItem
+		if err := tx.Select("id", "product_id", "name").First(&orderItem, item.OrderItemID).Error; err != nil {
+			return err
+		}
+		err := restock(tx, stockChange{
+			ProductID: orderItem.ProductID,
+			Quantity:  -item.Quantity,
+			Type:      models.StockReturn,
+			Reason:    "Return rejected",
+			OrderID:   &ret.OrderID,
+			ReturnID:  &ret.ID,
+			ActorID:   actorRef(actorID),
+		})
+		if _, ok := err.(stockError); ok {
+			return returnError("Restocked units of " + orderItem.Name + " were sold already")
+		}
+		if err != nil {
+			return err
+		}
+
+		item.Restocked = false
+		if err := tx.Model(item).Update("restocked", false).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReceiveReturn - Records the items as received with their inspected
+// condition and puts the resellable ones back into stock
+func (h *HandlerContext) ReceiveReturn(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := strconv.ParseUint(r.URL.Query().Get("userId"), 10, 32)
+
+	var reqBody struct {
+		Items []inspectionLine `json:"items"`
+		Note  string           `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil && err != io.EOF {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	ret, ok := h.loadReturn(w, r)
+	if !ok {
+		return
+	}
+
+	var orderItems []models.OrderItem
+	if err := h.db.Where("order_id = ?", ret.OrderID).Find(&orderItems).Error; err != nil {
+		log.Printf("Error fetching order items: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to receive return")
+		return
+	}
+	productIDs := make(map[uint]uint, len(orderItems))
+	for _, item := range orderItems {
+		productIDs[item.ID] = item.ProductID
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := transitionReturn(tx, ret, models.ReturnReceived, uint(adminID), actorAdmin, strings.TrimSpace(reqBody.Note)); err != nil {
+			return err
+		}
+
+		for _, line := range reqBody.Items {
+			var item *models.ReturnItem
+			for i := range ret.Items {
+				if ret.Items[i].ID == line.ReturnItemID {
+					item = &ret.Items[i]
+				}
+			}
+			if item == nil {
+				return returnError(fmt.Sprintf("Return item %d not found", line.ReturnItemID))
+			}
+
+			item.Condition = strings.TrimSpace(line.Condition)
+			item.Restocked = line.Restock
+			if err := tx.Model(item).Updates(map[string]any{
+				"condition": item.Condition,
+				"restocked": item.Restocked,
+			}).Error; err != nil {
+				return err
+			}
+
+			if line.Restock {
+				if err := restock(tx, stockChange{
+					ProductID: productIDs[item.OrderItemID],
+					Quantity:  item.Quantity,
+					Type:      models.StockReturn,
+					Reason:    item.Condition,
+					OrderID:   &ret.OrderID,
+					ReturnID:  &ret.ID,
+					ActorID:   actorRef(uint(adminID)),
+				}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		respondWithReturnError(w, err)
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message": "Return received",
+		"return":  ret,
+	})
+}
+
+// RefundReturn - Refunds the returned items of a received return through the
+// order's payment, optionally with shipping
+func (h *HandlerContext) RefundReturn(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := strconv.ParseUint(r.URL.Query().Get("userId"), 10, 32)
+
+	var reqBody struct {
+		Shipping bool   `json:"shipping"`
+		Note     string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil && err != io.EOF {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	ret, ok := h.loadReturn(w, r)
+	if !ok {
+		return
+	}
+	if ret.Status != models.ReturnReceived {
+		respondWithError(w, http.StatusConflict, "Only received returns can be refunded")
+		return
+	}
+
+	var order models.Order
+	if err := h.db.Preload("Items").Preload("Discounts").Preload("Refunds").First(&order, ret.OrderID).Error; err != nil {
+		log.Printf("Error fetching order: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Error fetching order")
+		return
+	}
+
+	// Stock was already handled when the items were inspected
+	req := refundRequest{
+		Shipping: reqBody.Shipping,
+		Shipped:  true,
+		Reason:   fmt.Sprintf("Return #%d: %s", ret.ID, ret.Reason),
+	}
+	for _, item := range ret.Items {
+		req.Items = append(req.Items, refundLine{OrderItemID: item.OrderItemID, Quantity: item.Quantity})
+	}
+
+	var refund *models.Refund
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		note := strings.TrimSpace(reqBody.Note)
+		if err := transitionReturn(tx, ret, models.ReturnRefunded, uint(adminID), actorAdmin, note); err != nil {
+			return err
+		}
+
+		var err error
+		refund, err = issueRefund(tx, &order, req, uint(adminID), actorAdmin)
+		if err != nil {
+			return err
+		}
+
+		ret.RefundID = &refund.ID
+		return tx.Model(&models.ReturnRequest{}).Where("id = ?", ret.ID).Update("refund_id", refund.ID).Error
+	})
+	if err != nil {
+		respondWithReturnError(w, err)
+		return
+	}
+
+	settleErr := settleRefund(&h.db, refund)
+	respondWithRefund(w, refund, settleErr, map[string]any{
+		"message": "Return refunded",
+		"return":  ret,
+	})
+}
@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"server/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// Tracking page of each supported carrier, %s is the tracking number
+var carrierTrackingURLs = map[string]string{
+	"ups":   "https://www.ups.com/track?tracknum=%s",
+	"usps":  "https://tools.usps.com/go/TrackConfirmAction?tLabels=%s",
+	"fedex": "https://www.fedex.com/fedextrack/?trknbr=%s",
+	"dhl":   "https://www.dhl.com/en/express/tracking.html?AWB=%s",
+}
+
+// shipmentLine - Units of an order item to put in a shipment
+type shipmentLine struct {
+	OrderItemID uint `json:"orderItemId"`
+	Quantity    int  `json:"quantity"`
+}
+
+// trackingURL - Tracking link for a known carrier, empty otherwise
+func trackingURL(carrier, trackingNumber string) string {
+	format, ok := carrierTrackingURLs[strings.ToLower(carrier)]
+	if !ok || trackingNumber == "" {
+		return ""
+	}
+	return fmt.Sprintf(format, url.QueryEscape(trackingNumber))
+}
+
+// CreateShipment - Ships some or all of the remaining units of an order
+func (h *HandlerContext) CreateShipment(w http.ResponseWriter, r *http.Request) {
+	orderIDStr := chi.URLParam(r, "id")
+	orderID, err := strconv.ParseUint(orderIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	adminID, _ := strconv.ParseUint(r.URL.Query().Get("userId"), 10, 32)
+
+	var reqBody struct {
+		Carrier        string         `json:"carrier"`
+		TrackingNumber string         `json:"trackingNumber"`
+		TrackingURL    string         `json:"trackingUrl"` // For carriers without a known tracking page
+		Items          []shipmentLine `json:"items"`       // Empty ships everything remaining
+		WarehouseID    *uint          `json:"warehouseId"` // Defaults to where most units were sold from
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	reqBody.Carrier = strings.TrimSpace(reqBody.Carrier)
+	reqBody.TrackingNumber = strings.TrimSpace(reqBody.TrackingNumber)
+	if reqBody.Carrier == "" {
+		respondWithError(w, http.StatusBadRequest, "Carrier is required")
+		return
+	}
+
+	var order models.Order
+	if err := h.db.Preload("Items").First(&order, orderID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Order not found")
+		} else {
+			log.Printf("Error fetching order: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Error fetching order")
+		}
+		return
+	}
+
+	switch order.Status {
+	case models.OrderPaid, models.OrderProcessing, models.OrderShipped:
+	default:
+		respondWithError(w, http.StatusConflict, "Order cannot be shipped while "+string(order.Status))
+		return
+	}
+
+	lines := reqBody.Items
+	if len(lines) == 0 {
+		for _, item := range order.Items {
+			if remaining := item.Quantity - item.CancelledQuantity - item.ShippedQuantity - item.BackorderedQuantity; remaining > 0 {
+				lines = append(lines, shipmentLine{OrderItemID: item.ID, Quantity: remaining})
+			}
+		}
+		if len(lines) == 0 {
+			respondWithError(w, http.StatusConflict, "All items have already been shipped or are waiting for stock")
+			return
+		}
+	}
+
+	shipment := models.Shipment{
+		OrderID:        order.ID,
+		Carrier:        reqBody.Carrier,
+		TrackingNumber: reqBody.TrackingNumber,
+		TrackingURL:    trackingURL(reqBody.Carrier, reqBody.TrackingNumber),
+		ShippedAt:      time.Now(),
+	}
+	if shipment.TrackingURL == "" {
+		shipment.TrackingURL = reqBody.TrackingURL
+	}
+	if adminID != 0 {
+		adminUserID := uint(adminID)
+		shipment.CreatedByID = &adminUserID
+	}
+
+	if reqBody.WarehouseID != nil {
+		var count int64
+		if err := h.db.Model(&models.Warehouse{}).Where("id = ?", *reqBody.WarehouseID).Count(&count).Error; err != nil {
+			log.Printf("Error fetching warehouse: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Error fetching warehouse")
+			return
+		}
+		if count == 0 {
+			respondWithError(w, http.StatusBadRequest, "Warehouse not found")
+			return
+		}
+		shipment.WarehouseID = reqBody.WarehouseID
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if shipment.WarehouseID == nil {
+			warehouseID, err := shipmentWarehouse(tx, order.ID)
+			if err != nil {
+				return err
+			}
+			shipment.WarehouseID = warehouseID
+		}
+
+		for _, line := range lines {
+			var item *models.OrderItem
+			for i := range order.Items {
+				if order.Items[i].ID == line.OrderItemID {
+					item = &order.Items[i]
+				}
+			}
+			if item == nil {
+				return orderStatusError(fmt.Sprintf("Order item %d not found", line.OrderItemID))
+			}
+
+			result := tx.Model(&models.OrderItem{}).
+				Where("id = ? AND shipped_quantity + cancelled_quantity + backordered_quantity + ? <= quantity", item.ID, line.Quantity).
+				UpdateColumn("shipped_quantity", gorm.Expr("shipped_quantity + ?", line.Quantity))
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 && line.Quantity > 0 && item.BackorderedQuantity > 0 {
+				return orderStatusError(fmt.Sprintf("%d of %s are still waiting for stock", item.BackorderedQuantity, item.Name))
+			}
+			if line.Quantity <= 0 || result.RowsAffected == 0 {
+				return orderStatusError("Invalid shipment quantity for " + item.Name)
+			}
+			item.ShippedQuantity += line.Quantity
+
+			shipment.Items = append(shipment.Items, models.ShipmentItem{
+				OrderItemID: item.ID,
+				Quantity:    line.Quantity,
+			})
+		}
+
+		if err := tx.Create(&shipment).Error; err != nil {
+			return err
+		}
+
+		// The first parcel moves the order along to shipped
+		note := fmt.Sprintf("Shipment %d via %s", shipment.ID, shipment.Carrier)
+		if order.Status == models.OrderPaid {
+			if err := transitionOrder(tx, &order, models.OrderProcessing, uint(adminID), actorAdmin, note); err != nil {
+				return err
+			}
+		}
+		if order.Status == models.OrderProcessing {
+			if err := transitionOrder(tx, &order, models.OrderShipped, uint(adminID), actorAdmin, note); err != nil {
+				return err
+			}
+		} else if err := recordOrderEvent(tx, order.ID, order.Status, order.Status, uint(adminID), actorAdmin, note); err != nil {
+			return err
+		}
+
+		// Every parcel gets its own tracking email
+		return enqueueOrderEmail(tx, order.ID, "order_shipped", note, &shipment)
+	})
+	if err != nil {
+		if msg, ok := err.(orderStatusError); ok {
+			respondWithError(w, http.StatusBadRequest, string(msg))
+		} else {
+			log.Printf("Error creating shipment: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to create shipment")
+		}
+		return
+	}
+
+	respondWithJson(w, http.StatusCreated, map[string]any{
+		"message":  "Shipment created successfully",
+		"shipment": shipment,
+		"status":   order.Status,
+	})
+}
+
+// GetShipments - Lists the shipments of an order
+func (h *HandlerContext) GetShipments(w http.ResponseWriter, r *http.Request) {
+	orderIDStr := chi.URLParam(r, "id")
+	orderID, err := strconv.ParseUint(orderIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var shipments []models.Shipment
+	if err := h.db.Preload("Items").Where("order_id = ?", orderID).Order("shipped_at").Find(&shipments).Error; err != nil {
+		log.Printf("Error fetching shipments: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch shipments")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"shipments": shipments,
+	})
+}
+
+// orderDelivered - Whether every unit of an order shipped, or will not, and
+// every parcel arrived. Items and shipments must be preloaded.
+func orderDelivered(order models.Order) bool {
+	if len(order.Shipments) == 0 {
+		return false
+	}
+	for _, item := range order.Items {
+		if item.ShippedQuantity+item.CancelledQuantity < item.Quantity {
+			return false
+		}
+	}
+	for _, shipment := range order.Shipments {
+		if shipment.DeliveredAt == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// MarkShipmentDelivered - Records a parcel as delivered, the order is delivered
+// once every unit has shipped and every parcel has arrived
+func (h *HandlerContext) MarkShipmentDelivered(w http.ResponseWriter, r *http.Request) {
+	shipmentIDStr := chi.URLParam(r, "id")
+	shipmentID, err := strconv.ParseUint(shipmentIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid shipment ID")
+		return
+	}
+
+	adminID, _ := strconv.ParseUint(r.URL.Query().Get("userId"), 10, 32)
+
+	var shipment models.Shipment
+	if err := h.db.First(&shipment, shipmentID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Shipment not found")
+		} else {
+			log.Printf("Error fetching shipment: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Error fetching shipment")
+		}
+		return
+	}
+
+	if shipment.DeliveredAt != nil {
+		respondWithError(w, http.StatusConflict, "Shipment is already delivered")
+		return
+	}
+
+	var order models.Order
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Model(&shipment).Update("delivered_at", now).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Preload("Items").Preload("Shipments").First(&order, shipment.OrderID).Error; err != nil {
+			return err
+		}
+		if order.Status != models.OrderShipped || !orderDelivered(order) {
+			return nil
+		}
+		return transitionOrder(tx, &order, models.OrderDelivered, uint(adminID), actorAdmin, "All shipments delivered")
+	})
+	if err != nil {
+		if msg, ok := err.(orderStatusError); ok {
+			respondWithError(w, http.StatusConflict, string(msg))
+		} else {
+			log.Printf("Error marking shipment delivered: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to update shipment")
+		}
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message": "Shipment marked as delivered",
+		"status":  order.Status,
+	})
+}
@@ -0,0 +1,533 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"server/models"
+	"sort"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// ShippingRate - A shipping option available for a cart, amounts in cents.
+// MethodID 0 is the built-in flat rate used when no zones are configured.
+type ShippingRate struct {
+	MethodID uint                      `json:"methodId"`
+	ZoneID   uint                      `json:"zoneId"`
+	Name     string                    `json:"name"`
+	Type     models.ShippingMethodType `json:"type"`
+	Cost     int64                     `json:"cost"`
+	MinDays  int                       `json:"minDays"`
+	MaxDays  int                       `json:"maxDays"`
+}
+
+type shippingZoneRequest struct {
+	Name         string `json:"name"`
+	Country      string `json:"country"`
+	State        string `json:"state"`
+	PostalPrefix string `json:"postalPrefix"`
+	Priority     int    `json:"priority"`
+	Active       *bool  `json:"active"`
+}
+
+type shippingMethodRequest struct {
+	Name           string                    `json:"name"`
+	Type           models.ShippingMethodType `json:"type"`
+	BaseRate       int64                     `json:"baseRate"`
+	PerKgRate      int64                     `json:"perKgRate"`
+	FreeThreshold  int64                     `json:"freeThreshold"`
+	Surcharge      int64                     `json:"surcharge"`
+	MaxWeightGrams int                       `json:"maxWeightGrams"`
+	MinDays        int                       `json:"minDays"`
+	MaxDays        int                       `json:"maxDays"`
+	Active         *bool                     `json:"active"`
+}
+
+// billableGrams - Shipping weight of one unit, the greater of actual and
+// volumetric weight (length x width x height in cm / 5000 kg)
+func billableGrams(product models.Product) int {
+	volumetric := int(math.Ceil(product.LengthCm * product.WidthCm * product.HeightCm / 5))
+	return max(product.WeightGrams, volumetric)
+}
+
+// cartWeightGrams - Total billable weight of cart items with preloaded products
+func cartWeightGrams(cartItems []models.Cart) int {
+	grams := 0
+	for _, item := range cartItems {
+		grams += billableGrams(item.Product) * item.Quantity
+	}
+	return grams
+}
+
+// shippingMethodCost - Cost of a method for a cart, false if the method cannot ship it
+func shippingMethodCost(method models.ShippingMethod, subtotal int64, grams int) (int64, bool) {
+	if method.MaxWeightGrams > 0 && grams > method.MaxWeightGrams {
+		return 0, false
+	}
+
+	switch method.Type {
+	case models.ShippingFlat:
+		return method.BaseRate, true
+	case models.ShippingWeight:
+		perWeight := int64(math.Ceil(float64(grams) * float64(method.PerKgRate) / 1000))
+		return method.BaseRate + perWeight, true
+	case models.ShippingExpress:
+		// Couriers bill every started kilogram, plus the premium for the faster service
+		perWeight := int64(math.Ceil(float64(grams)/1000)) * method.PerKgRate
+		return method.BaseRate + perWeight + method.Surcharge, true
+	case models.ShippingFreeOver:
+		if method.FreeThreshold > 0 && subtotal >= method.FreeThreshold {
+			return 0, true
+		}
+		return method.BaseRate, true
+	}
+	return 0, false
+}
+
+// applyShippingZones - Rates offered by the most specific zone covering the address
+func applyShippingZones(zones []models.ShippingZone, subtotal int64, grams int, address CheckoutAddress) []ShippingRate {
+	var zone *models.ShippingZone
+	for i := range zones {
+		candidate := zones[i]
+		if !address.matches(candidate.Country, candidate.State, candidate.PostalPrefix) {
+			continue
+		}
+		if zone == nil {
+			zone = &zones[i]
+			continue
+		}
+		score := areaSpecificity(candidate.Country, candidate.State, candidate.PostalPrefix)
+		bestScore := areaSpecificity(zone.Country, zone.State, zone.PostalPrefix)
+		if score > bestScore || (score == bestScore && candidate.Priority > zone.Priority) {
+			zone = &zones[i]
+		}
+	}
+
+	rates := []ShippingRate{}
+	if zone == nil {
+		return rates
+	}
+
+	for _, method := range zone.Methods {
+		if !method.Active {
+			continue
+		}
+		cost, ok := shippingMethodCost(method, subtotal, grams)
+		if !ok {
+			continue
+		}
+		rates = append(rates, ShippingRate{
+			MethodID: method.ID,
+			ZoneID:   zone.ID,
+			Name:     method.Name,
+			Type:     method.Type,
+			Cost:     cost,
+			MinDays:  method.MinDays,
+			MaxDays:  method.MaxDays,
+		})
+	}
+
+	sort.SliceStable(rates, func(i, j int) bool {
+		return rates[i].Cost < rates[j].Cost
+	})
+	return rates
+}
+
+// shippingRates - Rates available for cart items with preloaded products.
+// Free shipping thresholds count the subtotal less itemDiscount, what the
+// customer pays for the items.
+func (h *HandlerContext) shippingRates(cartItems []models.Cart, address CheckoutAddress, itemDiscount int64) ([]ShippingRate, error) {
+	var zones []models.ShippingZone
+	if err := h.db.Preload("Methods").Where("active = ?", true).Find(&zones).Error; err != nil {
+		return nil, err
+	}
+
+	// Fall back to the flat rate until an admin sets up zones
+	if len(zones) == 0 {
+		return []ShippingRate{{
+			Name: "Standard",
+			Type: models.ShippingFlat,
+			Cost: flatShippingCents,
+		}}, nil
+	}
+
+	subtotal := -itemDiscount
+	for _, line := range cartTaxableLines(cartItems) {
+		subtotal += line.Amount
+	}
+	return applyShippingZones(zones, subtotal, cartWeightGrams(cartItems), address), nil
+}
+
+// selectShippingRate - Picks the requested method, or the cheapest when methodID is 0
+func selectShippingRate(rates []ShippingRate, methodID uint) (ShippingRate, bool) {
+	if len(rates) == 0 {
+		return ShippingRate{}, false
+	}
+	if methodID == 0 {
+		return rates[0], true
+	}
+	for _, rate := range rates {
+		if rate.MethodID == methodID {
+			return rate, true
+		}
+	}
+	return ShippingRate{}, false
+}
+
+// GetShippingRates - Lists the shipping methods available for the user's or guest's cart
+func (h *HandlerContext) GetShippingRates(w http.ResponseWriter, r *http.Request) {
+	owner, ok := h.resolveCartOwner(w, r, false)
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		Address    CheckoutAddress `json:"address"`
+		CouponCode string          `json:"couponCode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if reqBody.Address.Country == "" {
+		respondWithError(w, http.StatusBadRequest, "Country is required")
+		return
+	}
+
+	var cartItems []models.Cart
+	if err := owner.scope(h.db.Preload("Product")).Find(&cartItems).Error; err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch cart items")
+		return
+	}
+
+	if len(cartItems) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Cart is empty")
+		return
+	}
+
+	// Discounts can take the cart below a free shipping threshold
+	promotions, err := h.activePromotions(owner.UserID, reqBody.CouponCode)
+	if err != nil {
+		if msg, ok := err.(checkoutError); ok {
+			respondWithError(w, http.StatusBadRequest, string(msg))
+			return
+		}
+		log.Printf("Error fetching promotions: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to calculate shipping rates")
+		return
+	}
+	itemDiscount := applyPromotions(promotions, cartTaxableLines(cartItems), 0).ItemDiscount
+
+	rates, err := h.shippingRates(cartItems, reqBody.Address, itemDiscount)
+	if err != nil {
+		log.Printf("Error calculating shipping rates: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to calculate shipping rates")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message": "Shipping rates retrieved successfully",
+		"rates":   rates,
+	})
+}
+
+// GetShippingZones - Lists shipping zones with their methods
+func (h *HandlerContext) GetShippingZones(w http.ResponseWriter, r *http.Request) {
+	var zones []models.ShippingZone
+	if err := h.db.Preload("Methods").Order("country, state, postal_prefix, id").Find(&zones).Error; err != nil {
+		log.Printf("Error fetching shipping zones: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch shipping zones")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"shippingZones": zones,
+	})
+}
+
+// CreateShippingZone - Creates a shipping zone
+func (h *HandlerContext) CreateShippingZone(w http.ResponseWriter, r *http.Request) {
+	var req shippingZoneRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Name == "" {
+		respondWithError(w, http.StatusBadRequest, "Name is required")
+		return
+	}
+
+	zone := models.ShippingZone{
+		Name:         req.Name,
+		Country:      req.Country,
+		State:        req.State,
+		PostalPrefix: req.PostalPrefix,
+		Priority:     req.Priority,
+		Active:       req.Active == nil || *req.Active,
+	}
+	if err := h.db.Create(&zone).Error; err != nil {
+		log.Printf("Error creating shipping zone: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create shipping zone")
+		return
+	}
+
+	respondWithJson(w, http.StatusCreated, map[string]any{
+		"message":      "Shipping zone created successfully",
+		"shippingZone": zone,
+	})
+}
+
+// UpdateShippingZone - Updates a shipping zone
+func (h *HandlerContext) UpdateShippingZone(w http.ResponseWriter, r *http.Request) {
+	zoneIDStr := chi.URLParam(r, "id")
+	zoneID, err := strconv.ParseUint(zoneIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid shipping zone ID")
+		return
+	}
+
+	var req shippingZoneRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if req.Name == "" {
+		respondWithError(w, http.StatusBadRequest, "Name is required")
+		return
+	}
+
+	var zone models.ShippingZone
+	if err := h.db.First(&zone, zoneID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Shipping zone not found")
+		} else {
+			log.Printf("Error fetching shipping zone: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Error fetching shipping zone")
+		}
+		return
+	}
+
+	zone.Name = req.Name
+	zone.Country = req.Country
+	zone.State = req.State
+	zone.PostalPrefix = req.PostalPrefix
+	zone.Priority = req.Priority
+	if req.Active != nil {
+		zone.Active = *req.Active
+	}
+
+	if err := h.db.Save(&zone).Error; err != nil {
+		log.Printf("Error updating shipping zone: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to update shipping zone")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message":      "Shipping zone updated successfully",
+		"shippingZone": zone,
+	})
+}
+
+// DeleteShippingZone - Deletes a shipping zone and its methods
+func (h *HandlerContext) DeleteShippingZone(w http.ResponseWriter, r *http.Request) {
+	zoneIDStr := chi.URLParam(r, "id")
+	zoneID, err := strconv.ParseUint(zoneIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid shipping zone ID")
+		return
+	}
+
+	var deleted int64
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("zone_id = ?", zoneID).Delete(&models.ShippingMethod{}).Error; err != nil {
+			return err
+		}
+		result := tx.Delete(&models.ShippingZone{}, zoneID)
+		deleted = result.RowsAffected
+		return result.Error
+	})
+	if err != nil {
+		log.Printf("Error deleting shipping zone: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete shipping zone")
+		return
+	}
+	if deleted == 0 {
+		respondWithError(w, http.StatusNotFound, "Shipping zone not found")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]string{
+		"message": "Shipping zone deleted successfully",
+	})
+}
+
+// validateShippingMethod - Checks a shipping method request, returns an error message if invalid
+func validateShippingMethod(req shippingMethodRequest) string {
+	if req.Name == "" {
+		return "Name is required"
+	}
+	switch req.Type {
+	case models.ShippingFlat, models.ShippingWeight:
+	case models.ShippingExpress:
+		if req.Surcharge <= 0 {
+			return "Express surcharge must be greater than 0"
+		}
+	case models.ShippingFreeOver:
+		if req.FreeThreshold <= 0 {
+			return "Free shipping threshold must be greater than 0"
+		}
+	default:
+		return "Invalid shipping method type"
+	}
+	if req.BaseRate < 0 || req.PerKgRate < 0 || req.Surcharge < 0 || req.MaxWeightGrams < 0 {
+		return "Rates and weight limits cannot be negative"
+	}
+	if req.MinDays < 0 || req.MaxDays < req.MinDays {
+		return "Invalid delivery estimate"
+	}
+	return ""
+}
+
+// CreateShippingMethod - Adds a shipping method to a zone
+func (h *HandlerContext) CreateShippingMethod(w http.ResponseWriter, r *http.Request) {
+	zoneIDStr := chi.URLParam(r, "id")
+	zoneID, err := strconv.ParseUint(zoneIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid shipping zone ID")
+		return
+	}
+
+	var req shippingMethodRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if msg := validateShippingMethod(req); msg != "" {
+		respondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	var zone models.ShippingZone
+	if err := h.db.First(&zone, zoneID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Shipping zone not found")
+		} else {
+			log.Printf("Error fetching shipping zone: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Error fetching shipping zone")
+		}
+		return
+	}
+
+	method := models.ShippingMethod{
+		ZoneID:         zone.ID,
+		Name:           req.Name,
+		Type:           req.Type,
+		BaseRate:       req.BaseRate,
+		PerKgRate:      req.PerKgRate,
+		FreeThreshold:  req.FreeThreshold,
+		Surcharge:      req.Surcharge,
+		MaxWeightGrams: req.MaxWeightGrams,
+		MinDays:        req.MinDays,
+		MaxDays:        req.MaxDays,
+		Active:         req.Active == nil || *req.Active,
+	}
+	if err := h.db.Create(&method).Error; err != nil {
+		log.Printf("Error creating shipping method: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create shipping method")
+		return
+	}
+
+	respondWithJson(w, http.StatusCreated, map[string]any{
+		"message":        "Shipping method created successfully",
+		"shippingMethod": method,
+	})
+}
+
+// UpdateShippingMethod - Updates a shipping method
+func (h *HandlerContext) UpdateShippingMethod(w http.ResponseWriter, r *http.Request) {
+	methodIDStr := chi.URLParam(r, "id")
+	methodID, err := strconv.ParseUint(methodIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid shipping method ID")
+		return
+	}
+
+	var req shippingMethodRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if msg := validateShippingMethod(req); msg != "" {
+		respondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	var method models.ShippingMethod
+	if err := h.db.First(&method, methodID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Shipping method not found")
+		} else {
+			log.Printf("Error fetching shipping method: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Error fetching shipping method")
+		}
+		return
+	}
+
+	method.Name = req.Name
+	method.Type = req.Type
+	method.BaseRate = req.BaseRate
+	method.PerKgRate = req.PerKgRate
+	method.FreeThreshold = req.FreeThreshold
+	method.Surcharge = req.Surcharge
+	method.MaxWeightGrams = req.MaxWeightGrams
+	method.MinDays = req.MinDays
+	method.MaxDays = req.MaxDays
+	if req.Active != nil {
+		method.Active = *req.Active
+	}
+
+	if err := h.db.Save(&method).Error; err != nil {
+		log.Printf("Error updating shipping method: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to update shipping method")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message":        "Shipping method updated successfully",
+		"shippingMethod": method,
+	})
+}
+
+// DeleteShippingMethod - Deletes a shipping method
+func (h *HandlerContext) DeleteShippingMethod(w http.ResponseWriter, r *http.Request) {
+	methodIDStr := chi.URLParam(r, "id")
+	methodID, err := strconv.ParseUint(methodIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid shipping method ID")
+		return
+	}
+
+	result := h.db.Delete(&models.ShippingMethod{}, methodID)
+	if result.Error != nil {
+		log.Printf("Error deleting shipping method: %v", result.Error)
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete shipping method")
+		return
+	}
+	if result.RowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "Shipping method not found")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]string{
+		"message": "Shipping method deleted successfully",
+	})
+}
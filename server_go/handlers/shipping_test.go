@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"server/models"
+	"slices"
+	"testing"
+)
+
+func TestBillableGrams(t *testing.T) {
+	tests := []struct {
+		name    string
+		product models.Product
+		want    int
+	}{
+		{"actual weight", models.Product{WeightGrams: 1200, LengthCm: 10, WidthCm: 10, HeightCm: 10}, 1200},
+		{"volumetric weight", models.Product{WeightGrams: 300, LengthCm: 40, WidthCm: 30, HeightCm: 20}, 4800},
+		{"volumetric rounds up", models.Product{WeightGrams: 1, LengthCm: 3, WidthCm: 2, HeightCm: 1}, 2},
+		{"no dimensions", models.Product{WeightGrams: 500}, 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := billableGrams(tt.product); got != tt.want {
+				t.Fatalf("billableGrams() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShippingMethodCost(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   models.ShippingMethod
+		subtotal int64
+		grams    int
+		want     int64
+		wantOK   bool
+	}{
+		{"flat", models.ShippingMethod{Type: models.ShippingFlat, BaseRate: 500}, 1000, 2500, 500, true},
+		{"weight", models.ShippingMethod{Type: models.ShippingWeight, BaseRate: 300, PerKgRate: 200}, 1000, 2500, 800, true},
+		{"weight rounds up", models.ShippingMethod{Type: models.ShippingWeight, PerKgRate: 333}, 1000, 1001, 334, true},
+		{"express bills started kilograms", models.ShippingMethod{Type: models.ShippingExpress, BaseRate: 1000, PerKgRate: 400, Surcharge: 250}, 1000, 2001, 2450, true},
+		{"free over threshold", models.ShippingMethod{Type: models.ShippingFreeOver, BaseRate: 700, FreeThreshold: 5000}, 5000, 100, 0, true},
+		{"free over below threshold", models.ShippingMethod{Type: models.ShippingFreeOver, BaseRate: 700, FreeThreshold: 5000}, 4999, 100, 700, true},
+		{"free over without threshold", models.ShippingMethod{Type: models.ShippingFreeOver, BaseRate: 700}, 100000, 100, 700, true},
+		{"over max weight", models.ShippingMethod{Type: models.ShippingFlat, BaseRate: 500, MaxWeightGrams: 2000}, 1000, 2001, 0, false},
+		{"at max weight", models.ShippingMethod{Type: models.ShippingFlat, BaseRate: 500, MaxWeightGrams: 2000}, 1000, 2000, 500, true},
+		{"unknown type", models.ShippingMethod{Type: "pigeon", BaseRate: 500}, 1000, 100, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := shippingMethodCost(tt.method, tt.subtotal, tt.grams)
+			if got != tt.want || ok != tt.wantOK {
+				t.Fatalf("shippingMethodCost() = %d, %v, want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestApplyShippingZones(t *testing.T) {
+	zones := []models.ShippingZone{
+		{ID: 1, Country: "US", Methods: []models.ShippingMethod{
+			{ID: 10, Type: models.ShippingFlat, BaseRate: 900, Active: true},
+		}},
+		{ID: 2, Country: "US", State: "CA", Methods: []models.ShippingMethod{
+			{ID: 20, Type: models.ShippingFlat, BaseRate: 800, Active: true},
+			{ID: 21, Type: models.ShippingFlat, BaseRate: 100, Active: false},
+			{ID: 22, Type: models.ShippingFreeOver, BaseRate: 600, FreeThreshold: 5000, Active: true},
+			{ID: 23, Type: models.ShippingFlat, BaseRate: 400, MaxWeightGrams: 1000, Active: true},
+		}},
+	}
+
+	tests := []struct {
+		name     string
+		address  CheckoutAddress
+		subtotal int64
+		grams    int
+		want     []uint
+	}{
+		{"most specific zone, cheapest first", CheckoutAddress{Country: "US", State: "CA"}, 1000, 500, []uint{23, 22, 20}},
+		{"threshold met", CheckoutAddress{Country: "US", State: "CA"}, 5000, 500, []uint{22, 23, 20}},
+		{"too heavy for a method", CheckoutAddress{Country: "US", State: "CA"}, 1000, 1500, []uint{22, 20}},
+		{"country zone", CheckoutAddress{Country: "US", State: "NY"}, 1000, 500, []uint{10}},
+		{"no zone", CheckoutAddress{Country: "FR"}, 1000, 500, []uint{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rates := applyShippingZones(zones, tt.subtotal, tt.grams, tt.address)
+			got := make([]uint, len(rates))
+			for i, rate := range rates {
+				got[i] = rate.MethodID
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("applyShippingZones() methods = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,379 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"server/models"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// stockError - A stock change that cannot be applied, such as one taking a
+// product below zero
+type stockError string
+
+func (e stockError) Error() string {
+	return string(e)
+}
+
+// stockChange - One movement to post to the stock ledger
+type stockChange struct {
+	ProductID   uint
+	WarehouseID *uint // Nil draws removals from the warehouses holding units, the rest goes to the primary
+	Quantity    int   // Negative removes stock
+	Type        models.StockMovementType
+	Reason      string
+	OrderID     *uint
+	ReturnID    *uint
+	ActorID     *uint
+}
+
+// stockDelta - How much the change moves the product's stock, nothing for
+// transfers between warehouses, and whether the units reserved for orders
+// awaiting payment must stay put. Only sales draw on reserved units.
+func (change stockChange) stockDelta() (int, bool) {
+	if change.Type == models.StockTransfer {
+		return 0, false
+	}
+	return change.Quantity, change.Quantity < 0 && change.Type != models.StockSale
+}
+
+// moveStock - Applies a change to the product's stock and its warehouse level
+// and appends it to the ledger with the resulting balance, run it inside a
+// transaction. Transfers only move units between warehouses. Removals never
+// take stock below zero, nor other than sales below the units reserved for
+// orders awaiting payment, and fail with a stockError instead. A removal
+// split across warehouses posts a movement for each and returns the last.
+// Missing products give gorm.ErrRecordNotFound.
+func moveStock(tx *gorm.DB, change stockChange) (models.StockMovement, error) {
+	// Removals with no warehouse named come from wherever the units are
+	if change.WarehouseID == nil && change.Type != models.StockTransfer && change.Quantity < 0 {
+		allocations, err := drawStock(tx, change.ProductID, -change.Quantity, change.Type != models.StockSale)
+		if err != nil {
+			return models.StockMovement{}, err
+		}
+		if len(allocations) > 1 {
+			var movement models.StockMovement
+			for i := range allocations {
+				part := change
+				part.WarehouseID = &allocations[i].WarehouseID
+				part.Quantity = -allocations[i].Quantity
+				if movement, err = moveStock(tx, part); err != nil {
+					return models.StockMovement{}, err
+				}
+			}
+			return movement, nil
+		}
+		if len(allocations) == 1 {
+			change.WarehouseID = &allocations[0].WarehouseID
+		}
+	}
+
+	// Stock always lands in a warehouse once there are any
+	if change.WarehouseID == nil && change.Type != models.StockTransfer {
+		warehouse, err := primaryWarehouse(tx)
+		if err == nil {
+			change.WarehouseID = &warehouse.ID
+		} else if err != gorm.ErrRecordNotFound {
+			return models.StockMovement{}, err
+		}
+	}
+
+	delta, keepReserved := change.stockDelta()
+
+	var product models.Product
+	query := tx.Model(&product).
+		Clauses(clause.Returning{Columns: []clause.Column{{Name: "stock"}}}).
+		Where("id = ?", change.ProductID)
+	if keepReserved {
+		query = query.Where(`stock - COALESCE((SELECT SUM(quantity) FROM stock_reservations
+			WHERE stock_reservations.product_id = products.id AND stock_reservations.status = ?), 0) >= ?`,
+			models.ReservationActive, -delta)
+	} else if delta < 0 {
+		query = query.Where("stock >= ?", -delta)
+	}
+	result := query.UpdateColumn("stock", gorm.Expr("stock + ?", delta))
+	if result.Error != nil {
+		return models.StockMovement{}, result.Error
+	}
+	if result.RowsAffected == 0 {
+		if delta < 0 {
+			var exists int64
+			if err := tx.Model(&models.Product{}).Where("id = ?", change.ProductID).Count(&exists).Error; err != nil {
+				return models.StockMovement{}, err
+			}
+			if exists > 0 && keepReserved {
+				return models.StockMovement{}, stockError("Not enough stock that is not reserved for orders awaiting payment")
+			}
+			if exists > 0 {
+				return models.StockMovement{}, stockError("Not enough stock")
+			}
+		}
+		return models.StockMovement{}, gorm.ErrRecordNotFound
+	}
+
+	if change.WarehouseID != nil {
+		if err := moveWarehouseStock(tx, *change.WarehouseID, change.ProductID, change.Quantity); err != nil {
+			return models.StockMovement{}, err
+		}
+	}
+
+	movement := models.StockMovement{
+		ProductID:   change.ProductID,
+		WarehouseID: change.WarehouseID,
+		Type:        change.Type,
+		Quantity:    change.Quantity,
+		Balance:     product.Stock,
+		Reason:      change.Reason,
+		OrderID:     change.OrderID,
+		ReturnID:    change.ReturnID,
+		ActorID:     change.ActorID,
+	}
+	if err := tx.Create(&movement).Error; err != nil {
+		return models.StockMovement{}, err
+	}
+
+	// Incoming units go to customers waiting on backorders first
+	if change.Quantity > 0 && change.Type != models.StockTransfer {
+		if err := fillBackorders(tx, change.ProductID); err != nil {
+			return models.StockMovement{}, err
+		}
+	}
+
+	// Selling out and restocking arm and fire the wishlist and stock alerts
+	if err := syncWishlistAlerts(tx, change.ProductID); err != nil {
+		return models.StockMovement{}, err
+	}
+	return movement, syncStockAlerts(tx, change.ProductID)
+}
+
+// soldStock - Units of each product the ledger shows leaving stock for an
+// order and not put back yet
+func soldStock(tx *gorm.DB, orderID uint) (map[uint]int, error) {
+	var rows []struct {
+		ProductID uint
+		Quantity  int
+	}
+	if err := tx.Model(&models.StockMovement{}).
+		Select("product_id, -SUM(quantity) AS quantity").
+		Where("order_id = ? AND type IN ?", orderID,
+			[]models.StockMovementType{models.StockSale, models.StockReturn, models.StockCancellation}).
+		Group("product_id").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	sold := make(map[uint]int, len(rows))
+	for _, row := range rows {
+		sold[row.ProductID] = row.Quantity
+	}
+	return sold, nil
+}
+
+// actorRef - The acting user for a ledger entry, nil for the system
+func actorRef(actorID uint) *uint {
+	if actorID == 0 {
+		return nil
+	}
+	return &actorID
+}
+
+// ReconcileStockLedger - Posts an opening balance adjustment for every product
+// whose stock differs from its ledger, such as stock set before the ledger existed
+func (h *HandlerContext) ReconcileStockLedger() (int64, error) {
+	result := h.db.Exec(`INSERT INTO stock_movements (product_id, type, quantity, balance, reason, created_at)
+		SELECT products.id, ?, products.stock - COALESCE(SUM(stock_movements.quantity), 0), products.stock, 'Opening balance', now()
+		FROM products
+		LEFT JOIN stock_movements ON stock_movements.product_id = products.id
+		GROUP BY products.id
+		HAVING products.stock <> COALESCE(SUM(stock_movements.quantity), 0)`, models.StockAdjustment)
+	return result.RowsAffected, result.Error
+}
+
+// GetStockMovements - A product's stock ledger newest first, optionally by type
+// or warehouse, with the current stock, the balance the ledger adds up to and
+// the stock at each warehouse
+func (h *HandlerContext) GetStockMovements(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		limit = 20
+	}
+	offset := (page - 1) * limit
+
+	var product models.Product
+	if err := h.db.Select("id", "name", "stock").First(&product, productID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Product not found")
+			return
+		}
+		log.Printf("Error fetching product %d: %v", productID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch stock movements")
+		return
+	}
+
+	query := h.db.Model(&models.StockMovement{}).Where("product_id = ?", productID)
+	if typeParam := r.URL.Query().Get("type"); typeParam != "" {
+		movementType := models.StockMovementType(typeParam)
+		if !movementType.Valid() {
+			respondWithError(w, http.StatusBadRequest, "Invalid movement type: "+typeParam)
+			return
+		}
+		query = query.Where("type = ?", movementType)
+	}
+	if warehouseParam := r.URL.Query().Get("warehouseId"); warehouseParam != "" {
+		warehouseID, err := strconv.ParseUint(warehouseParam, 10, 32)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid warehouse ID")
+			return
+		}
+		query = query.Where("warehouse_id = ?", warehouseID)
+	}
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		log.Printf("Error counting stock movements: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch stock movements")
+		return
+	}
+
+	var movements []models.StockMovement
+	if err := query.Order("id DESC").Offset(offset).Limit(limit).Find(&movements).Error; err != nil {
+		log.Printf("Error fetching stock movements: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch stock movements")
+		return
+	}
+
+	var ledgerBalance int64
+	if err := h.db.Model(&models.StockMovement{}).
+		Where("product_id = ?", productID).
+		Select("COALESCE(SUM(quantity), 0)").
+		Scan(&ledgerBalance).Error; err != nil {
+		log.Printf("Error summing stock movements: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch stock movements")
+		return
+	}
+
+	warehouses, err := warehouseLevels(&h.db, product.ID, 0)
+	if err != nil {
+		log.Printf("Error fetching warehouse stock of product %d: %v", productID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch stock movements")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"productId":     product.ID,
+		"stock":         product.Stock,
+		"ledgerBalance": ledgerBalance,
+		"warehouses":    warehouses,
+		"movements":     movements,
+		"totalPages":    (int(total) + limit - 1) / limit,
+		"currentPage":   page,
+		"totalItems":    total,
+	})
+}
+
+// CreateStockMovement - Posts a manual movement: a receipt or damage of a
+// positive quantity, or a signed adjustment. Adjustments and damage need a reason.
+func (h *HandlerContext) CreateStockMovement(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+	adminID, _ := strconv.ParseUint(r.URL.Query().Get("userId"), 10, 32)
+
+	var reqBody struct {
+		Type        models.StockMovementType `json:"type"`
+		Quantity    int                      `json:"quantity"`
+		Reason      string                   `json:"reason"`
+		WarehouseID *uint                    `json:"warehouseId"` // Defaults to where the units are, or the primary warehouse
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	reqBody.Reason = strings.TrimSpace(reqBody.Reason)
+
+	change := stockChange{
+		ProductID:   uint(productID),
+		WarehouseID: reqBody.WarehouseID,
+		Type:        reqBody.Type,
+		Quantity:    reqBody.Quantity,
+		Reason:      reqBody.Reason,
+		ActorID:     actorRef(uint(adminID)),
+	}
+	switch reqBody.Type {
+	case models.StockReceipt, models.StockDamage:
+		if reqBody.Quantity <= 0 {
+			respondWithError(w, http.StatusBadRequest, "Quantity must be greater than 0")
+			return
+		}
+		if reqBody.Type == models.StockDamage {
+			change.Quantity = -reqBody.Quantity
+		}
+	case models.StockAdjustment:
+		if reqBody.Quantity == 0 {
+			respondWithError(w, http.StatusBadRequest, "Adjustment quantity cannot be 0")
+			return
+		}
+	default:
+		respondWithError(w, http.StatusBadRequest, "Type must be receipt, adjustment or damage")
+		return
+	}
+	if reqBody.Type != models.StockReceipt && reqBody.Reason == "" {
+		respondWithError(w, http.StatusBadRequest, "A reason is required for "+string(reqBody.Type))
+		return
+	}
+	if reqBody.WarehouseID != nil {
+		var count int64
+		if err := h.db.Model(&models.Warehouse{}).Where("id = ?", *reqBody.WarehouseID).Count(&count).Error; err != nil {
+			log.Printf("Error fetching warehouse: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to post stock movement")
+			return
+		}
+		if count == 0 {
+			respondWithError(w, http.StatusBadRequest, "Warehouse not found")
+			return
+		}
+	}
+
+	var movement models.StockMovement
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		movement, err = moveStock(tx, change)
+		return err
+	})
+	if err != nil {
+		switch e := err.(type) {
+		case stockError:
+			respondWithError(w, http.StatusConflict, string(e))
+		default:
+			if err == gorm.ErrRecordNotFound {
+				respondWithError(w, http.StatusNotFound, "Product not found")
+				return
+			}
+			log.Printf("Error posting stock movement for product %d: %v", productID, err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to post stock movement")
+		}
+		return
+	}
+
+	respondWithJson(w, http.StatusCreated, map[string]any{
+		"message":  "Stock movement posted",
+		"movement": movement,
+	})
+}
@@ -0,0 +1,466 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"server/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Stock alert digest tuning
+const (
+	defaultStockDigestInterval = time.Hour
+	stockDigestBatch           = 200
+	// Advisory lock key so only one server sends the digest
+	stockDigestLock = 4502
+)
+
+// stockAlertView - A stock alert with the name of its product
+type stockAlertView struct {
+	models.StockAlert
+	Product string `json:"product"`
+}
+
+// stockDigestEmailData - Values available to the stock alert digest template
+type stockDigestEmailData struct {
+	StoreName string
+	Alerts    []stockAlertView
+	AlertsURL string
+}
+
+// stockDigestInterval - How often admins get the digest of new stock alerts,
+// STOCK_ALERT_DIGEST_INTERVAL takes a Go duration
+func stockDigestInterval() time.Duration {
+	return envDuration("STOCK_ALERT_DIGEST_INTERVAL", defaultStockDigestInterval)
+}
+
+// syncStockAlerts - Raises a low or out of stock alert when the product's
+// stock is at or below its reorder threshold and none is open, resolves the
+// open ones that no longer hold and tells waiting customers once units not
+// reserved for pending checkouts are back. Safe to call after any stock or threshold change.
+func syncStockAlerts(tx *gorm.DB, productID uint) error {
+	var product models.Product
+	if err := tx.First(&product, productID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		return err
+	}
+
+	var open []models.StockAlert
+	if err := tx.Where("product_id = ? AND resolved_at IS NULL", productID).Find(&open).Error; err != nil {
+		return err
+	}
+
+	raised := map[models.StockAlertType]bool{}
+	var resolved []uint
+	for _, alert := range open {
+		holds := product.Stock <= product.ReorderThreshold
+		if alert.Type == models.StockAlertOutOfStock {
+			holds = product.Stock <= 0
+		}
+		if holds {
+			raised[alert.Type] = true
+		} else {
+			resolved = append(resolved, alert.ID)
+		}
+	}
+	if len(resolved) > 0 {
+		if err := tx.Model(&models.StockAlert{}).Where("id IN ?", resolved).Update("resolved_at", time.Now()).Error; err != nil {
+			return err
+		}
+	}
+
+	// Archived products are no longer restocked or sold
+	if product.ArchivedAt != nil {
+		return nil
+	}
+
+	alert := models.StockAlert{ProductID: product.ID, Stock: product.Stock, Threshold: product.ReorderThreshold}
+	switch {
+	case product.Stock <= 0 && !raised[models.StockAlertOutOfStock]:
+		alert.Type = models.StockAlertOutOfStock
+	case product.Stock > 0 && product.Stock <= product.ReorderThreshold && !raised[models.StockAlertLow]:
+		alert.Type = models.StockAlertLow
+	}
+	if alert.Type != "" {
+		if err := tx.Create(&alert).Error; err != nil {
+			return err
+		}
+	}
+
+	// Units held for pending checkouts cannot be bought yet
+	if err := fillAvailable(tx, &product); err != nil {
+		return err
+	}
+	if product.Available > 0 {
+		return notifyStockSubscribers(tx, product)
+	}
+	return nil
+}
+
+// notifyStockSubscribers - Queues the back in stock email to everyone still
+// waiting for the product, each subscription fires once
+func notifyStockSubscribers(tx *gorm.DB, product models.Product) error {
+	var subscriptions []models.StockSubscription
+	if err := tx.Where("product_id = ? AND notified_at IS NULL", product.ID).Find(&subscriptions).Error; err != nil {
+		return err
+	}
+	if len(subscriptions) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	for _, subscription := range subscriptions {
+		data := wishlistEmailData{
+			StoreName:  envOr("SELLER_NAME", "Two Idiots Store"),
+			Product:    product.Name,
+			Price:      formatCents(toCents(product.Price)),
+			ProductURL: storeURL(fmt.Sprintf("/products/%d", product.ID)),
+		}
+		if subscription.UserID != nil {
+			var user models.User
+			if err := tx.Select("first_name").First(&user, *subscription.UserID).Error; err != nil && err != gorm.ErrRecordNotFound {
+				return err
+			}
+			data.Name = strings.TrimSpace(user.FirstName)
+		}
+
+		locale := emailLocale(subscription.Locale)
+		subject, text, html, err := renderEmail(locale, "back_in_stock", data)
+		if err != nil {
+			log.Printf("Error rendering back_in_stock email for product %d: %v", product.ID, err)
+			continue
+		}
+		if err := tx.Create(&models.EmailJob{
+			UserID:        subscription.UserID,
+			Template:      "back_in_stock",
+			Locale:        locale,
+			To:            subscription.Email,
+			Subject:       subject,
+			TextBody:      text,
+			HTMLBody:      html,
+			Status:        models.EmailPending,
+			NextAttemptAt: now,
+		}).Error; err != nil {
+			return err
+		}
+	}
+
+	ids := make([]uint, len(subscriptions))
+	for i, subscription := range subscriptions {
+		ids[i] = subscription.ID
+	}
+	return tx.Model(&models.StockSubscription{}).Where("id IN ?", ids).Update("notified_at", now).Error
+}
+
+// SubscribeToStock - Asks to be emailed once an out of stock product can be
+// bought again. Signed in customers pass userId, guests give an email.
+func (h *HandlerContext) SubscribeToStock(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	var reqBody struct {
+		Email  string `json:"email"`
+		Locale string `json:"locale"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	subscription := models.StockSubscription{
+		ProductID: uint(productID),
+		Email:     strings.ToLower(strings.TrimSpace(reqBody.Email)),
+		Locale:    emailLocale(reqBody.Locale),
+	}
+	if userIDStr := r.URL.Query().Get("userId"); userIDStr != "" {
+		userID, err := strconv.ParseUint(userIDStr, 10, 32)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid userId")
+			return
+		}
+		var user models.User
+		if err := h.db.First(&user, userID).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				respondWithError(w, http.StatusNotFound, "User not found")
+			} else {
+				log.Printf("Error fetching user %d: %v", userID, err)
+				respondWithError(w, http.StatusInternalServerError, "Failed to subscribe")
+			}
+			return
+		}
+		subscription.UserID = &user.ID
+		subscription.Email = strings.ToLower(user.Email)
+		subscription.Locale = emailLocale(user.Locale)
+	}
+	if _, err := mail.ParseAddress(subscription.Email); err != nil || subscription.Email == "" {
+		respondWithError(w, http.StatusBadRequest, "A valid email is required")
+		return
+	}
+
+	var product models.Product
+	if err := h.db.First(&product, productID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Product not found")
+		} else {
+			log.Printf("Error fetching product %d: %v", productID, err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to subscribe")
+		}
+		return
+	}
+	if product.ArchivedAt != nil {
+		respondWithError(w, http.StatusNotFound, "Product not found")
+		return
+	}
+	if err := fillAvailable(&h.db, &product); err != nil {
+		log.Printf("Error fetching stock of product %d: %v", productID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to subscribe")
+		return
+	}
+	if product.Available > 0 {
+		respondWithError(w, http.StatusConflict, "Product is in stock")
+		return
+	}
+
+	// Subscribing again after a notification waits for the next restock
+	if err := h.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "product_id"}, {Name: "email"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"user_id":     subscription.UserID,
+			"locale":      subscription.Locale,
+			"notified_at": nil,
+		}),
+	}).Create(&subscription).Error; err != nil {
+		log.Printf("Error subscribing to product %d: %v", productID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to subscribe")
+		return
+	}
+
+	respondWithJson(w, http.StatusCreated, map[string]any{
+		"message": "We will email you when it is back in stock",
+	})
+}
+
+// RunStockAlertWorker - Emails admins a digest of new stock alerts until the
+// process exits, run it in its own goroutine
+func (h *HandlerContext) RunStockAlertWorker() {
+	ticker := time.NewTicker(stockDigestInterval())
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Keep going while full batches come back
+		for {
+			sent, err := h.sendStockDigest()
+			if err != nil {
+				log.Printf("Error sending stock alert digest: %v", err)
+			}
+			if err != nil || sent < stockDigestBatch {
+				break
+			}
+		}
+	}
+}
+
+// stockDigestRecipients - Addresses and locales the digest goes to,
+// STOCK_ALERT_EMAILS takes a comma separated list, otherwise every admin
+func stockDigestRecipients(tx *gorm.DB) (map[string]string, error) {
+	recipients := map[string]string{}
+	if list := envOr("STOCK_ALERT_EMAILS", ""); list != "" {
+		for _, email := range strings.Split(list, ",") {
+			if email = strings.TrimSpace(email); email != "" {
+				recipients[email] = defaultLocale
+			}
+		}
+		return recipients, nil
+	}
+
+	var admins []models.User
+	if err := tx.Select("email", "locale").Where("role = ?", models.RoleAdmin).Find(&admins).Error; err != nil {
+		return nil, err
+	}
+	for _, admin := range admins {
+		if admin.Email != "" {
+			recipients[admin.Email] = emailLocale(admin.Locale)
+		}
+	}
+	return recipients, nil
+}
+
+// sendStockDigest - Queues one digest of stock alerts not sent yet to each
+// recipient, returns how many alerts it covered
+func (h *HandlerContext) sendStockDigest() (int, error) {
+	var alerts []stockAlertView
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var locked bool
+		if err := tx.Raw("SELECT pg_try_advisory_xact_lock(?)", stockDigestLock).Scan(&locked).Error; err != nil || !locked {
+			return err
+		}
+
+		if err := tx.Table("stock_alerts").
+			Select("stock_alerts.*, COALESCE(products.name, '') AS product").
+			Joins("LEFT JOIN products ON products.id = stock_alerts.product_id").
+			Where("stock_alerts.digested_at IS NULL").
+			Order("stock_alerts.id").
+			Limit(stockDigestBatch).
+			Scan(&alerts).Error; err != nil {
+			return err
+		}
+		if len(alerts) == 0 {
+			return nil
+		}
+
+		recipients, err := stockDigestRecipients(tx)
+		if err != nil {
+			return err
+		}
+		data := stockDigestEmailData{
+			StoreName: envOr("SELLER_NAME", "Two Idiots Store"),
+			Alerts:    alerts,
+			AlertsURL: storeURL("/admin/products"),
+		}
+		now := time.Now()
+		for email, locale := range recipients {
+			subject, text, html, err := renderEmail(locale, "stock_alert_digest", data)
+			if err != nil {
+				log.Printf("Error rendering stock_alert_digest email: %v", err)
+				continue
+			}
+			if err := tx.Create(&models.EmailJob{
+				Template:      "stock_alert_digest",
+				Locale:        locale,
+				To:            email,
+				Subject:       subject,
+				TextBody:      text,
+				HTMLBody:      html,
+				Status:        models.EmailPending,
+				NextAttemptAt: now,
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		ids := make([]uint, len(alerts))
+		for i, alert := range alerts {
+			ids[i] = alert.ID
+		}
+		return tx.Model(&models.StockAlert{}).Where("id IN ?", ids).Update("digested_at", now).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(alerts), nil
+}
+
+// GetStockAlerts - Stock alert feed newest first, by state and type
+func (h *HandlerContext) GetStockAlerts(w http.ResponseWriter, r *http.Request) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		limit = 20
+	}
+	offset := (page - 1) * limit
+
+	query := h.db.Table("stock_alerts")
+	switch r.URL.Query().Get("state") {
+	case "":
+	case "open":
+		query = query.Where("stock_alerts.resolved_at IS NULL")
+	case "unacknowledged":
+		query = query.Where("stock_alerts.resolved_at IS NULL AND stock_alerts.acknowledged_at IS NULL")
+	case "resolved":
+		query = query.Where("stock_alerts.resolved_at IS NOT NULL")
+	default:
+		respondWithError(w, http.StatusBadRequest, "Invalid state, expected open, unacknowledged or resolved")
+		return
+	}
+	switch alertType := models.StockAlertType(r.URL.Query().Get("type")); alertType {
+	case "":
+	case models.StockAlertLow, models.StockAlertOutOfStock:
+		query = query.Where("stock_alerts.type = ?", alertType)
+	default:
+		respondWithError(w, http.StatusBadRequest, "Invalid type, expected low_stock or out_of_stock")
+		return
+	}
+
+	var total int64
+	if err := query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		log.Printf("Error counting stock alerts: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch stock alerts")
+		return
+	}
+
+	alerts := []stockAlertView{}
+	if err := query.
+		Select("stock_alerts.*, COALESCE(products.name, '') AS product").
+		Joins("LEFT JOIN products ON products.id = stock_alerts.product_id").
+		Order("stock_alerts.id DESC").
+		Offset(offset).Limit(limit).
+		Scan(&alerts).Error; err != nil {
+		log.Printf("Error fetching stock alerts: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch stock alerts")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"alerts":      alerts,
+		"totalPages":  (int(total) + limit - 1) / limit,
+		"currentPage": page,
+		"totalItems":  total,
+	})
+}
+
+// AcknowledgeStockAlert - Marks an alert as seen, it stays open until stock recovers
+func (h *HandlerContext) AcknowledgeStockAlert(w http.ResponseWriter, r *http.Request) {
+	alertID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid alert ID")
+		return
+	}
+	adminID, _ := strconv.ParseUint(r.URL.Query().Get("userId"), 10, 32)
+
+	var alert models.StockAlert
+	if err := h.db.First(&alert, alertID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Stock alert not found")
+		} else {
+			log.Printf("Error fetching stock alert %d: %v", alertID, err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to acknowledge stock alert")
+		}
+		return
+	}
+
+	if alert.AcknowledgedAt == nil {
+		now := time.Now()
+		alert.AcknowledgedAt = &now
+		alert.AcknowledgedByID = actorRef(uint(adminID))
+		if err := h.db.Model(&alert).Updates(map[string]any{
+			"acknowledged_at":    alert.AcknowledgedAt,
+			"acknowledged_by_id": alert.AcknowledgedByID,
+		}).Error; err != nil {
+			log.Printf("Error acknowledging stock alert %d: %v", alertID, err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to acknowledge stock alert")
+			return
+		}
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message": "Stock alert acknowledged",
+		"alert":   alert,
+	})
+}
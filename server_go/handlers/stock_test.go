@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"server/models"
+	"testing"
+)
+
+func TestStockDelta(t *testing.T) {
+	tests := []struct {
+		name             string
+		change           stockChange
+		wantDelta        int
+		wantKeepReserved bool
+	}{
+		{"receipt", stockChange{Type: models.StockReceipt, Quantity: 10}, 10, false},
+		{"return", stockChange{Type: models.StockReturn, Quantity: 2}, 2, false},
+		{"sale draws on reserved units", stockChange{Type: models.StockSale, Quantity: -3}, -3, false},
+		{"damage leaves reserved units", stockChange{Type: models.StockDamage, Quantity: -1}, -1, true},
+		{"adjustment down leaves reserved units", stockChange{Type: models.StockAdjustment, Quantity: -4}, -4, true},
+		{"adjustment up", stockChange{Type: models.StockAdjustment, Quantity: 4}, 4, false},
+		{"transfer out", stockChange{Type: models.StockTransfer, Quantity: -5}, 0, false},
+		{"transfer in", stockChange{Type: models.StockTransfer, Quantity: 5}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delta, keepReserved := tt.change.stockDelta()
+			if delta != tt.wantDelta || keepReserved != tt.wantKeepReserved {
+				t.Fatalf("stockDelta() = %d, %v, want %d, %v", delta, keepReserved, tt.wantDelta, tt.wantKeepReserved)
+			}
+		})
+	}
+}
+
+func TestActorRef(t *testing.T) {
+	if got := actorRef(0); got != nil {
+		t.Fatalf("actorRef(0) = %v, want nil", *got)
+	}
+	if got := actorRef(7); got == nil || *got != 7 {
+		t.Fatalf("actorRef(7) = %v, want 7", got)
+	}
+}
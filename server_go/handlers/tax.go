@@ -0,0 +1,372 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"server/models"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// Rate used when no tax rule matches the destination
+const defaultTaxRate = 0.08
+
+// taxableLine - A cart line that tax is calculated on
+type taxableLine struct {
+	ProductID  uint
+	CategoryID uint
+	Quantity   int
+	UnitPrice  int64 // In cents
+	Amount     int64 // Line amount in cents
+}
+
+// TaxLineQuote - Tax calculated for a single line
+type TaxLineQuote struct {
+	ProductID uint    `json:"productId"`
+	RuleID    *uint   `json:"ruleId,omitempty"`
+	Rate      float64 `json:"rate"`
+	Inclusive bool    `json:"inclusive"`
+	Tax       int64   `json:"tax"`
+}
+
+// TaxQuote - Tax calculated for a cart, all amounts in cents
+type TaxQuote struct {
+	Lines       []TaxLineQuote `json:"lines"`
+	ShippingTax int64          `json:"shippingTax"`
+	Total       int64          `json:"total"` // All tax, including tax already inside prices
+	Added       int64          `json:"added"` // Tax added on top of prices
+}
+
+type taxRuleRequest struct {
+	Name         string  `json:"name"`
+	Country      string  `json:"country"`
+	State        string  `json:"state"`
+	PostalPrefix string  `json:"postalPrefix"`
+	CategoryID   *uint   `json:"categoryId"`
+	Rate         float64 `json:"rate"`
+	Inclusive    bool    `json:"inclusive"`
+	Priority     int     `json:"priority"`
+	Active       *bool   `json:"active"`
+}
+
+// toCents - Converts a decimal price to cents
+func toCents(price float64) int64 {
+	return int64(math.Round(price * 100))
+}
+
+// cartTaxableLines - Builds taxable lines from cart items with preloaded products
+func cartTaxableLines(cartItems []models.Cart) []taxableLine {
+	lines := make([]taxableLine, 0, len(cartItems))
+	for _, item := range cartItems {
+		unitPrice := toCents(item.Product.Price)
+		lines = append(lines, taxableLine{
+			ProductID:  item.ProductID,
+			CategoryID: item.Product.CategoryID,
+			Quantity:   item.Quantity,
+			UnitPrice:  unitPrice,
+			Amount:     unitPrice * int64(item.Quantity),
+		})
+	}
+	return lines
+}
+
+// taxRuleMatches - Reports whether a rule applies to the address and category
+func taxRuleMatches(rule models.TaxRule, address CheckoutAddress, categoryID uint) bool {
+	if !address.matches(rule.Country, rule.State, rule.PostalPrefix) {
+		return false
+	}
+	if rule.CategoryID != nil && *rule.CategoryID != categoryID {
+		return false
+	}
+	return true
+}
+
+// taxRuleSpecificity - Ranks rules so the narrowest match wins
+func taxRuleSpecificity(rule models.TaxRule) int {
+	score := areaSpecificity(rule.Country, rule.State, rule.PostalPrefix)
+	if rule.CategoryID != nil {
+		score += 1000
+	}
+	return score
+}
+
+// matchTaxRule - Finds the most specific rule for the address and category.
+// A category ID of 0 only matches rules that are not category scoped.
+func matchTaxRule(rules []models.TaxRule, address CheckoutAddress, categoryID uint) *models.TaxRule {
+	var best *models.TaxRule
+	for i := range rules {
+		rule := rules[i]
+		if !taxRuleMatches(rule, address, categoryID) {
+			continue
+		}
+		if best == nil {
+			best = &rules[i]
+			continue
+		}
+		score, bestScore := taxRuleSpecificity(rule), taxRuleSpecificity(*best)
+		if score > bestScore || (score == bestScore && rule.Priority > best.Priority) {
+			best = &rules[i]
+		}
+	}
+	return best
+}
+
+// taxForAmount - Tax contained in or added to an amount for the given rule
+func taxForAmount(amount int64, rate float64, inclusive bool) int64 {
+	if rate <= 0 {
+		return 0
+	}
+	if inclusive {
+		return amount - int64(math.Round(float64(amount)/(1+rate)))
+	}
+	return int64(math.Round(float64(amount) * rate))
+}
+
+// applyTaxRules - Calculates tax for the lines and shipping shipped to the address
+func applyTaxRules(rules []models.TaxRule, lines []taxableLine, shipping int64, address CheckoutAddress) TaxQuote {
+	quote := TaxQuote{Lines: make([]TaxLineQuote, 0, len(lines))}
+
+	for _, line := range lines {
+		lineQuote := TaxLineQuote{ProductID: line.ProductID, Rate: defaultTaxRate}
+		if rule := matchTaxRule(rules, address, line.CategoryID); rule != nil {
+			ruleID := rule.ID
+			lineQuote.RuleID = &ruleID
+			lineQuote.Rate = rule.Rate
+			lineQuote.Inclusive = rule.Inclusive
+		}
+		lineQuote.Tax = taxForAmount(line.Amount, lineQuote.Rate, lineQuote.Inclusive)
+
+		quote.Total += lineQuote.Tax
+		if !lineQuote.Inclusive {
+			quote.Added += lineQuote.Tax
+		}
+		quote.Lines = append(quote.Lines, lineQuote)
+	}
+
+	// Shipping is taxed at the destination rate, never inclusive
+	if shipping > 0 {
+		rate := defaultTaxRate
+		if rule := matchTaxRule(rules, address, 0); rule != nil {
+			rate = rule.Rate
+		}
+		quote.ShippingTax = taxForAmount(shipping, rate, false)
+		quote.Total += quote.ShippingTax
+		quote.Added += quote.ShippingTax
+	}
+
+	return quote
+}
+
+// calculateTax - Loads the active tax rules and applies them
+func (h *HandlerContext) calculateTax(lines []taxableLine, shipping int64, address CheckoutAddress) (TaxQuote, error) {
+	var rules []models.TaxRule
+	if err := h.db.Where("active = ?", true).Find(&rules).Error; err != nil {
+		return TaxQuote{}, err
+	}
+	return applyTaxRules(rules, lines, shipping, address), nil
+}
+
+// GetTaxQuote - Calculates the tax for the user's or guest's cart shipped to an address
+func (h *HandlerContext) GetTaxQuote(w http.ResponseWriter, r *http.Request) {
+	owner, ok := h.resolveCartOwner(w, r, false)
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		Address          CheckoutAddress `json:"address"`
+		ShippingMethodID uint            `json:"shippingMethodId"`
+		CouponCode       string          `json:"couponCode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if reqBody.Address.Country == "" {
+		respondWithError(w, http.StatusBadRequest, "Country is required")
+		return
+	}
+
+	var cartItems []models.Cart
+	if err := owner.scope(h.db.Preload("Product")).Find(&cartItems).Error; err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch cart items")
+		return
+	}
+
+	if len(cartItems) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Cart is empty")
+		return
+	}
+
+	pricing, err := h.priceCart(owner.UserID, cartItems, reqBody.Address, reqBody.ShippingMethodID, reqBody.CouponCode)
+	if err != nil {
+		if msg, ok := err.(checkoutError); ok {
+			respondWithError(w, http.StatusBadRequest, string(msg))
+		} else {
+			log.Printf("Error calculating tax: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to calculate tax")
+		}
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message":  "Tax quote calculated successfully",
+		"subtotal": pricing.Subtotal,
+		"discount": pricing.Discount.Total,
+		"shipping": pricing.Shipping.Cost,
+		"tax":      pricing.Tax,
+		"total":    pricing.Total,
+	})
+}
+
+// GetTaxRules - Lists all tax rules
+func (h *HandlerContext) GetTaxRules(w http.ResponseWriter, r *http.Request) {
+	var rules []models.TaxRule
+	if err := h.db.Preload("Category").Order("country, state, postal_prefix, id").Find(&rules).Error; err != nil {
+		log.Printf("Error fetching tax rules: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch tax rules")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"taxRules": rules,
+	})
+}
+
+// validateTaxRule - Checks a tax rule request, returns an error message if invalid
+func (h *HandlerContext) validateTaxRule(req taxRuleRequest) string {
+	if req.Name == "" {
+		return "Name is required"
+	}
+	if req.Rate < 0 || req.Rate >= 1 {
+		return "Rate must be between 0 and 1"
+	}
+	if req.CategoryID != nil {
+		var category models.Category
+		if err := h.db.First(&category, *req.CategoryID).Error; err != nil {
+			return "Category not found"
+		}
+	}
+	return ""
+}
+
+// CreateTaxRule - Creates a tax rule
+func (h *HandlerContext) CreateTaxRule(w http.ResponseWriter, r *http.Request) {
+	var req taxRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if msg := h.validateTaxRule(req); msg != "" {
+		respondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	rule := models.TaxRule{
+		Name:         req.Name,
+		Country:      req.Country,
+		State:        req.State,
+		PostalPrefix: req.PostalPrefix,
+		CategoryID:   req.CategoryID,
+		Rate:         req.Rate,
+		Inclusive:    req.Inclusive,
+		Priority:     req.Priority,
+		Active:       req.Active == nil || *req.Active,
+	}
+	if err := h.db.Create(&rule).Error; err != nil {
+		log.Printf("Error creating tax rule: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create tax rule")
+		return
+	}
+
+	respondWithJson(w, http.StatusCreated, map[string]any{
+		"message": "Tax rule created successfully",
+		"taxRule": rule,
+	})
+}
+
+// UpdateTaxRule - Updates a tax rule
+func (h *HandlerContext) UpdateTaxRule(w http.ResponseWriter, r *http.Request) {
+	ruleIDStr := chi.URLParam(r, "id")
+	ruleID, err := strconv.ParseUint(ruleIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tax rule ID")
+		return
+	}
+
+	var req taxRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if msg := h.validateTaxRule(req); msg != "" {
+		respondWithError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	var rule models.TaxRule
+	if err := h.db.First(&rule, ruleID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Tax rule not found")
+		} else {
+			log.Printf("Error fetching tax rule: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Error fetching tax rule")
+		}
+		return
+	}
+
+	rule.Name = req.Name
+	rule.Country = req.Country
+	rule.State = req.State
+	rule.PostalPrefix = req.PostalPrefix
+	rule.CategoryID = req.CategoryID
+	rule.Rate = req.Rate
+	rule.Inclusive = req.Inclusive
+	rule.Priority = req.Priority
+	if req.Active != nil {
+		rule.Active = *req.Active
+	}
+
+	if err := h.db.Save(&rule).Error; err != nil {
+		log.Printf("Error updating tax rule: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to update tax rule")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message": "Tax rule updated successfully",
+		"taxRule": rule,
+	})
+}
+
+// DeleteTaxRule - Deletes a tax rule
+func (h *HandlerContext) DeleteTaxRule(w http.ResponseWriter, r *http.Request) {
+	ruleIDStr := chi.URLParam(r, "id")
+	ruleID, err := strconv.ParseUint(ruleIDStr, 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tax rule ID")
+		return
+	}
+
+	result := h.db.Delete(&models.TaxRule{}, ruleID)
+	if result.Error != nil {
+		log.Printf("Error deleting tax rule: %v", result.Error)
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete tax rule")
+		return
+	}
+	if result.RowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "Tax rule not found")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]string{
+		"message": "Tax rule deleted successfully",
+	})
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"server/models"
+	"testing"
+)
+
+func TestMatchTaxRule(t *testing.T) {
+	books := uint(7)
+	rules := []models.TaxRule{
+		{ID: 1, Country: "US"},
+		{ID: 2, Country: "US", State: "CA"},
+		{ID: 3, Country: "US", State: "CA", PostalPrefix: "941"},
+		{ID: 4, Country: "US", CategoryID: &books},
+		{ID: 5, Country: "DE", Priority: 1},
+		{ID: 6, Country: "DE", Priority: 5},
+	}
+
+	tests := []struct {
+		name       string
+		address    CheckoutAddress
+		categoryID uint
+		want       uint // 0 when no rule matches
+	}{
+		{"country only", CheckoutAddress{Country: "US", State: "NY", PostalCode: "10001"}, 0, 1},
+		{"state beats country", CheckoutAddress{Country: "US", State: "CA", PostalCode: "90001"}, 0, 2},
+		{"postal prefix beats state", CheckoutAddress{Country: "US", State: "CA", PostalCode: "94105"}, 0, 3},
+		{"category beats postal prefix", CheckoutAddress{Country: "US", State: "CA", PostalCode: "94105"}, books, 4},
+		{"other category falls back to area", CheckoutAddress{Country: "US", State: "CA", PostalCode: "94105"}, 8, 3},
+		{"case and spaces are ignored", CheckoutAddress{Country: " us ", State: "ca", PostalCode: "94 105"}, 0, 3},
+		{"priority breaks ties", CheckoutAddress{Country: "DE"}, 0, 6},
+		{"no match", CheckoutAddress{Country: "FR"}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := matchTaxRule(rules, tt.address, tt.categoryID)
+			switch {
+			case got == nil && tt.want != 0:
+				t.Fatalf("got no rule, want rule %d", tt.want)
+			case got != nil && got.ID != tt.want:
+				t.Fatalf("got rule %d, want %d", got.ID, tt.want)
+			}
+		})
+	}
+}
+
+func TestTaxForAmount(t *testing.T) {
+	tests := []struct {
+		name      string
+		amount    int64
+		rate      float64
+		inclusive bool
+		want      int64
+	}{
+		{"added", 10000, 0.0825, false, 825},
+		{"added rounds half up", 1000, 0.0725, false, 73},
+		{"included", 11900, 0.19, true, 1900},
+		{"included rounds", 999, 0.2, true, 166},
+		{"exempt", 10000, 0, false, 0},
+		{"exempt included", 10000, 0, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := taxForAmount(tt.amount, tt.rate, tt.inclusive); got != tt.want {
+				t.Fatalf("taxForAmount(%d, %v, %v) = %d, want %d", tt.amount, tt.rate, tt.inclusive, got, tt.want)
+			}
+		})
+	}
+}
@@ -24,6 +24,7 @@ type SignupRequest struct {
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
 	Phone     string `json:"phone"`
+	Locale    string `json:"locale"` // Optional, e.g. "en" or "vi"
 }
 
 // SigninRequest for user login
@@ -66,6 +67,7 @@ func (h *HandlerContext) Signup(w http.ResponseWriter, r *http.Request) {
 		FirstName:    req.FirstName,
 		LastName:     req.LastName,
 		Phone:        req.Phone,
+		Locale:       emailLocale(req.Locale),
 		Role:         models.RoleUser, // Default role: user
 	}
 
@@ -81,7 +83,7 @@ func (h *HandlerContext) Signup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respondWithJson(w, http.StatusCreated, map[string]any{
+	response := map[string]any{
 		"message": "User created successfully",
 		"user": map[string]any{
 			"id":        user.ID,
@@ -90,9 +92,16 @@ func (h *HandlerContext) Signup(w http.ResponseWriter, r *http.Request) {
 			"lastName":  user.LastName,
 			"role":      user.Role,
 			"phone":     user.Phone,
+			"locale":    user.Locale,
 		},
 		"token": token,
-	})
+	}
+	// Anything picked as a guest carries over, guest orders are claimed
+	// one at a time through their lookup links
+	if report := h.mergeGuestCartOnSignin(w, r, user.ID); report != nil {
+		response["cart"] = report
+	}
+	respondWithJson(w, http.StatusCreated, response)
 }
 
 // Signin - Authenticate a user
@@ -127,7 +136,7 @@ func (h *HandlerContext) Signin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	respondWithJson(w, http.StatusOK, map[string]interface{}{
+	response := map[string]interface{}{
 		"message": "Signed in successfully",
 		"user": map[string]interface{}{
 			"id":        user.ID,
@@ -138,7 +147,13 @@ func (h *HandlerContext) Signin(w http.ResponseWriter, r *http.Request) {
 			"phone":     user.Phone,
 		},
 		"token": token,
-	})
+	}
+	// Anything picked as a guest carries over, guest orders are claimed
+	// one at a time through their lookup links
+	if report := h.mergeGuestCartOnSignin(w, r, user.ID); report != nil {
+		response["cart"] = report
+	}
+	respondWithJson(w, http.StatusOK, response)
 }
 
 // AuthMiddleware - Validate JWT and attach user ID and role to context
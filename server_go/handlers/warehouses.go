@@ -0,0 +1,556 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"server/models"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Ways checkout can pick the warehouses an order ships from, set with
+// WAREHOUSE_ALLOCATION
+const (
+	allocatePriority = "priority" // Highest priority first
+	allocateNearest  = "nearest"  // Same state, then same country, then by priority
+)
+
+// Code of the warehouse created for stock that predates warehouses
+const defaultWarehouseCode = "MAIN"
+
+type warehouseRequest struct {
+	Code     string `json:"code"`
+	Name     string `json:"name"`
+	Country  string `json:"country"`
+	State    string `json:"state"`
+	Priority int    `json:"priority"`
+	Active   *bool  `json:"active"`
+}
+
+// warehouseAllocation - Units of an order line taken from one warehouse
+type warehouseAllocation struct {
+	WarehouseID uint
+	Quantity    int
+}
+
+// warehouseLevel - A product's stock at one warehouse
+type warehouseLevel struct {
+	WarehouseID uint   `json:"warehouseId"`
+	Code        string `json:"code"`
+	Name        string `json:"name"`
+	ProductID   uint   `json:"productId"`
+	Product     string `json:"product"`
+	Quantity    int    `json:"quantity"`
+	Reserved    int    `json:"reserved"`  // Held by pending checkouts
+	Available   int    `json:"available"` // Quantity not reserved
+}
+
+// primaryWarehouse - Active warehouse that takes stock when none is named,
+// gorm.ErrRecordNotFound when there are no warehouses
+func primaryWarehouse(tx *gorm.DB) (models.Warehouse, error) {
+	var warehouse models.Warehouse
+	err := tx.Where("active = ?", true).Order("priority DESC, id").First(&warehouse).Error
+	return warehouse, err
+}
+
+// moveWarehouseStock - Changes a product's level at a warehouse, removals
+// fail with a stockError when the warehouse has too few units
+func moveWarehouseStock(tx *gorm.DB, warehouseID, productID uint, quantity int) error {
+	if quantity >= 0 {
+		return tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "warehouse_id"}, {Name: "product_id"}},
+			DoUpdates: clause.Assignments(map[string]any{
+				"quantity":   gorm.Expr("warehouse_stocks.quantity + ?", quantity),
+				"updated_at": time.Now(),
+			}),
+		}).Create(&models.WarehouseStock{
+			WarehouseID: warehouseID,
+			ProductID:   productID,
+			Quantity:    quantity,
+		}).Error
+	}
+
+	result := tx.Model(&models.WarehouseStock{}).
+		Where("warehouse_id = ? AND product_id = ? AND quantity >= ?", warehouseID, productID, -quantity).
+		Updates(map[string]any{"quantity": gorm.Expr("quantity + ?", quantity), "updated_at": time.Now()})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return stockError("Not enough stock at the warehouse")
+	}
+	return nil
+}
+
+// warehouseLevels - Stock, reservations and availability per warehouse,
+// limited to one product or one warehouse when their ID is not 0
+func warehouseLevels(db *gorm.DB, productID, warehouseID uint) ([]warehouseLevel, error) {
+	query := db.Model(&models.WarehouseStock{}).
+		Select(`warehouse_stocks.warehouse_id, warehouses.code, warehouses.name,
+			warehouse_stocks.product_id, products.name AS product, warehouse_stocks.quantity,
+			COALESCE((SELECT SUM(stock_reservations.quantity) FROM stock_reservations
+				WHERE stock_reservations.warehouse_id = warehouse_stocks.warehouse_id
+				AND stock_reservations.product_id = warehouse_stocks.product_id
+				AND stock_reservations.status = ?), 0) AS reserved`, models.ReservationActive).
+		Joins("JOIN warehouses ON warehouses.id = warehouse_stocks.warehouse_id").
+		Joins("LEFT JOIN products ON products.id = warehouse_stocks.product_id").
+		Order("warehouses.priority DESC, warehouses.id, warehouse_stocks.product_id")
+	if productID != 0 {
+		query = query.Where("warehouse_stocks.product_id = ?", productID)
+	}
+	if warehouseID != 0 {
+		query = query.Where("warehouse_stocks.warehouse_id = ?", warehouseID)
+	}
+
+	levels := []warehouseLevel{}
+	if err := query.Scan(&levels).Error; err != nil {
+		return nil, err
+	}
+	for i := range levels {
+		levels[i].Available = max(levels[i].Quantity-levels[i].Reserved, 0)
+	}
+	return levels, nil
+}
+
+// rankWarehouses - Orders warehouses by the allocation rule for an address
+func rankWarehouses(warehouses []models.Warehouse, country, state string) {
+	nearest := strings.EqualFold(envOr("WAREHOUSE_ALLOCATION", allocatePriority), allocateNearest)
+	closeness := func(warehouse models.Warehouse) int {
+		if !nearest || warehouse.Country == "" || !strings.EqualFold(warehouse.Country, strings.TrimSpace(country)) {
+			return 0
+		}
+		if warehouse.State != "" && strings.EqualFold(warehouse.State, strings.TrimSpace(state)) {
+			return 2
+		}
+		return 1
+	}
+
+	sort.SliceStable(warehouses, func(i, j int) bool {
+		if ci, cj := closeness(warehouses[i]), closeness(warehouses[j]); ci != cj {
+			return ci > cj
+		}
+		if warehouses[i].Priority != warehouses[j].Priority {
+			return warehouses[i].Priority > warehouses[j].Priority
+		}
+		return warehouses[i].ID < warehouses[j].ID
+	})
+}
+
+// allocateStock - Picks the warehouses an order line ships from, preferring
+// the best ranked one that can send it whole and splitting across warehouses
+// otherwise. Returns nothing when there are no warehouses, and a checkoutError
+// when they hold too few units between them.
+func allocateStock(tx *gorm.DB, item models.OrderItem, country, state string) ([]warehouseAllocation, error) {
+	var warehouses []models.Warehouse
+	if err := tx.Where("active = ?", true).Find(&warehouses).Error; err != nil {
+		return nil, err
+	}
+	if len(warehouses) == 0 {
+		return nil, nil
+	}
+	rankWarehouses(warehouses, country, state)
+
+	levels, err := warehouseLevels(tx, item.ProductID, 0)
+	if err != nil {
+		return nil, err
+	}
+	available := make(map[uint]int, len(levels))
+	for _, level := range levels {
+		available[level.WarehouseID] = level.Available
+	}
+
+	candidates := make([]warehouseAllocation, len(warehouses))
+	for i, warehouse := range warehouses {
+		candidates[i] = warehouseAllocation{WarehouseID: warehouse.ID, Quantity: available[warehouse.ID]}
+	}
+	if allocations := splitStock(candidates, item.Quantity); allocations != nil {
+		return allocations, nil
+	}
+	return nil, checkoutError("Insufficient stock for " + item.Name)
+}
+
+// drawStock - Warehouses a removal with no warehouse named takes its units
+// from: one that holds them all, else by priority. Reserved units stay put
+// when keepReserved is set. Nil without warehouses or when they hold too few
+// units, the primary warehouse then answers for the removal.
+func drawStock(tx *gorm.DB, productID uint, quantity int, keepReserved bool) ([]warehouseAllocation, error) {
+	levels, err := warehouseLevels(tx, productID, 0)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]warehouseAllocation, len(levels))
+	for i, level := range levels {
+		candidates[i] = warehouseAllocation{WarehouseID: level.WarehouseID, Quantity: level.Quantity}
+		if keepReserved {
+			candidates[i].Quantity = level.Available
+		}
+	}
+	return splitStock(candidates, quantity), nil
+}
+
+// splitStock - Takes quantity units from the warehouses holding the units
+// given, in order: the first that holds them all, else as many as each holds
+// until enough. Nil when they hold too few units between them.
+func splitStock(candidates []warehouseAllocation, quantity int) []warehouseAllocation {
+	for _, candidate := range candidates {
+		if candidate.Quantity >= quantity {
+			return []warehouseAllocation{{WarehouseID: candidate.WarehouseID, Quantity: quantity}}
+		}
+	}
+
+	var allocations []warehouseAllocation
+	remaining := quantity
+	for _, candidate := range candidates {
+		if take := min(candidate.Quantity, remaining); take > 0 {
+			allocations = append(allocations, warehouseAllocation{WarehouseID: candidate.WarehouseID, Quantity: take})
+			remaining -= take
+		}
+		if remaining == 0 {
+			return allocations
+		}
+	}
+	return nil
+}
+
+// saleWarehouse - Warehouse an order's units of a product were sold from, nil
+// when the sale predates warehouses
+func saleWarehouse(tx *gorm.DB, orderID, productID uint) (*uint, error) {
+	var warehouseIDs []uint
+	if err := tx.Model(&models.StockMovement{}).
+		Where("order_id = ? AND product_id = ? AND type = ? AND warehouse_id IS NOT NULL", orderID, productID, models.StockSale).
+		Order("id DESC").
+		Limit(1).
+		Pluck("warehouse_id", &warehouseIDs).Error; err != nil {
+		return nil, err
+	}
+	if len(warehouseIDs) == 0 {
+		return nil, nil
+	}
+	return &warehouseIDs[0], nil
+}
+
+// shipmentWarehouse - Warehouse most of an order's units were sold from, the
+// primary warehouse for orders sold before warehouses, nil without warehouses
+func shipmentWarehouse(tx *gorm.DB, orderID uint) (*uint, error) {
+	var warehouseIDs []uint
+	if err := tx.Model(&models.StockMovement{}).
+		Where("order_id = ? AND type = ? AND warehouse_id IS NOT NULL", orderID, models.StockSale).
+		Group("warehouse_id").
+		Order("SUM(-quantity) DESC, warehouse_id").
+		Limit(1).
+		Pluck("warehouse_id", &warehouseIDs).Error; err != nil {
+		return nil, err
+	}
+	if len(warehouseIDs) > 0 {
+		return &warehouseIDs[0], nil
+	}
+
+	warehouse, err := primaryWarehouse(tx)
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &warehouse.ID, nil
+}
+
+// AssignUnplacedStock - Creates the default warehouse when there are none and
+// moves stock not held at any warehouse, such as stock from before
+// warehouses, into the primary one with transfer movements
+func (h *HandlerContext) AssignUnplacedStock() (int, error) {
+	assigned := 0
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.Warehouse{}).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			if err := tx.Create(&models.Warehouse{Code: defaultWarehouseCode, Name: "Main warehouse", Active: true}).Error; err != nil {
+				return err
+			}
+		}
+		warehouse, err := primaryWarehouse(tx)
+		if err != nil {
+			return err
+		}
+
+		var unplaced []struct {
+			ProductID uint
+			Stock     int
+			Quantity  int
+		}
+		if err := tx.Model(&models.Product{}).
+			Select("products.id AS product_id, products.stock, products.stock - COALESCE(SUM(warehouse_stocks.quantity), 0) AS quantity").
+			Joins("LEFT JOIN warehouse_stocks ON warehouse_stocks.product_id = products.id").
+			Group("products.id").
+			Having("products.stock > COALESCE(SUM(warehouse_stocks.quantity), 0)").
+			Scan(&unplaced).Error; err != nil {
+			return err
+		}
+
+		reason := "Placed in warehouse " + warehouse.Code
+		for _, row := range unplaced {
+			movements := []models.StockMovement{
+				{ProductID: row.ProductID, Type: models.StockTransfer, Quantity: -row.Quantity, Balance: row.Stock, Reason: reason},
+				{ProductID: row.ProductID, WarehouseID: &warehouse.ID, Type: models.StockTransfer, Quantity: row.Quantity, Balance: row.Stock, Reason: reason},
+			}
+			if err := tx.Create(&movements).Error; err != nil {
+				return err
+			}
+			if err := moveWarehouseStock(tx, warehouse.ID, row.ProductID, row.Quantity); err != nil {
+				return err
+			}
+		}
+		assigned = len(unplaced)
+		return nil
+	})
+	return assigned, err
+}
+
+// GetWarehouses - Lists warehouses in allocation priority order
+func (h *HandlerContext) GetWarehouses(w http.ResponseWriter, r *http.Request) {
+	var warehouses []models.Warehouse
+	if err := h.db.Order("priority DESC, id").Find(&warehouses).Error; err != nil {
+		log.Printf("Error fetching warehouses: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch warehouses")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"warehouses": warehouses,
+		"allocation": strings.ToLower(envOr("WAREHOUSE_ALLOCATION", allocatePriority)),
+	})
+}
+
+// CreateWarehouse - Adds a warehouse
+func (h *HandlerContext) CreateWarehouse(w http.ResponseWriter, r *http.Request) {
+	var req warehouseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Code = strings.ToUpper(strings.TrimSpace(req.Code))
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Code == "" || req.Name == "" {
+		respondWithError(w, http.StatusBadRequest, "Code and name are required")
+		return
+	}
+
+	warehouse := models.Warehouse{
+		Code:     req.Code,
+		Name:     req.Name,
+		Country:  strings.TrimSpace(req.Country),
+		State:    strings.TrimSpace(req.State),
+		Priority: req.Priority,
+		Active:   req.Active == nil || *req.Active,
+	}
+	result := h.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&warehouse)
+	if result.Error != nil {
+		log.Printf("Error creating warehouse: %v", result.Error)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create warehouse")
+		return
+	}
+	if result.RowsAffected == 0 {
+		respondWithError(w, http.StatusConflict, "A warehouse with this code already exists")
+		return
+	}
+
+	respondWithJson(w, http.StatusCreated, map[string]any{
+		"message":   "Warehouse created successfully",
+		"warehouse": warehouse,
+	})
+}
+
+// UpdateWarehouse - Updates a warehouse, its code never changes
+func (h *HandlerContext) UpdateWarehouse(w http.ResponseWriter, r *http.Request) {
+	warehouseID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid warehouse ID")
+		return
+	}
+
+	var req warehouseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		respondWithError(w, http.StatusBadRequest, "Name is required")
+		return
+	}
+
+	var warehouse models.Warehouse
+	if err := h.db.First(&warehouse, warehouseID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Warehouse not found")
+		} else {
+			log.Printf("Error fetching warehouse: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Error fetching warehouse")
+		}
+		return
+	}
+
+	warehouse.Name = req.Name
+	warehouse.Country = strings.TrimSpace(req.Country)
+	warehouse.State = strings.TrimSpace(req.State)
+	warehouse.Priority = req.Priority
+	if req.Active != nil {
+		warehouse.Active = *req.Active
+	}
+
+	if err := h.db.Save(&warehouse).Error; err != nil {
+		log.Printf("Error updating warehouse: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to update warehouse")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message":   "Warehouse updated successfully",
+		"warehouse": warehouse,
+	})
+}
+
+// GetWarehouseStock - Stock levels of every product held at a warehouse
+func (h *HandlerContext) GetWarehouseStock(w http.ResponseWriter, r *http.Request) {
+	warehouseID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid warehouse ID")
+		return
+	}
+
+	var warehouse models.Warehouse
+	if err := h.db.First(&warehouse, warehouseID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Warehouse not found")
+		} else {
+			log.Printf("Error fetching warehouse: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Error fetching warehouse")
+		}
+		return
+	}
+
+	levels, err := warehouseLevels(&h.db, 0, warehouse.ID)
+	if err != nil {
+		log.Printf("Error fetching stock of warehouse %d: %v", warehouse.ID, err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch warehouse stock")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"warehouse": warehouse,
+		"stock":     levels,
+	})
+}
+
+// CreateStockTransfer - Moves units of a product between warehouses, units
+// reserved by checkouts at the source cannot be moved
+func (h *HandlerContext) CreateStockTransfer(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := strconv.ParseUint(r.URL.Query().Get("userId"), 10, 32)
+
+	var reqBody struct {
+		ProductID       uint   `json:"productId"`
+		FromWarehouseID uint   `json:"fromWarehouseId"`
+		ToWarehouseID   uint   `json:"toWarehouseId"`
+		Quantity        int    `json:"quantity"`
+		Reason          string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if reqBody.Quantity <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Quantity must be greater than 0")
+		return
+	}
+	if reqBody.FromWarehouseID == reqBody.ToWarehouseID {
+		respondWithError(w, http.StatusBadRequest, "Source and destination warehouses must differ")
+		return
+	}
+
+	var warehouses []models.Warehouse
+	if err := h.db.Where("id IN ?", []uint{reqBody.FromWarehouseID, reqBody.ToWarehouseID}).Find(&warehouses).Error; err != nil {
+		log.Printf("Error fetching warehouses: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to transfer stock")
+		return
+	}
+	if len(warehouses) != 2 {
+		respondWithError(w, http.StatusNotFound, "Warehouse not found")
+		return
+	}
+
+	reason := strings.TrimSpace(reqBody.Reason)
+	if reason == "" {
+		reason = "Transfer"
+	}
+
+	var movements []models.StockMovement
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		// Lock the product like checkout does so reservations cannot race the check
+		var product models.Product
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").First(&product, reqBody.ProductID).Error; err != nil {
+			return err
+		}
+
+		levels, err := warehouseLevels(tx, reqBody.ProductID, reqBody.FromWarehouseID)
+		if err != nil {
+			return err
+		}
+		if len(levels) == 0 || levels[0].Available < reqBody.Quantity {
+			return stockError("Not enough unreserved stock at the source warehouse")
+		}
+
+		for _, leg := range []struct {
+			warehouseID uint
+			quantity    int
+		}{
+			{reqBody.FromWarehouseID, -reqBody.Quantity},
+			{reqBody.ToWarehouseID, reqBody.Quantity},
+		} {
+			warehouseID := leg.warehouseID
+			movement, err := moveStock(tx, stockChange{
+				ProductID:   reqBody.ProductID,
+				WarehouseID: &warehouseID,
+				Quantity:    leg.quantity,
+				Type:        models.StockTransfer,
+				Reason:      reason,
+				ActorID:     actorRef(uint(adminID)),
+			})
+			if err != nil {
+				return err
+			}
+			movements = append(movements, movement)
+		}
+		return nil
+	})
+	if err != nil {
+		switch e := err.(type) {
+		case stockError:
+			respondWithError(w, http.StatusConflict, string(e))
+		default:
+			if err == gorm.ErrRecordNotFound {
+				respondWithError(w, http.StatusNotFound, "Product not found")
+				return
+			}
+			log.Printf("Error transferring stock of product %d: %v", reqBody.ProductID, err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to transfer stock")
+		}
+		return
+	}
+
+	respondWithJson(w, http.StatusCreated, map[string]any{
+		"message":   "Stock transferred",
+		"movements": movements,
+	})
+}
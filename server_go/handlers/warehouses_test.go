@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"server/models"
+	"slices"
+	"testing"
+)
+
+func TestSplitStock(t *testing.T) {
+	tests := []struct {
+		name       string
+		candidates []warehouseAllocation
+		quantity   int
+		want       []warehouseAllocation
+	}{
+		{
+			"first that holds them all",
+			[]warehouseAllocation{{1, 2}, {2, 5}, {3, 9}},
+			4,
+			[]warehouseAllocation{{2, 4}},
+		},
+		{
+			"split in order",
+			[]warehouseAllocation{{1, 2}, {2, 0}, {3, 3}, {4, 5}},
+			7,
+			[]warehouseAllocation{{1, 2}, {3, 3}, {4, 2}},
+		},
+		{
+			"exactly enough",
+			[]warehouseAllocation{{1, 2}, {2, 3}},
+			5,
+			[]warehouseAllocation{{1, 2}, {2, 3}},
+		},
+		{
+			"too few units",
+			[]warehouseAllocation{{1, 2}, {2, 3}},
+			6,
+			nil,
+		},
+		{
+			"negative levels are skipped",
+			[]warehouseAllocation{{1, -2}, {2, 3}, {3, 3}},
+			4,
+			[]warehouseAllocation{{2, 3}, {3, 1}},
+		},
+		{"no warehouses", nil, 1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitStock(tt.candidates, tt.quantity); !slices.Equal(got, tt.want) {
+				t.Fatalf("splitStock() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRankWarehouses(t *testing.T) {
+	warehouses := []models.Warehouse{
+		{ID: 1, Country: "US", State: "NY", Priority: 1},
+		{ID: 2, Country: "US", State: "CA", Priority: 0},
+		{ID: 3, Country: "DE", Priority: 5},
+		{ID: 4, Country: "US", Priority: 1},
+		{ID: 5, Priority: 5},
+	}
+
+	tests := []struct {
+		name    string
+		rule    string
+		country string
+		state   string
+		want    []uint
+	}{
+		{"priority by default", "", "US", "CA", []uint{3, 5, 1, 4, 2}},
+		{"priority", allocatePriority, "US", "CA", []uint{3, 5, 1, 4, 2}},
+		{"nearest state first", allocateNearest, "US", "CA", []uint{2, 1, 4, 3, 5}},
+		{"nearest ignores case and spaces", "NEAREST", " us ", "ny", []uint{1, 4, 2, 3, 5}},
+		{"nearest country", allocateNearest, "DE", "BE", []uint{3, 5, 1, 4, 2}},
+		{"nothing near", allocateNearest, "FR", "", []uint{3, 5, 1, 4, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WAREHOUSE_ALLOCATION", tt.rule)
+			ranked := slices.Clone(warehouses)
+			rankWarehouses(ranked, tt.country, tt.state)
+			got := make([]uint, len(ranked))
+			for i, warehouse := range ranked {
+				got[i] = warehouse.ID
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("rankWarehouses() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
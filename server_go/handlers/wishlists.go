@@ -0,0 +1,647 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"server/models"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Limits on a user's wishlists
+const (
+	maxWishlists          = 20
+	maxWishlistNameLength = 100
+	defaultWishlistName   = "Saved for later" // Created when something is saved without a list
+)
+
+// wishlistError - A wishlist problem caused by the request rather than the server
+type wishlistError string
+
+func (e wishlistError) Error() string {
+	return string(e)
+}
+
+// wishlistView - A wishlist with its share link when it is shared
+type wishlistView struct {
+	models.Wishlist
+	ShareURL string `json:"shareUrl,omitempty"`
+}
+
+func newWishlistView(wishlist models.Wishlist) wishlistView {
+	view := wishlistView{Wishlist: wishlist}
+	if wishlist.Shared {
+		view.ShareURL = storeURL("/wishlists/shared/" + signID("wishlist", wishlist.ID))
+	}
+	return view
+}
+
+// newWishlistItem - A wishlist row for a product, alerts start from what the
+// customer sees right now
+func newWishlistItem(wishlistID uint, product models.Product) models.WishlistItem {
+	return models.WishlistItem{
+		WishlistID:      wishlistID,
+		ProductID:       product.ID,
+		AlertPrice:      toCents(product.Price),
+		AlertOutOfStock: product.Stock <= 0,
+	}
+}
+
+// validWishlistName - Trimmed name, or a wishlistError when it cannot be used
+func validWishlistName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", wishlistError("Name is required")
+	}
+	if utf8.RuneCountInString(name) > maxWishlistNameLength {
+		return "", wishlistError(fmt.Sprintf("Name must be at most %d characters", maxWishlistNameLength))
+	}
+	return name, nil
+}
+
+// respondWithWishlistError - Maps wishlist failures to responses, notFound is
+// the message for a missing record
+func respondWithWishlistError(w http.ResponseWriter, err error, action, notFound string) {
+	if msg, ok := err.(wishlistError); ok {
+		respondWithError(w, http.StatusBadRequest, string(msg))
+		return
+	}
+	if err == gorm.ErrRecordNotFound {
+		respondWithError(w, http.StatusNotFound, notFound)
+		return
+	}
+	log.Printf("Error trying to %s: %v", action, err)
+	respondWithError(w, http.StatusInternalServerError, "Failed to "+action)
+}
+
+// loadWishlist - One of the authenticated user's wishlists by the id in the
+// URL, responding with an error when it cannot
+func (h *HandlerContext) loadWishlist(w http.ResponseWriter, r *http.Request) (*models.Wishlist, bool) {
+	userID := getUserIDFromRequest(r)
+	if userID == 0 {
+		respondWithError(w, http.StatusUnauthorized, "Missing authorization token")
+		return nil, false
+	}
+
+	wishlistID, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid wishlist ID")
+		return nil, false
+	}
+
+	var wishlist models.Wishlist
+	if err := h.db.Where("id = ? AND user_id = ?", wishlistID, userID).First(&wishlist).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Wishlist not found")
+		} else {
+			log.Printf("Error fetching wishlist: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Error fetching wishlist")
+		}
+		return nil, false
+	}
+	return &wishlist, true
+}
+
+// preloadWishlistItems - Loads wishlist items with their products and images,
+// most recently added first
+func preloadWishlistItems(db *gorm.DB) *gorm.DB {
+	return db.Preload("Items", func(db *gorm.DB) *gorm.DB {
+		return db.Order("added_at DESC, id DESC")
+	}).Preload("Items.Product.Images", func(db *gorm.DB) *gorm.DB {
+		return db.Order(`is_primary DESC, "order", id`)
+	})
+}
+
+// GetWishlists - The authenticated user's wishlists with their products
+func (h *HandlerContext) GetWishlists(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromRequest(r)
+	if userID == 0 {
+		respondWithError(w, http.StatusUnauthorized, "Missing authorization token")
+		return
+	}
+
+	var wishlists []models.Wishlist
+	if err := preloadWishlistItems(h.db.Model(&models.Wishlist{})).
+		Where("user_id = ?", userID).Order("created_at, id").Find(&wishlists).Error; err != nil {
+		log.Printf("Error fetching wishlists: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to fetch wishlists")
+		return
+	}
+
+	views := make([]wishlistView, 0, len(wishlists))
+	for _, wishlist := range wishlists {
+		views = append(views, newWishlistView(wishlist))
+	}
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"wishlists": views,
+	})
+}
+
+// CreateWishlist - Starts a new named wishlist
+func (h *HandlerContext) CreateWishlist(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromRequest(r)
+	if userID == 0 {
+		respondWithError(w, http.StatusUnauthorized, "Missing authorization token")
+		return
+	}
+
+	var reqBody struct {
+		Name   string `json:"name"`
+		Shared bool   `json:"shared"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	name, err := validWishlistName(reqBody.Name)
+	if err != nil {
+		respondWithWishlistError(w, err, "create wishlist", "Wishlist not found")
+		return
+	}
+
+	var count int64
+	if err := h.db.Model(&models.Wishlist{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+		log.Printf("Error counting wishlists: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create wishlist")
+		return
+	}
+	if count >= maxWishlists {
+		respondWithError(w, http.StatusConflict, fmt.Sprintf("You can have at most %d wishlists", maxWishlists))
+		return
+	}
+
+	wishlist := models.Wishlist{UserID: userID, Name: name, Shared: reqBody.Shared, Items: []models.WishlistItem{}}
+	if err := h.db.Create(&wishlist).Error; err != nil {
+		log.Printf("Error creating wishlist: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to create wishlist")
+		return
+	}
+
+	respondWithJson(w, http.StatusCreated, map[string]any{
+		"message":  "Wishlist created successfully",
+		"wishlist": newWishlistView(wishlist),
+	})
+}
+
+// UpdateWishlist - Renames a wishlist or turns its share link on or off
+func (h *HandlerContext) UpdateWishlist(w http.ResponseWriter, r *http.Request) {
+	wishlist, ok := h.loadWishlist(w, r)
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		Name   *string `json:"name"`   // Left unchanged when omitted
+		Shared *bool   `json:"shared"` // Left unchanged when omitted
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	updates := map[string]any{}
+	if reqBody.Name != nil {
+		name, err := validWishlistName(*reqBody.Name)
+		if err != nil {
+			respondWithWishlistError(w, err, "update wishlist", "Wishlist not found")
+			return
+		}
+		updates["name"] = name
+	}
+	if reqBody.Shared != nil {
+		updates["shared"] = *reqBody.Shared
+	}
+	if len(updates) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Nothing to update")
+		return
+	}
+
+	if err := h.db.Model(wishlist).Updates(updates).Error; err != nil {
+		log.Printf("Error updating wishlist: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to update wishlist")
+		return
+	}
+	if name, ok := updates["name"].(string); ok {
+		wishlist.Name = name
+	}
+	if reqBody.Shared != nil {
+		wishlist.Shared = *reqBody.Shared
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message":  "Wishlist updated successfully",
+		"wishlist": newWishlistView(*wishlist),
+	})
+}
+
+// DeleteWishlist - Deletes a wishlist and everything on it
+func (h *HandlerContext) DeleteWishlist(w http.ResponseWriter, r *http.Request) {
+	wishlist, ok := h.loadWishlist(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("wishlist_id = ?", wishlist.ID).Delete(&models.WishlistItem{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(wishlist).Error
+	})
+	if err != nil {
+		log.Printf("Error deleting wishlist: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete wishlist")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message": "Wishlist deleted successfully",
+	})
+}
+
+// AddWishlistItem - Puts a product on a wishlist, adding it twice is a no-op
+func (h *HandlerContext) AddWishlistItem(w http.ResponseWriter, r *http.Request) {
+	wishlist, ok := h.loadWishlist(w, r)
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		ProductID uint `json:"productId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	var product models.Product
+	if err := h.db.Where("archived_at IS NULL").First(&product, reqBody.ProductID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Product not found")
+		} else {
+			log.Printf("Error fetching product: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Error fetching product")
+		}
+		return
+	}
+
+	item := newWishlistItem(wishlist.ID, product)
+	result := h.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&item)
+	if result.Error != nil {
+		log.Printf("Error adding wishlist item: %v", result.Error)
+		respondWithError(w, http.StatusInternalServerError, "Failed to add product to wishlist")
+		return
+	}
+	if result.RowsAffected == 0 {
+		if err := h.db.Where("wishlist_id = ? AND product_id = ?", wishlist.ID, product.ID).First(&item).Error; err != nil {
+			log.Printf("Error fetching wishlist item: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Failed to add product to wishlist")
+			return
+		}
+		item.Product = product
+		respondWithJson(w, http.StatusOK, map[string]any{
+			"message": "Product is already on the wishlist",
+			"item":    item,
+		})
+		return
+	}
+
+	item.Product = product
+	respondWithJson(w, http.StatusCreated, map[string]any{
+		"message": "Product added to wishlist",
+		"item":    item,
+	})
+}
+
+// RemoveWishlistItem - Takes a product off a wishlist
+func (h *HandlerContext) RemoveWishlistItem(w http.ResponseWriter, r *http.Request) {
+	wishlist, ok := h.loadWishlist(w, r)
+	if !ok {
+		return
+	}
+
+	itemID, err := strconv.ParseUint(chi.URLParam(r, "itemId"), 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid item ID")
+		return
+	}
+
+	result := h.db.Where("id = ? AND wishlist_id = ?", itemID, wishlist.ID).Delete(&models.WishlistItem{})
+	if result.Error != nil {
+		log.Printf("Error removing wishlist item: %v", result.Error)
+		respondWithError(w, http.StatusInternalServerError, "Failed to remove product from wishlist")
+		return
+	}
+	if result.RowsAffected == 0 {
+		respondWithError(w, http.StatusNotFound, "Wishlist item not found")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message": "Product removed from wishlist",
+	})
+}
+
+// MoveWishlistItemToCart - Moves a product from a wishlist into the user's
+// cart, adding to the quantity already there
+func (h *HandlerContext) MoveWishlistItemToCart(w http.ResponseWriter, r *http.Request) {
+	wishlist, ok := h.loadWishlist(w, r)
+	if !ok {
+		return
+	}
+
+	itemID, err := strconv.ParseUint(chi.URLParam(r, "itemId"), 10, 32)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid item ID")
+		return
+	}
+
+	var reqBody struct {
+		Quantity int `json:"quantity"` // Defaults to 1
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil && err != io.EOF {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if reqBody.Quantity == 0 {
+		reqBody.Quantity = 1
+	}
+	if reqBody.Quantity < 0 {
+		respondWithError(w, http.StatusBadRequest, "Quantity must be greater than 0")
+		return
+	}
+
+	var cartItem models.Cart
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		var item models.WishlistItem
+		if err := tx.Preload("Product").Where("id = ? AND wishlist_id = ?", itemID, wishlist.ID).First(&item).Error; err != nil {
+			return err
+		}
+
+		owner := cartOwner{UserID: wishlist.UserID}
+		err := owner.scope(tx.Where("product_id = ?", item.ProductID)).First(&cartItem).Error
+		if err != nil && err != gorm.ErrRecordNotFound {
+			return err
+		}
+		if err == gorm.ErrRecordNotFound {
+			cartItem = owner.newItem()
+			cartItem.ProductID = item.ProductID
+		}
+
+		if item.Product.ArchivedAt != nil {
+			return wishlistError(item.Product.Name + " is no longer available")
+		}
+		cartItem.Quantity += reqBody.Quantity
+		cartItem.PriceAtAdd = toCents(item.Product.Price)
+		if cartItem.Quantity > item.Product.Stock {
+			return wishlistError("Insufficient stock for " + item.Product.Name)
+		}
+		if err := tx.Save(&cartItem).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&item).Error
+	})
+	if err != nil {
+		respondWithWishlistError(w, err, "move product to cart", "Wishlist item not found")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message": "Product moved to cart",
+		"cart":    cartItem,
+	})
+}
+
+// MoveCartItemToWishlist - Saves a cart item for later on a wishlist, the
+// oldest one unless given, creating one if the user has none
+func (h *HandlerContext) MoveCartItemToWishlist(w http.ResponseWriter, r *http.Request) {
+	userID := getUserIDFromRequest(r)
+	if userID == 0 {
+		respondWithError(w, http.StatusUnauthorized, "Missing authorization token")
+		return
+	}
+
+	var reqBody struct {
+		CartItemID uint `json:"cartItemId"`
+		WishlistID uint `json:"wishlistId"` // 0 picks the oldest wishlist
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	var item models.WishlistItem
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var cartItem models.Cart
+		if err := tx.Preload("Product").Where("id = ? AND user_id = ?", reqBody.CartItemID, userID).First(&cartItem).Error; err != nil {
+			return err
+		}
+
+		var wishlist models.Wishlist
+		query := tx.Where("user_id = ?", userID)
+		if reqBody.WishlistID != 0 {
+			query = query.Where("id = ?", reqBody.WishlistID)
+		}
+		err := query.Order("created_at, id").First(&wishlist).Error
+		if err == gorm.ErrRecordNotFound && reqBody.WishlistID == 0 {
+			wishlist = models.Wishlist{UserID: userID, Name: defaultWishlistName}
+			err = tx.Create(&wishlist).Error
+		}
+		if err != nil {
+			return err
+		}
+
+		item = newWishlistItem(wishlist.ID, cartItem.Product)
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&item).Error; err != nil {
+			return err
+		}
+		if item.ID == 0 {
+			if err := tx.Where("wishlist_id = ? AND product_id = ?", wishlist.ID, cartItem.ProductID).First(&item).Error; err != nil {
+				return err
+			}
+		}
+		item.Product = cartItem.Product
+		return tx.Delete(&cartItem).Error
+	})
+	if err != nil {
+		respondWithWishlistError(w, err, "save product for later", "Cart item or wishlist not found")
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"message": "Product saved for later",
+		"item":    item,
+	})
+}
+
+// GetSharedWishlist - A shared wishlist for anyone holding its link, without
+// anything identifying its owner
+func (h *HandlerContext) GetSharedWishlist(w http.ResponseWriter, r *http.Request) {
+	wishlistID, ok := parseSignedID("wishlist", chi.URLParam(r, "token"))
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Wishlist not found")
+		return
+	}
+
+	var wishlist models.Wishlist
+	if err := preloadWishlistItems(h.db.Model(&models.Wishlist{})).
+		Where("id = ? AND shared = ?", wishlistID, true).First(&wishlist).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			respondWithError(w, http.StatusNotFound, "Wishlist not found")
+		} else {
+			log.Printf("Error fetching wishlist: %v", err)
+			respondWithError(w, http.StatusInternalServerError, "Error fetching wishlist")
+		}
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"name":  wishlist.Name,
+		"items": wishlist.Items,
+	})
+}
+
+// wishlistAlert - One email about a wishlisted product
+type wishlistAlert struct {
+	UserID   uint
+	Template string
+	OldPrice int64 // In cents, price drops only
+}
+
+// syncWishlistAlerts - Compares a product's price and stock with what the
+// customers wishlisting it last saw, and queues one email per customer for a
+// restock or a price drop. Call it in the transaction that changed the product.
+func syncWishlistAlerts(tx *gorm.DB, productID uint) error {
+	var product models.Product
+	if err := tx.First(&product, productID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		return err
+	}
+	price := toCents(product.Price)
+	outOfStock := product.Stock <= 0 || product.ArchivedAt != nil
+
+	var items []struct {
+		models.WishlistItem
+		UserID uint
+	}
+	if err := tx.Table("wishlist_items").
+		Select("wishlist_items.*, wishlists.user_id").
+		Joins("JOIN wishlists ON wishlists.id = wishlist_items.wishlist_id").
+		Where("wishlist_items.product_id = ? AND (wishlist_items.alert_price <> ? OR wishlist_items.alert_out_of_stock <> ?)",
+			productID, price, outOfStock).
+		Scan(&items).Error; err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	// The same product on several lists of a user is still one email, a restock
+	// says more than a price drop
+	alerts := map[uint]*wishlistAlert{}
+	var order []uint
+	for _, item := range items {
+		if outOfStock {
+			continue
+		}
+		var template string
+		switch {
+		case item.AlertOutOfStock:
+			template = "wishlist_back_in_stock"
+		case price < item.AlertPrice:
+			template = "wishlist_price_drop"
+		default:
+			continue
+		}
+
+		alert, ok := alerts[item.UserID]
+		if !ok {
+			alert = &wishlistAlert{UserID: item.UserID}
+			alerts[item.UserID] = alert
+			order = append(order, item.UserID)
+		}
+		if alert.Template != "wishlist_back_in_stock" {
+			alert.Template = template
+		}
+		alert.OldPrice = max(alert.OldPrice, item.AlertPrice)
+	}
+
+	if err := tx.Model(&models.WishlistItem{}).Where("product_id = ?", productID).Updates(map[string]any{
+		"alert_price":        price,
+		"alert_out_of_stock": outOfStock,
+	}).Error; err != nil {
+		return err
+	}
+
+	for _, userID := range order {
+		// A customer who also subscribed to the restock gets this email only
+		if alerts[userID].Template == "wishlist_back_in_stock" {
+			if err := tx.Model(&models.StockSubscription{}).
+				Where("product_id = ? AND notified_at IS NULL", productID).
+				Where("user_id = ? OR email = (SELECT LOWER(email) FROM users WHERE id = ?)", userID, userID).
+				Update("notified_at", time.Now()).Error; err != nil {
+				return err
+			}
+		}
+		if err := enqueueWishlistEmail(tx, product, *alerts[userID]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enqueueWishlistEmail - Queues a wishlist alert to its customer, template
+// problems are logged rather than failing the change
+func enqueueWishlistEmail(tx *gorm.DB, product models.Product, alert wishlistAlert) error {
+	var user models.User
+	if err := tx.First(&user, alert.UserID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		}
+		return err
+	}
+	if user.Email == "" {
+		return nil
+	}
+
+	data := wishlistEmailData{
+		StoreName:  envOr("SELLER_NAME", "Two Idiots Store"),
+		Name:       strings.TrimSpace(user.FirstName),
+		Product:    product.Name,
+		Price:      formatCents(toCents(product.Price)),
+		ProductURL: storeURL(fmt.Sprintf("/products/%d", product.ID)),
+	}
+	if alert.OldPrice > toCents(product.Price) {
+		data.OldPrice = formatCents(alert.OldPrice)
+	}
+
+	locale := emailLocale(user.Locale)
+	subject, text, html, err := renderEmail(locale, alert.Template, data)
+	if err != nil {
+		log.Printf("Error rendering %s email for product %d: %v", alert.Template, product.ID, err)
+		return nil
+	}
+
+	return tx.Create(&models.EmailJob{
+		UserID:        &user.ID,
+		Template:      alert.Template,
+		Locale:        locale,
+		To:            user.Email,
+		Subject:       subject,
+		TextBody:      text,
+		HTMLBody:      html,
+		Status:        models.EmailPending,
+		NextAttemptAt: time.Now(),
+	}).Error
+}
@@ -41,10 +41,29 @@ func main() {
 
 	if os.Getenv("MIGRATE") == "true" {
 		fmt.Println("Start migrating database schema....")
+
+		// Idempotency keys gained the guest scope, AutoMigrate only creates
+		// missing indexes so the old one is dropped to be rebuilt with it
+		if db.Migrator().HasTable(&models.IdempotencyKey{}) && !db.Migrator().HasColumn(&models.IdempotencyKey{}, "guest_scope") {
+			if err := db.Migrator().DropIndex(&models.IdempotencyKey{}, "idx_idempotency_keys_scope"); err != nil {
+				log.Fatalf("Failed to migrate: %v", err)
+			}
+		}
 		err = db.AutoMigrate(
 			&models.User{}, &models.Category{}, &models.Product{},
 			&models.ProductImage{}, &models.ProductSpec{}, &models.Cart{},
 			&models.Order{}, &models.OrderItem{}, &models.Review{},
+			&models.IdempotencyKey{}, &models.TaxRule{},
+			&models.ShippingZone{}, &models.ShippingMethod{},
+			&models.Promotion{}, &models.PromotionRedemption{}, &models.OrderDiscount{},
+			&models.CheckoutQuote{}, &models.OrderEvent{}, &models.Refund{},
+			&models.RefundItem{}, &models.Shipment{}, &models.ShipmentItem{},
+			&models.ReturnRequest{}, &models.ReturnItem{}, &models.ReturnEvent{},
+			&models.Invoice{}, &models.EmailJob{}, &models.OrderNote{},
+			&models.GuestCart{}, &models.Wishlist{}, &models.WishlistItem{},
+			&models.AbandonedCart{}, &models.StockMovement{}, &models.StockReservation{},
+			&models.Warehouse{}, &models.WarehouseStock{}, &models.StockAlert{},
+			&models.StockSubscription{},
 		)
 		if err != nil {
 			log.Fatalf("Failed to migrate: %v", err)
@@ -54,6 +73,27 @@ func main() {
 	// Create Handler Context
 	handlerContext := handlers.New(db)
 
+	// Deliver queued emails in the background
+	go handlerContext.RunEmailWorker()
+	go handlerContext.RunCartWorker()
+	go handlerContext.RunReservationWorker()
+	go handlerContext.RunStockAlertWorker()
+	go handlerContext.RunRefundWorker()
+
+	// Give stock set before the ledger existed an opening balance and a warehouse
+	if os.Getenv("MIGRATE") == "true" {
+		if count, err := handlerContext.ReconcileStockLedger(); err != nil {
+			log.Printf("Failed to reconcile stock ledger: %v", err)
+		} else if count > 0 {
+			log.Printf("Posted opening stock balances for %d products", count)
+		}
+		if count, err := handlerContext.AssignUnplacedStock(); err != nil {
+			log.Printf("Failed to place stock in warehouses: %v", err)
+		} else if count > 0 {
+			log.Printf("Placed stock of %d products in the primary warehouse", count)
+		}
+	}
+
 	// Seeding data here
 	// SeedCategories(db)
 
@@ -23,6 +23,7 @@ type User struct {
 	UpdatedAt    time.Time `gorm:"default:now()" json:"updatedAt"`
 	Role         UserRole  `gorm:"not null;type:varchar(20);default:'user'" json:"role"`
 	Phone        string    `gorm:"unique;not null;type:varchar(255)" json:"phone"`
+	Locale       string    `gorm:"not null;type:varchar(10);default:'en'" json:"locale"` // Language of emails sent to the user
 
 	CartItems []Cart   `gorm:"foreignKey:UserID" json:"cartItems"`
 	Orders    []Order  `gorm:"foreignKey:UserID" json:"orders"`
@@ -55,9 +56,25 @@ type Product struct {
 	Description string    `gorm:"not null;type:text" json:"description"`
 	CategoryID  uint      `gorm:"index" json:"categoryId"`
 	Stock       int       `gorm:"not null;default:0" json:"stock"`
+	WeightGrams int       `gorm:"not null;default:0" json:"weightGrams"`
+	LengthCm    float64   `gorm:"not null;default:0;type:decimal(8,2)" json:"lengthCm"`
+	WidthCm     float64   `gorm:"not null;default:0;type:decimal(8,2)" json:"widthCm"`
+	HeightCm    float64   `gorm:"not null;default:0;type:decimal(8,2)" json:"heightCm"`
 	CreatedAt   time.Time `gorm:"default:now()" json:"createdAt"`
 	UpdatedAt   time.Time `gorm:"default:now()" json:"updatedAt"`
 
+	ReorderThreshold int        `gorm:"not null;default:5" json:"reorderThreshold"` // Stock at or below this is low
+	ArchivedAt       *time.Time `gorm:"index" json:"archivedAt,omitempty"`          // No longer sold, kept for past orders
+	Available        int        `gorm:"-" json:"available"`                         // Stock not held by reservations, filled in by handlers
+
+	// Selling beyond stock, the units ship once receipts come in
+	BackorderMode    BackorderMode `gorm:"not null;type:varchar(20);default:''" json:"backorderMode"`
+	BackorderLimit   int           `gorm:"not null;default:0" json:"backorderLimit"`            // Units that may be waiting for stock at once
+	AvailableOn      *time.Time    `gorm:"type:date" json:"availableOn,omitempty"`              // When stock is expected
+	BackorderMessage string        `gorm:"type:varchar(255)" json:"backorderMessage,omitempty"` // Shown instead of the default notice
+	Backorderable    int           `gorm:"-" json:"backorderable"`                              // Units left to sell beyond stock, filled in by handlers
+	BackorderNotice  string        `gorm:"-" json:"backorderNotice,omitempty"`                  // What shoppers are told, filled in by handlers
+
 	Category   Category       `gorm:"foreignKey:CategoryID" json:"category"`
 	Images     []ProductImage `gorm:"foreignKey:ProductID" json:"images"`
 	Specs      []ProductSpec  `gorm:"foreignKey:ProductID" json:"specs"`
@@ -66,6 +83,24 @@ type Product struct {
 	Reviews    []Review       `gorm:"foreignKey:ProductID" json:"reviews"`
 }
 
+// BackorderMode - Whether a product can be sold when it has no stock
+type BackorderMode string
+
+const (
+	BackorderNone     BackorderMode = ""          // Sold from stock only
+	BackorderAllowed  BackorderMode = "backorder" // Sold out for now, ships when restocked
+	BackorderPreorder BackorderMode = "preorder"  // Not released yet, ships from the first receipts
+)
+
+// Valid reports whether the mode is a known backorder mode
+func (m BackorderMode) Valid() bool {
+	switch m {
+	case BackorderNone, BackorderAllowed, BackorderPreorder:
+		return true
+	}
+	return false
+}
+
 // ProductImage model
 type ProductImage struct {
 	ID        uint   `gorm:"primaryKey" json:"id"`
@@ -89,20 +124,65 @@ type ProductSpec struct {
 
 // Cart model
 type Cart struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	UserID    uint      `gorm:"index" json:"userId"`
-	ProductID uint      `gorm:"index" json:"productId"`
-	Quantity  int       `gorm:"not null;check:quantity > 0" json:"quantity"`
-	AddedAt   time.Time `gorm:"default:now()" json:"addedAt"`
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	UserID      *uint     `gorm:"index" json:"userId"`                // Nil for guest carts
+	GuestCartID *uint     `gorm:"index" json:"guestCartId,omitempty"` // Set instead of UserID for anonymous visitors
+	ProductID   uint      `gorm:"index" json:"productId"`
+	Quantity    int       `gorm:"not null;check:quantity > 0" json:"quantity"`
+	PriceAtAdd  int64     `gorm:"not null;default:0" json:"priceAtAdd"` // In cents, what the shopper saw when adding, 0 if unknown
+	AddedAt     time.Time `gorm:"default:now()" json:"addedAt"`
+	UpdatedAt   time.Time `json:"updatedAt"` // Last change, how idle the cart is
 
 	User    User    `gorm:"foreignKey:UserID" json:"user"`
 	Product Product `gorm:"foreignKey:ProductID" json:"product"`
 }
 
+type OrderStatus string
+
+const (
+	OrderPending    OrderStatus = "pending"
+	OrderPaid       OrderStatus = "paid"
+	OrderProcessing OrderStatus = "processing"
+	OrderShipped    OrderStatus = "shipped"
+	OrderDelivered  OrderStatus = "delivered"
+	OrderCancelled  OrderStatus = "cancelled"
+	OrderRefunded   OrderStatus = "refunded"
+)
+
+// orderTransitions - Statuses each status may move to
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderPending:    {OrderPaid, OrderCancelled},
+	OrderPaid:       {OrderProcessing, OrderCancelled, OrderRefunded},
+	OrderProcessing: {OrderShipped, OrderCancelled, OrderRefunded},
+	OrderShipped:    {OrderDelivered, OrderRefunded},
+	OrderDelivered:  {OrderRefunded},
+}
+
+// Valid reports whether the status is a known order status
+func (s OrderStatus) Valid() bool {
+	switch s {
+	case OrderPending, OrderPaid, OrderProcessing, OrderShipped, OrderDelivered, OrderCancelled, OrderRefunded:
+		return true
+	}
+	return false
+}
+
+// CanTransitionTo reports whether an order may move from s to next
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	for _, allowed := range orderTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
 // Order model
 type Order struct {
 	ID           uint        `gorm:"primaryKey" json:"id"`
-	UserID       uint        `gorm:"not null" json:"userId"`
+	UserID       *uint       `gorm:"index" json:"userId"` // Nil for guest orders until they are claimed
+	GuestEmail   string      `gorm:"type:varchar(255);index" json:"guestEmail,omitempty"`
+	GuestName    string      `gorm:"type:varchar(255)" json:"guestName,omitempty"`
 	Total        int64       `gorm:"not null" json:"total"` // In cents
 	CreatedAt    time.Time   `json:"createdAt"`
 	AddressLine1 string      `gorm:"type:varchar(255)" json:"line1"`
@@ -113,16 +193,48 @@ type Order struct {
 	Country      string      `gorm:"type:varchar(100)" json:"country"`
 	Items        []OrderItem `gorm:"foreignKey:OrderID" json:"items"`
 	User         User        `gorm:"foreignKey:UserID" json:"user"`
-    Status       string      `gorm:"type:varchar(50);default:'pending'" json:"status"`
+	Status       OrderStatus `gorm:"type:varchar(50);default:'pending'" json:"status"`
+	Tax          int64       `gorm:"not null;default:0" json:"tax"` // In cents
+
+	ShippingMethodID   *uint  `json:"shippingMethodId"`
+	ShippingMethodName string `gorm:"type:varchar(100)" json:"shippingMethodName"`
+	Shipping           int64  `gorm:"not null;default:0" json:"shipping"` // In cents
+
+	Discount  int64           `gorm:"not null;default:0" json:"discount"` // In cents
+	Discounts []OrderDiscount `gorm:"foreignKey:OrderID" json:"discounts"`
+
+	PaymentIntentID string     `gorm:"type:varchar(255);index" json:"paymentIntentId"`
+	CancelReason    string     `gorm:"type:text" json:"cancelReason,omitempty"`
+	CancelledAt     *time.Time `json:"cancelledAt,omitempty"`
+	Refunds         []Refund   `gorm:"foreignKey:OrderID" json:"refunds"`
+	Refunded        int64      `gorm:"not null;default:0" json:"refunded"`                // In cents, net amount is Total - Refunded
+	AwaitingStock   bool       `gorm:"not null;default:false;index" json:"awaitingStock"` // Some backordered or pre-ordered units have no stock yet
+
+	Shipments []Shipment `gorm:"foreignKey:OrderID" json:"shipments"`
+
+	Notes []OrderNote `gorm:"foreignKey:OrderID" json:"notes,omitempty"`
 }
 
 type OrderItem struct {
-	ID        uint   `gorm:"primaryKey" json:"id"`
-	OrderID   uint   `gorm:"not null" json:"orderId"`
-	ProductID uint   `gorm:"not null" json:"productId"`
-	Quantity  int    `gorm:"not null" json:"quantity"`
-	Price     int64  `gorm:"not null" json:"price"`         // Price at purchase time, in cents
-	Name      string `gorm:"type:varchar(255)" json:"name"` // Product name at purchase time
+	ID                uint    `gorm:"primaryKey" json:"id"`
+	OrderID           uint    `gorm:"not null" json:"orderId"`
+	ProductID         uint    `gorm:"not null" json:"productId"`
+	Quantity          int     `gorm:"not null" json:"quantity"`
+	Price             int64   `gorm:"not null" json:"price"`                               // Price at purchase time, in cents
+	Name              string  `gorm:"type:varchar(255)" json:"name"`                       // Product name at purchase time
+	Tax               int64   `gorm:"not null;default:0" json:"tax"`                       // Line tax, in cents
+	TaxRate           float64 `gorm:"not null;default:0;type:decimal(6,4)" json:"taxRate"` // Rate applied to the line
+	TaxIncluded       bool    `gorm:"not null;default:false" json:"taxIncluded"`           // Whether Price already contains the tax
+	Discount          int64   `gorm:"not null;default:0" json:"discount"`                  // Promotion discount on the line, in cents
+	RefundedQuantity  int     `gorm:"not null;default:0" json:"refundedQuantity"`          // Units refunded so far
+	ShippedQuantity   int     `gorm:"not null;default:0" json:"shippedQuantity"`           // Units sent in shipments so far
+	CancelledQuantity int     `gorm:"not null;default:0" json:"cancelledQuantity"`         // Refunded units that had not shipped, they never will
+
+	BackorderMode       BackorderMode `gorm:"not null;type:varchar(20);default:''" json:"backorderMode,omitempty"` // Set when units were sold beyond stock
+	BackorderedQuantity int           `gorm:"not null;default:0" json:"backorderedQuantity"`                       // Units still waiting for stock, they cannot ship
+	AvailableOn         *time.Time    `gorm:"type:date" json:"availableOn,omitempty"`                              // Expected date shown at purchase
+
+	Product *Product `gorm:"foreignKey:ProductID" json:"product,omitempty"` // Only when preloaded, nil if the product was deleted
 }
 
 type Review struct {
@@ -138,12 +250,552 @@ type Review struct {
 }
 
 type ShippingAddress struct {
-    ID         uint   `gorm:"primaryKey" json:"id"`
-    OrderID    uint   `gorm:"column:order_id;not null" json:"orderId"`
-    Line1      string `gorm:"type:varchar(255);not null" json:"line1"`
-    Line2      string `gorm:"type:varchar(255)" json:"line2"`
-    City       string `gorm:"type:varchar(100);not null" json:"city"`
-    State      string `gorm:"type:varchar(100);not null" json:"state"`
-    PostalCode string `gorm:"type:varchar(20);not null" json:"postalCode"`
-    Country    string `gorm:"type:varchar(100);not null" json:"country"`
+	ID         uint   `gorm:"primaryKey" json:"id"`
+	OrderID    uint   `gorm:"column:order_id;not null" json:"orderId"`
+	Line1      string `gorm:"type:varchar(255);not null" json:"line1"`
+	Line2      string `gorm:"type:varchar(255)" json:"line2"`
+	City       string `gorm:"type:varchar(100);not null" json:"city"`
+	State      string `gorm:"type:varchar(100);not null" json:"state"`
+	PostalCode string `gorm:"type:varchar(20);not null" json:"postalCode"`
+	Country    string `gorm:"type:varchar(100);not null" json:"country"`
+}
+
+// IdempotencyKey model - stores the first response for a client supplied
+// Idempotency-Key so retries of the same request can be replayed
+type IdempotencyKey struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	Key          string    `gorm:"not null;type:varchar(255);uniqueIndex:idx_idempotency_keys_scope" json:"key"`
+	UserID       uint      `gorm:"not null;uniqueIndex:idx_idempotency_keys_scope" json:"userId"`
+	GuestScope   string    `gorm:"not null;type:varchar(64);default:'';uniqueIndex:idx_idempotency_keys_scope" json:"-"` // Hash of the guest cart token, guests without one share the empty scope
+	Method       string    `gorm:"not null;type:varchar(10)" json:"method"`
+	Path         string    `gorm:"not null;type:varchar(255)" json:"path"`
+	RequestHash  string    `gorm:"not null;type:varchar(64)" json:"requestHash"`
+	StatusCode   int       `gorm:"not null;default:0" json:"statusCode"` // 0 while the first request is still running
+	ContentType  string    `gorm:"type:varchar(100)" json:"contentType"`
+	ResponseBody []byte    `gorm:"type:bytea" json:"-"`
+	CartToken    string    `gorm:"type:varchar(100)" json:"-"` // Guest cart token the response handed out, handed out again on replay
+	CreatedAt    time.Time `gorm:"default:now()" json:"createdAt"`
+}
+
+// TaxRule model - a rate applied to lines shipped to a matching destination.
+// Empty Country/State/PostalPrefix and a nil CategoryID match anything; a
+// rate of 0 makes the matching category tax exempt.
+type TaxRule struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	Name         string    `gorm:"not null;type:varchar(100)" json:"name"`
+	Country      string    `gorm:"type:varchar(100);index" json:"country"`
+	State        string    `gorm:"type:varchar(100)" json:"state"`
+	PostalPrefix string    `gorm:"type:varchar(20)" json:"postalPrefix"`
+	CategoryID   *uint     `gorm:"index" json:"categoryId"`
+	Rate         float64   `gorm:"not null;type:decimal(6,4)" json:"rate"`  // e.g. 0.0825 for 8.25%
+	Inclusive    bool      `gorm:"not null;default:false" json:"inclusive"` // Prices already include this tax
+	Priority     int       `gorm:"not null;default:0" json:"priority"`
+	Active       bool      `gorm:"not null;default:true" json:"active"`
+	CreatedAt    time.Time `gorm:"default:now()" json:"createdAt"`
+	UpdatedAt    time.Time `gorm:"default:now()" json:"updatedAt"`
+
+	Category *Category `gorm:"foreignKey:CategoryID" json:"category,omitempty"`
+}
+
+type ShippingMethodType string
+
+const (
+	ShippingFlat     ShippingMethodType = "flat"
+	ShippingWeight   ShippingMethodType = "weight"
+	ShippingFreeOver ShippingMethodType = "free_over"
+	ShippingExpress  ShippingMethodType = "express"
+)
+
+// ShippingZone model - a destination area with its own shipping methods.
+// Empty Country/State/PostalPrefix match anything.
+type ShippingZone struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	Name         string    `gorm:"not null;type:varchar(100)" json:"name"`
+	Country      string    `gorm:"type:varchar(100);index" json:"country"`
+	State        string    `gorm:"type:varchar(100)" json:"state"`
+	PostalPrefix string    `gorm:"type:varchar(20)" json:"postalPrefix"`
+	Priority     int       `gorm:"not null;default:0" json:"priority"`
+	Active       bool      `gorm:"not null;default:true" json:"active"`
+	CreatedAt    time.Time `gorm:"default:now()" json:"createdAt"`
+	UpdatedAt    time.Time `gorm:"default:now()" json:"updatedAt"`
+
+	Methods []ShippingMethod `gorm:"foreignKey:ZoneID" json:"methods"`
+}
+
+// ShippingMethod model - how a zone's rate is calculated, amounts in cents
+type ShippingMethod struct {
+	ID             uint               `gorm:"primaryKey" json:"id"`
+	ZoneID         uint               `gorm:"not null;index" json:"zoneId"`
+	Name           string             `gorm:"not null;type:varchar(100)" json:"name"`
+	Type           ShippingMethodType `gorm:"not null;type:varchar(20)" json:"type"`
+	BaseRate       int64              `gorm:"not null;default:0" json:"baseRate"`
+	PerKgRate      int64              `gorm:"not null;default:0" json:"perKgRate"`
+	FreeThreshold  int64              `gorm:"not null;default:0" json:"freeThreshold"`
+	Surcharge      int64              `gorm:"not null;default:0" json:"surcharge"`      // Express premium on top of the weight-based cost
+	MaxWeightGrams int                `gorm:"not null;default:0" json:"maxWeightGrams"` // 0 means no limit
+	MinDays        int                `gorm:"not null;default:0" json:"minDays"`
+	MaxDays        int                `gorm:"not null;default:0" json:"maxDays"`
+	Active         bool               `gorm:"not null;default:true" json:"active"`
+	CreatedAt      time.Time          `gorm:"default:now()" json:"createdAt"`
+	UpdatedAt      time.Time          `gorm:"default:now()" json:"updatedAt"`
+}
+
+type PromotionType string
+
+const (
+	PromotionPercentage   PromotionType = "percentage"
+	PromotionFixed        PromotionType = "fixed"
+	PromotionFreeShipping PromotionType = "free_shipping"
+	PromotionBuyXGetY     PromotionType = "buy_x_get_y"
+)
+
+// Promotion model - a discount applied automatically, or with Code when set.
+// ProductID/CategoryID scope the discount to matching lines.
+type Promotion struct {
+	ID           uint          `gorm:"primaryKey" json:"id"`
+	Name         string        `gorm:"not null;type:varchar(100)" json:"name"`
+	Code         *string       `gorm:"unique;type:varchar(50)" json:"code"`
+	Type         PromotionType `gorm:"not null;type:varchar(20)" json:"type"`
+	PercentOff   float64       `gorm:"not null;default:0;type:decimal(5,2)" json:"percentOff"`
+	AmountOff    int64         `gorm:"not null;default:0" json:"amountOff"` // In cents
+	BuyQuantity  int           `gorm:"not null;default:0" json:"buyQuantity"`
+	GetQuantity  int           `gorm:"not null;default:0" json:"getQuantity"`
+	ProductID    *uint         `gorm:"index" json:"productId"`
+	CategoryID   *uint         `gorm:"index" json:"categoryId"`
+	MinSubtotal  int64         `gorm:"not null;default:0" json:"minSubtotal"`  // In cents
+	UsageLimit   int           `gorm:"not null;default:0" json:"usageLimit"`   // 0 means unlimited
+	PerUserLimit int           `gorm:"not null;default:0" json:"perUserLimit"` // 0 means unlimited
+	UsedCount    int           `gorm:"not null;default:0" json:"usedCount"`
+	StartsAt     *time.Time    `json:"startsAt"`
+	EndsAt       *time.Time    `json:"endsAt"`
+	Active       bool          `gorm:"not null;default:true" json:"active"`
+	CreatedAt    time.Time     `gorm:"default:now()" json:"createdAt"`
+	UpdatedAt    time.Time     `gorm:"default:now()" json:"updatedAt"`
+}
+
+// PromotionRedemption model - one use of a promotion by an order
+type PromotionRedemption struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	PromotionID uint      `gorm:"not null;index" json:"promotionId"`
+	UserID      *uint     `gorm:"index" json:"userId"` // Nil for guest orders
+	OrderID     uint      `gorm:"not null;index" json:"orderId"`
+	CreatedAt   time.Time `gorm:"default:now()" json:"createdAt"`
+}
+
+// OrderDiscount model - a promotion's share of an order's discount
+type OrderDiscount struct {
+	ID           uint          `gorm:"primaryKey" json:"id"`
+	OrderID      uint          `gorm:"not null;index" json:"orderId"`
+	PromotionID  uint          `gorm:"not null" json:"promotionId"`
+	Code         string        `gorm:"type:varchar(50)" json:"code,omitempty"`
+	Name         string        `gorm:"type:varchar(100)" json:"name"`
+	Type         PromotionType `gorm:"type:varchar(20)" json:"type"`
+	Amount       int64         `gorm:"not null" json:"amount"` // In cents
+	FreeShipping bool          `gorm:"not null;default:false" json:"freeShipping"`
+}
+
+// CheckoutQuote model - server side totals for a cart that checkout pays for.
+// CartHash fingerprints the cart so later changes invalidate the quote.
+type CheckoutQuote struct {
+	ID               uint       `gorm:"primaryKey" json:"id"`
+	UserID           *uint      `gorm:"index" json:"userId"`
+	GuestCartID      *uint      `gorm:"index" json:"guestCartId,omitempty"` // Set instead of UserID for guest checkout
+	GuestEmail       string     `gorm:"type:varchar(255)" json:"guestEmail,omitempty"`
+	GuestName        string     `gorm:"type:varchar(255)" json:"guestName,omitempty"`
+	CartHash         string     `gorm:"not null;type:varchar(64)" json:"-"`
+	AddressLine1     string     `gorm:"type:varchar(255)" json:"line1"`
+	AddressLine2     string     `gorm:"type:varchar(255)" json:"line2,omitempty"`
+	City             string     `gorm:"type:varchar(100)" json:"city"`
+	State            string     `gorm:"type:varchar(100)" json:"state"`
+	PostalCode       string     `gorm:"type:varchar(20)" json:"postalCode"`
+	Country          string     `gorm:"type:varchar(100)" json:"country"`
+	ShippingMethodID uint       `gorm:"not null;default:0" json:"shippingMethodId"`
+	CouponCode       string     `gorm:"type:varchar(50)" json:"couponCode,omitempty"`
+	Subtotal         int64      `gorm:"not null" json:"subtotal"` // In cents
+	Discount         int64      `gorm:"not null" json:"discount"` // In cents
+	Shipping         int64      `gorm:"not null" json:"shipping"` // In cents
+	Tax              int64      `gorm:"not null" json:"tax"`      // In cents, tax added on top of prices
+	Total            int64      `gorm:"not null" json:"total"`    // In cents
+	ExpiresAt        time.Time  `gorm:"not null" json:"expiresAt"`
+	UsedAt           *time.Time `json:"usedAt"`
+	CreatedAt        time.Time  `gorm:"default:now()" json:"createdAt"`
+}
+
+// OrderEvent model - one status change in an order's timeline
+type OrderEvent struct {
+	ID         uint        `gorm:"primaryKey" json:"id"`
+	OrderID    uint        `gorm:"not null;index" json:"orderId"`
+	FromStatus OrderStatus `gorm:"type:varchar(50)" json:"fromStatus"`
+	ToStatus   OrderStatus `gorm:"not null;type:varchar(50)" json:"toStatus"`
+	ActorID    *uint       `json:"actorId"`
+	ActorRole  string      `gorm:"not null;type:varchar(20)" json:"actorRole"` // customer, admin or system
+	Note       string      `gorm:"type:text" json:"note,omitempty"`
+	CreatedAt  time.Time   `gorm:"default:now()" json:"createdAt"`
+}
+
+// RefundStatus - Where a refund stands with the payment provider
+type RefundStatus string
+
+const (
+	RefundPending   RefundStatus = "pending" // Recorded, not confirmed by the payment provider yet
+	RefundSucceeded RefundStatus = "succeeded"
+	RefundFailed    RefundStatus = "failed" // Refused by the payment provider, needs staff attention
+)
+
+// Refund model - money returned to the customer through the payment provider
+type Refund struct {
+	ID               uint         `gorm:"primaryKey" json:"id"`
+	OrderID          uint         `gorm:"not null;index" json:"orderId"`
+	Amount           int64        `gorm:"not null" json:"amount"` // In cents
+	Reason           string       `gorm:"type:text" json:"reason"`
+	Status           RefundStatus `gorm:"not null;type:varchar(20);default:succeeded;index" json:"status"` // Refunds recorded before statuses existed were all issued
+	ProviderRefundID string       `gorm:"type:varchar(255)" json:"providerRefundId"`
+	Attempts         int          `gorm:"not null;default:0" json:"attempts"`
+	LastError        string       `gorm:"type:text" json:"lastError,omitempty"`
+	Shipping         int64        `gorm:"not null;default:0" json:"shipping"` // Part of Amount refunding shipping, in cents
+	CreatedByID      *uint        `json:"createdById"`
+	CreatedAt        time.Time    `gorm:"default:now()" json:"createdAt"`
+
+	Items []RefundItem `gorm:"foreignKey:RefundID" json:"items"`
+}
+
+// RefundItem model - units of an order item covered by a refund
+type RefundItem struct {
+	ID          uint  `gorm:"primaryKey" json:"id"`
+	RefundID    uint  `gorm:"not null;index" json:"refundId"`
+	OrderItemID uint  `gorm:"not null;index" json:"orderItemId"`
+	Quantity    int   `gorm:"not null" json:"quantity"`
+	Amount      int64 `gorm:"not null" json:"amount"`                // In cents
+	Cancelled   int   `gorm:"not null;default:0" json:"cancelled"`   // Units taken off what ships
+	Backordered int   `gorm:"not null;default:0" json:"backordered"` // Of the cancelled units, those still backordered
+}
+
+// Shipment model - a parcel sent for an order, orders can ship in several parcels
+type Shipment struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	OrderID        uint       `gorm:"not null;index" json:"orderId"`
+	Carrier        string     `gorm:"not null;type:varchar(50)" json:"carrier"`
+	TrackingNumber string     `gorm:"type:varchar(100)" json:"trackingNumber"`
+	TrackingURL    string     `gorm:"type:varchar(255)" json:"trackingUrl"`
+	ShippedAt      time.Time  `gorm:"default:now()" json:"shippedAt"`
+	DeliveredAt    *time.Time `json:"deliveredAt"`
+	CreatedByID    *uint      `json:"createdById"`
+	WarehouseID    *uint      `gorm:"index" json:"warehouseId"` // Where the parcel ships from
+	CreatedAt      time.Time  `gorm:"default:now()" json:"createdAt"`
+
+	Items []ShipmentItem `gorm:"foreignKey:ShipmentID" json:"items"`
+}
+
+// ShipmentItem model - units of an order item packed in a shipment
+type ShipmentItem struct {
+	ID          uint `gorm:"primaryKey" json:"id"`
+	ShipmentID  uint `gorm:"not null;index" json:"shipmentId"`
+	OrderItemID uint `gorm:"not null;index" json:"orderItemId"`
+	Quantity    int  `gorm:"not null" json:"quantity"`
+}
+
+// ReturnStatus - Where a return request is in the RMA workflow
+type ReturnStatus string
+
+const (
+	ReturnRequested ReturnStatus = "requested"
+	ReturnApproved  ReturnStatus = "approved"
+	ReturnRejected  ReturnStatus = "rejected"
+	ReturnReceived  ReturnStatus = "received"
+	ReturnRefunded  ReturnStatus = "refunded"
+)
+
+// returnTransitions - Statuses each return status may move to
+var returnTransitions = map[ReturnStatus][]ReturnStatus{
+	ReturnRequested: {ReturnApproved, ReturnRejected},
+	ReturnApproved:  {ReturnReceived, ReturnRejected},
+	ReturnReceived:  {ReturnRefunded, ReturnRejected},
+}
+
+// CanTransitionTo reports whether a return may move from s to next
+func (s ReturnStatus) CanTransitionTo(next ReturnStatus) bool {
+	for _, allowed := range returnTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// ReturnRequest model - a customer's request to send delivered items back (RMA)
+type ReturnRequest struct {
+	ID        uint         `gorm:"primaryKey" json:"id"`
+	OrderID   uint         `gorm:"not null;index" json:"orderId"`
+	UserID    uint         `gorm:"not null;index" json:"userId"`
+	Status    ReturnStatus `gorm:"not null;type:varchar(20);default:'requested'" json:"status"`
+	Reason    string       `gorm:"not null;type:text" json:"reason"`
+	AdminNote string       `gorm:"type:text" json:"adminNote,omitempty"`
+	RefundID  *uint        `json:"refundId"`
+	CreatedAt time.Time    `gorm:"default:now()" json:"createdAt"`
+	UpdatedAt time.Time    `gorm:"default:now()" json:"updatedAt"`
+
+	Items  []ReturnItem  `gorm:"foreignKey:ReturnRequestID" json:"items"`
+	Events []ReturnEvent `gorm:"foreignKey:ReturnRequestID" json:"events,omitempty"`
+}
+
+// ReturnItem model - units of an order item being returned
+type ReturnItem struct {
+	ID              uint   `gorm:"primaryKey" json:"id"`
+	ReturnRequestID uint   `gorm:"not null;index" json:"returnRequestId"`
+	OrderItemID     uint   `gorm:"not null;index" json:"orderItemId"`
+	Quantity        int    `gorm:"not null" json:"quantity"`
+	Reason          string `gorm:"type:text" json:"reason,omitempty"`
+	Condition       string `gorm:"type:varchar(50)" json:"condition,omitempty"` // Set on inspection, e.g. new, opened, damaged
+	Restocked       bool   `gorm:"not null;default:false" json:"restocked"`
+}
+
+// ReturnEvent model - one status change in a return's history
+type ReturnEvent struct {
+	ID              uint         `gorm:"primaryKey" json:"id"`
+	ReturnRequestID uint         `gorm:"not null;index" json:"returnRequestId"`
+	FromStatus      ReturnStatus `gorm:"type:varchar(20)" json:"fromStatus"`
+	ToStatus        ReturnStatus `gorm:"not null;type:varchar(20)" json:"toStatus"`
+	ActorID         *uint        `json:"actorId"`
+	ActorRole       string       `gorm:"not null;type:varchar(20)" json:"actorRole"`
+	Note            string       `gorm:"type:text" json:"note,omitempty"`
+	CreatedAt       time.Time    `gorm:"default:now()" json:"createdAt"`
+}
+
+// Invoice model - issued once per order, Sequence gives invoices gapless numbers
+type Invoice struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	OrderID       uint      `gorm:"not null;uniqueIndex" json:"orderId"`
+	Sequence      int64     `gorm:"not null;uniqueIndex" json:"sequence"`
+	Number        string    `gorm:"not null;uniqueIndex;type:varchar(50)" json:"number"`
+	SellerName    string    `gorm:"type:varchar(255)" json:"sellerName"` // Seller details as of issuing
+	SellerAddress string    `gorm:"type:text" json:"sellerAddress"`
+	SellerTaxID   string    `gorm:"type:varchar(100)" json:"sellerTaxId"`
+	SellerEmail   string    `gorm:"type:varchar(255)" json:"sellerEmail"`
+	Discount      int64     `gorm:"not null;default:0" json:"discount"` // Totals charged as of issuing, in cents
+	Shipping      int64     `gorm:"not null;default:0" json:"shipping"`
+	Tax           int64     `gorm:"not null;default:0" json:"tax"`
+	Total         int64     `gorm:"not null;default:0" json:"total"`
+	IssuedAt      time.Time `gorm:"default:now()" json:"issuedAt"`
+}
+
+// EmailJobStatus - Delivery state of a queued email
+type EmailJobStatus string
+
+const (
+	EmailPending EmailJobStatus = "pending"
+	EmailSending EmailJobStatus = "sending" // Claimed by a worker, due again if its lease runs out
+	EmailSent    EmailJobStatus = "sent"
+	EmailFailed  EmailJobStatus = "failed" // Gave up after the last attempt
+)
+
+// EmailJob model - a rendered email waiting in the outbox, queued in the same
+// transaction as the change it reports and delivered by the email worker
+type EmailJob struct {
+	ID            uint           `gorm:"primaryKey" json:"id"`
+	UserID        *uint          `gorm:"index" json:"userId"`
+	OrderID       *uint          `gorm:"index" json:"orderId"`
+	Template      string         `gorm:"not null;type:varchar(50)" json:"template"`
+	Locale        string         `gorm:"not null;type:varchar(10)" json:"locale"`
+	To            string         `gorm:"not null;type:varchar(255)" json:"to"`
+	Subject       string         `gorm:"not null;type:varchar(255)" json:"subject"`
+	TextBody      string         `gorm:"type:text" json:"textBody"`
+	HTMLBody      string         `gorm:"type:text" json:"htmlBody"`
+	Status        EmailJobStatus `gorm:"not null;type:varchar(20);default:'pending';index:idx_email_jobs_due,priority:1" json:"status"`
+	Attempts      int            `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt time.Time      `gorm:"not null;default:now();index:idx_email_jobs_due,priority:2" json:"nextAttemptAt"`
+	LastError     string         `gorm:"type:text" json:"lastError,omitempty"`
+	SentAt        *time.Time     `json:"sentAt"`
+	CreatedAt     time.Time      `gorm:"default:now()" json:"createdAt"`
+}
+
+// OrderNoteVisibility - Who can read an order note
+type OrderNoteVisibility string
+
+const (
+	NoteInternal OrderNoteVisibility = "internal" // Staff only
+	NoteCustomer OrderNoteVisibility = "customer" // Also shown to the customer
+)
+
+// OrderNote model - a staff comment or customer message attached to an order
+type OrderNote struct {
+	ID         uint                `gorm:"primaryKey" json:"id"`
+	OrderID    uint                `gorm:"not null;index" json:"orderId"`
+	Visibility OrderNoteVisibility `gorm:"not null;type:varchar(20);default:'internal'" json:"visibility"`
+	Kind       string              `gorm:"not null;type:varchar(30);default:'note'" json:"kind"` // note or gift_message
+	Body       string              `gorm:"not null;type:text" json:"body"`
+	AuthorID   *uint               `json:"authorId"`
+	AuthorRole string              `gorm:"not null;type:varchar(20)" json:"authorRole"` // customer or admin
+	CreatedAt  time.Time           `gorm:"default:now()" json:"createdAt"`
+}
+
+// GuestCart model - an anonymous visitor's cart, identified by a signed cart token
+type GuestCart struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt  time.Time `gorm:"default:now()" json:"createdAt"`
+	LastSeenAt time.Time `gorm:"default:now();index" json:"lastSeenAt"`
+
+	Items []Cart `gorm:"foreignKey:GuestCartID" json:"items"`
+}
+
+// Wishlist model - a named list of products a user parked for later
+type Wishlist struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;index" json:"userId"`
+	Name      string    `gorm:"not null;type:varchar(100)" json:"name"`
+	Shared    bool      `gorm:"not null;default:false" json:"shared"` // Viewable by anyone with the share link
+	CreatedAt time.Time `gorm:"default:now()" json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	Items []WishlistItem `gorm:"foreignKey:WishlistID" json:"items"`
+}
+
+// WishlistItem model - a product on a wishlist. AlertPrice and AlertOutOfStock
+// remember what the customer last saw so drops and restocks are announced once.
+type WishlistItem struct {
+	ID              uint      `gorm:"primaryKey" json:"id"`
+	WishlistID      uint      `gorm:"not null;uniqueIndex:idx_wishlist_items_product" json:"wishlistId"`
+	ProductID       uint      `gorm:"not null;uniqueIndex:idx_wishlist_items_product;index" json:"productId"`
+	AlertPrice      int64     `gorm:"not null;default:0" json:"-"` // In cents
+	AlertOutOfStock bool      `gorm:"not null;default:false" json:"-"`
+	AddedAt         time.Time `gorm:"default:now()" json:"addedAt"`
+
+	Product Product `gorm:"foreignKey:ProductID" json:"product"`
+}
+
+// AbandonedCart model - a cart left idle, recorded once per idle spell for
+// recovery emails and reporting
+type AbandonedCart struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	UserID         *uint      `gorm:"index" json:"userId"`
+	GuestCartID    *uint      `gorm:"index" json:"guestCartId,omitempty"`
+	Email          string     `gorm:"type:varchar(255)" json:"email,omitempty"` // Empty for guests who never gave one
+	Items          int        `gorm:"not null" json:"items"`                    // Units in the cart
+	Subtotal       int64      `gorm:"not null" json:"subtotal"`                 // In cents at detection
+	LastActivityAt time.Time  `gorm:"not null" json:"lastActivityAt"`
+	DetectedAt     time.Time  `gorm:"not null;default:now();index" json:"detectedAt"`
+	EmailJobID     *uint      `json:"emailJobId,omitempty"` // Recovery email, if one could be sent
+	ClickedAt      *time.Time `json:"clickedAt,omitempty"`  // First visit through the recovery link
+	RecoveredAt    *time.Time `json:"recoveredAt,omitempty"`
+	OrderID        *uint      `gorm:"index" json:"orderId,omitempty"` // Order that recovered the cart
+}
+
+// StockMovementType - Why a product's stock changed
+type StockMovementType string
+
+const (
+	StockReceipt      StockMovementType = "receipt" // Goods arrived from a supplier
+	StockSale         StockMovementType = "sale"
+	StockReturn       StockMovementType = "return" // Returned or refunded units put back on the shelf
+	StockCancellation StockMovementType = "cancellation"
+	StockAdjustment   StockMovementType = "adjustment" // Count corrections, either direction
+	StockDamage       StockMovementType = "damage"
+	StockTransfer     StockMovementType = "transfer" // Between warehouses, posted in pairs that cancel out
+)
+
+// Valid reports whether the type is a known stock movement type
+func (t StockMovementType) Valid() bool {
+	switch t {
+	case StockReceipt, StockSale, StockReturn, StockCancellation, StockAdjustment, StockDamage, StockTransfer:
+		return true
+	}
+	return false
+}
+
+// StockMovement model - one append-only change to a product's stock, a
+// product's movements add up to its stock
+type StockMovement struct {
+	ID          uint              `gorm:"primaryKey" json:"id"`
+	ProductID   uint              `gorm:"not null;index:idx_stock_movements_product,priority:1" json:"productId"` // No foreign key, the history outlives deleted products
+	WarehouseID *uint             `gorm:"index" json:"warehouseId"`                                               // Nil for stock not placed in a warehouse yet
+	Type        StockMovementType `gorm:"not null;type:varchar(20)" json:"type"`
+	Quantity    int               `gorm:"not null" json:"quantity"` // Negative removes stock
+	Balance     int               `gorm:"not null" json:"balance"`  // Stock right after the movement
+	Reason      string            `gorm:"type:text" json:"reason,omitempty"`
+	OrderID     *uint             `gorm:"index" json:"orderId,omitempty"`
+	ReturnID    *uint             `json:"returnId,omitempty"`
+	ActorID     *uint             `json:"actorId,omitempty"` // Staff member behind manual movements
+	CreatedAt   time.Time         `gorm:"default:now();index:idx_stock_movements_product,priority:2" json:"createdAt"`
+}
+
+// ReservationStatus - Where a stock reservation stands
+type ReservationStatus string
+
+const (
+	ReservationActive    ReservationStatus = "active"    // Units held while the customer pays
+	ReservationConverted ReservationStatus = "converted" // Paid, the units were sold
+	ReservationReleased  ReservationStatus = "released"  // Payment failed or timed out
+)
+
+// StockReservation model - units of a product held for a pending order until
+// its payment completes or the reservation expires
+type StockReservation struct {
+	ID          uint              `gorm:"primaryKey" json:"id"`
+	ProductID   uint              `gorm:"not null;index:idx_stock_reservations_product,priority:1" json:"productId"`
+	WarehouseID *uint             `gorm:"index" json:"warehouseId"` // Where the units were allocated
+	OrderID     uint              `gorm:"not null;index" json:"orderId"`
+	Quantity    int               `gorm:"not null" json:"quantity"`
+	Status      ReservationStatus `gorm:"not null;type:varchar(20);default:'active';index:idx_stock_reservations_product,priority:2;index:idx_stock_reservations_due,priority:1" json:"status"`
+	ExpiresAt   time.Time         `gorm:"not null;index:idx_stock_reservations_due,priority:2" json:"expiresAt"`
+	ResolvedAt  *time.Time        `json:"resolvedAt,omitempty"`
+	CreatedAt   time.Time         `gorm:"default:now()" json:"createdAt"`
+}
+
+// Warehouse model - a location stock is kept at and shipped from
+type Warehouse struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Code      string    `gorm:"not null;uniqueIndex;type:varchar(20)" json:"code"`
+	Name      string    `gorm:"not null;type:varchar(100)" json:"name"`
+	Country   string    `gorm:"type:varchar(100)" json:"country"`
+	State     string    `gorm:"type:varchar(100)" json:"state"`
+	Priority  int       `gorm:"not null;default:0" json:"priority"`  // Higher ships first
+	Active    bool      `gorm:"not null;default:true" json:"active"` // Inactive warehouses get no new allocations
+	CreatedAt time.Time `gorm:"default:now()" json:"createdAt"`
+	UpdatedAt time.Time `gorm:"default:now()" json:"updatedAt"`
+}
+
+// WarehouseStock model - units of a product held at one warehouse, a
+// product's levels add up to its stock
+type WarehouseStock struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	WarehouseID uint      `gorm:"not null;uniqueIndex:idx_warehouse_stocks_product,priority:1" json:"warehouseId"`
+	ProductID   uint      `gorm:"not null;uniqueIndex:idx_warehouse_stocks_product,priority:2;index" json:"productId"`
+	Quantity    int       `gorm:"not null;default:0" json:"quantity"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+
+	Warehouse *Warehouse `gorm:"foreignKey:WarehouseID" json:"warehouse,omitempty"`
+}
+
+// StockAlertType - What a stock alert warns about
+type StockAlertType string
+
+const (
+	StockAlertLow        StockAlertType = "low_stock"    // At or below the reorder threshold
+	StockAlertOutOfStock StockAlertType = "out_of_stock" // Nothing left to sell
+)
+
+// StockAlert model - a product crossing its reorder threshold or running
+// out, open until stock recovers
+type StockAlert struct {
+	ID               uint           `gorm:"primaryKey" json:"id"`
+	ProductID        uint           `gorm:"not null;index" json:"productId"` // No foreign key, like the ledger
+	Type             StockAlertType `gorm:"not null;type:varchar(20)" json:"type"`
+	Stock            int            `gorm:"not null" json:"stock"`     // Stock when the alert was raised
+	Threshold        int            `gorm:"not null" json:"threshold"` // Reorder threshold at the time
+	CreatedAt        time.Time      `gorm:"default:now()" json:"createdAt"`
+	AcknowledgedAt   *time.Time     `json:"acknowledgedAt,omitempty"`
+	AcknowledgedByID *uint          `json:"acknowledgedById,omitempty"`
+	ResolvedAt       *time.Time     `gorm:"index" json:"resolvedAt,omitempty"` // Stock went back above the threshold
+	DigestedAt       *time.Time     `gorm:"index" json:"digestedAt,omitempty"` // Included in a digest email
+}
+
+// StockSubscription model - a customer waiting to hear when an out of stock
+// product can be bought again
+type StockSubscription struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	ProductID  uint       `gorm:"not null;uniqueIndex:idx_stock_subscriptions_email,priority:1" json:"productId"`
+	Email      string     `gorm:"not null;type:varchar(255);uniqueIndex:idx_stock_subscriptions_email,priority:2" json:"email"`
+	UserID     *uint      `gorm:"index" json:"userId,omitempty"`
+	Locale     string     `gorm:"not null;type:varchar(10);default:'en'" json:"locale"`
+	CreatedAt  time.Time  `gorm:"default:now()" json:"createdAt"`
+	NotifiedAt *time.Time `json:"notifiedAt,omitempty"` // Nil while still waiting
 }
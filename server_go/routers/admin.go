@@ -5,14 +5,67 @@ import "github.com/go-chi/chi/v5"
 func (r *RouterContext) AdminRoute() {
 	r.v1Router.Group(func(adminRouter chi.Router) {
 		adminRouter.Use(r.handlerContext.AdminMiddleware)
+		adminRouter.Use(r.handlerContext.IdempotencyMiddleware)
 		adminRouter.Get("/admin/dashboard", r.handlerContext.GetDashboardData)
 		adminRouter.Delete("/admin/products/{id}", r.handlerContext.DeleteProduct)
 		adminRouter.Patch("/admin/products/{id}", r.handlerContext.UpdateProduct)
+		adminRouter.Get("/admin/products/{id}/stock-movements", r.handlerContext.GetStockMovements)
+		adminRouter.Post("/admin/products/{id}/stock-movements", r.handlerContext.CreateStockMovement)
+		adminRouter.Post("/admin/stock-transfers", r.handlerContext.CreateStockTransfer)
+		adminRouter.Get("/admin/stock-alerts", r.handlerContext.GetStockAlerts)
+		adminRouter.Post("/admin/stock-alerts/{id}/acknowledge", r.handlerContext.AcknowledgeStockAlert)
+		adminRouter.Get("/admin/warehouses", r.handlerContext.GetWarehouses)
+		adminRouter.Post("/admin/warehouses", r.handlerContext.CreateWarehouse)
+		adminRouter.Patch("/admin/warehouses/{id}", r.handlerContext.UpdateWarehouse)
+		adminRouter.Get("/admin/warehouses/{id}/stock", r.handlerContext.GetWarehouseStock)
 		adminRouter.Patch("/admin/order/{id}", r.handlerContext.UpdateOrderStatus)
 
 		adminRouter.Get("/admin/orders/{id}", r.handlerContext.GetOrder)
+		adminRouter.Get("/admin/orders/{id}/timeline", r.handlerContext.GetOrderTimelineAdmin)
+		adminRouter.Get("/admin/orders/{id}/invoice", r.handlerContext.GetInvoiceAdmin)
+		adminRouter.Get("/admin/orders/{id}/packing-slip", r.handlerContext.GetPackingSlipAdmin)
+		adminRouter.Get("/admin/orders/{id}/notes", r.handlerContext.GetOrderNotes)
+		adminRouter.Post("/admin/orders/{id}/notes", r.handlerContext.CreateOrderNote)
+		adminRouter.Delete("/admin/orders/{id}/notes/{noteId}", r.handlerContext.DeleteOrderNote)
+		adminRouter.Get("/admin/orders/{id}/refunds", r.handlerContext.GetRefunds)
+		adminRouter.Post("/admin/orders/{id}/refunds", r.handlerContext.CreateRefund)
+		adminRouter.Get("/admin/orders/{id}/shipments", r.handlerContext.GetShipments)
+		adminRouter.Post("/admin/orders/{id}/shipments", r.handlerContext.CreateShipment)
+		adminRouter.Post("/admin/shipments/{id}/deliver", r.handlerContext.MarkShipmentDelivered)
 		adminRouter.Get("/admin/orders", r.handlerContext.GetAllOrders)
+		adminRouter.Get("/admin/orders/export", r.handlerContext.ExportOrders)
+
+		adminRouter.Get("/admin/returns", r.handlerContext.GetReturns)
+		adminRouter.Get("/admin/returns/{id}", r.handlerContext.GetReturn)
+		adminRouter.Post("/admin/returns/{id}/approve", r.handlerContext.ApproveReturn)
+		adminRouter.Post("/admin/returns/{id}/reject", r.handlerContext.RejectReturn)
+		adminRouter.Post("/admin/returns/{id}/receive", r.handlerContext.ReceiveReturn)
+		adminRouter.Post("/admin/returns/{id}/refund", r.handlerContext.RefundReturn)
+
+		adminRouter.Get("/admin/emails", r.handlerContext.GetEmailJobs)
+		adminRouter.Post("/admin/emails/{id}/retry", r.handlerContext.RetryEmailJob)
+
+		adminRouter.Get("/admin/carts/abandoned", r.handlerContext.GetAbandonedCarts)
+		adminRouter.Get("/admin/carts/abandoned/metrics", r.handlerContext.GetAbandonedCartMetrics)
 
 		adminRouter.Patch("/admin/users/{id}", r.handlerContext.UpdateUserRole)
+
+		adminRouter.Get("/admin/tax-rules", r.handlerContext.GetTaxRules)
+		adminRouter.Post("/admin/tax-rules", r.handlerContext.CreateTaxRule)
+		adminRouter.Patch("/admin/tax-rules/{id}", r.handlerContext.UpdateTaxRule)
+		adminRouter.Delete("/admin/tax-rules/{id}", r.handlerContext.DeleteTaxRule)
+
+		adminRouter.Get("/admin/shipping-zones", r.handlerContext.GetShippingZones)
+		adminRouter.Post("/admin/shipping-zones", r.handlerContext.CreateShippingZone)
+		adminRouter.Patch("/admin/shipping-zones/{id}", r.handlerContext.UpdateShippingZone)
+		adminRouter.Delete("/admin/shipping-zones/{id}", r.handlerContext.DeleteShippingZone)
+		adminRouter.Post("/admin/shipping-zones/{id}/methods", r.handlerContext.CreateShippingMethod)
+		adminRouter.Patch("/admin/shipping-methods/{id}", r.handlerContext.UpdateShippingMethod)
+		adminRouter.Delete("/admin/shipping-methods/{id}", r.handlerContext.DeleteShippingMethod)
+
+		adminRouter.Get("/admin/promotions", r.handlerContext.GetPromotions)
+		adminRouter.Post("/admin/promotions", r.handlerContext.CreatePromotion)
+		adminRouter.Patch("/admin/promotions/{id}", r.handlerContext.UpdatePromotion)
+		adminRouter.Delete("/admin/promotions/{id}", r.handlerContext.DeletePromotion)
 	})
 }
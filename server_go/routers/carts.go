@@ -1,8 +1,10 @@
 package routers
 
 func (r *RouterContext) CartsRoute() {
-	r.v1Router.Post("/cart", r.handlerContext.AddToCart)
+	r.v1Router.With(r.handlerContext.IdempotencyMiddleware).Post("/cart", r.handlerContext.AddToCart)
 	r.v1Router.Get("/cart", r.handlerContext.GetCart)
+	r.v1Router.Post("/cart/accept-changes", r.handlerContext.AcceptCartChanges)
+	r.v1Router.Get("/cart/recover/{token}", r.handlerContext.RecoverCart)
     r.v1Router.Patch("/cart/{id}", r.handlerContext.UpdateCartItem)
     r.v1Router.Delete("/cart/{id}", r.handlerContext.RemoveFromCart)
 }
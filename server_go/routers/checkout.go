@@ -1,6 +1,8 @@
 package routers
 
 func (r *RouterContext) CheckoutRoute() {
-	r.v1Router.Post("/checkout", r.handlerContext.CreatePaymentIntent)
+	r.v1Router.With(r.handlerContext.IdempotencyMiddleware).Post("/checkout", r.handlerContext.CreatePaymentIntent)
+	r.v1Router.Post("/checkout/quote", r.handlerContext.CreateCheckoutQuote)
+	r.v1Router.Post("/checkout/webhook", r.handlerContext.HandlePaymentWebhook)
 
 }
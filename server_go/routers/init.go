@@ -19,7 +19,7 @@ func NewRouter(handlerContext handlers.HandlerContext) *chi.Mux {
 		AllowedOrigins:   []string{"http://*", "http://*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"*"},
-		ExposedHeaders:   []string{"Link"},
+		ExposedHeaders:   []string{"Link", "Idempotent-Replayed", "X-Cart-Token"},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}))
@@ -40,9 +40,12 @@ func NewRouter(handlerContext handlers.HandlerContext) *chi.Mux {
 	routerContext.CategoriesRoute()
 	routerContext.UsersRoute()
 	routerContext.CartsRoute()
-    routerContext.CheckoutRoute()
-    routerContext.OrderRoute()
-    routerContext.AdminRoute()
+	routerContext.CheckoutRoute()
+	routerContext.TaxRoute()
+	routerContext.ShippingRoute()
+	routerContext.OrderRoute()
+	routerContext.WishlistsRoute()
+	routerContext.AdminRoute()
 
 	// Connnect v1  routes to the main routes
 	router.Mount("/api/v1", routerContext.v1Router)
@@ -1,5 +1,14 @@
 package routers
 
-func(r *RouterContext) OrderRoute() {
-    r.v1Router.Get("/orders", r.handlerContext.GetOrders)
+func (r *RouterContext) OrderRoute() {
+	r.v1Router.With(r.handlerContext.AuthMiddleware).Get("/orders", r.handlerContext.GetOrders)
+	r.v1Router.With(r.handlerContext.AuthMiddleware).Get("/orders/{id}", r.handlerContext.GetUserOrder)
+	r.v1Router.Get("/orders/lookup/{token}", r.handlerContext.GetGuestOrder)
+	r.v1Router.With(r.handlerContext.AuthMiddleware).Post("/orders/lookup/{token}/claim", r.handlerContext.ClaimGuestOrder)
+	r.v1Router.With(r.handlerContext.AuthMiddleware).Get("/orders/{id}/timeline", r.handlerContext.GetOrderTimeline)
+	r.v1Router.With(r.handlerContext.AuthMiddleware).Get("/orders/{id}/invoice", r.handlerContext.GetInvoice)
+	r.v1Router.With(r.handlerContext.AuthMiddleware).Get("/orders/{id}/packing-slip", r.handlerContext.GetPackingSlip)
+	r.v1Router.With(r.handlerContext.AuthMiddleware, r.handlerContext.IdempotencyMiddleware).Post("/orders/{id}/cancel", r.handlerContext.CancelOrder)
+	r.v1Router.With(r.handlerContext.AuthMiddleware).Get("/orders/{id}/returns", r.handlerContext.GetOrderReturns)
+	r.v1Router.With(r.handlerContext.AuthMiddleware, r.handlerContext.IdempotencyMiddleware).Post("/orders/{id}/returns", r.handlerContext.CreateReturn)
 }
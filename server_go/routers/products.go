@@ -4,5 +4,6 @@ func (routerContext *RouterContext) ProductsRoute() {
 	routerContext.v1Router.Post("/products", routerContext.handlerContext.CreateProduct)
 	routerContext.v1Router.Get("/products", routerContext.handlerContext.GetProducts)
 	routerContext.v1Router.Get("/products/{id}", routerContext.handlerContext.GetProductByID)
+	routerContext.v1Router.Post("/products/{id}/notify-me", routerContext.handlerContext.SubscribeToStock)
 
 }
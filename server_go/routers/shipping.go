@@ -0,0 +1,5 @@
+package routers
+
+func (r *RouterContext) ShippingRoute() {
+	r.v1Router.Post("/shipping/rates", r.handlerContext.GetShippingRates)
+}
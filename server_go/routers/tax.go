@@ -0,0 +1,5 @@
+package routers
+
+func (r *RouterContext) TaxRoute() {
+	r.v1Router.Post("/tax/quote", r.handlerContext.GetTaxQuote)
+}
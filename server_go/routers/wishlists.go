@@ -0,0 +1,19 @@
+package routers
+
+import "github.com/go-chi/chi/v5"
+
+func (r *RouterContext) WishlistsRoute() {
+	r.v1Router.Get("/wishlists/shared/{token}", r.handlerContext.GetSharedWishlist)
+
+	r.v1Router.Group(func(wishlistRouter chi.Router) {
+		wishlistRouter.Use(r.handlerContext.AuthMiddleware)
+		wishlistRouter.Get("/wishlists", r.handlerContext.GetWishlists)
+		wishlistRouter.Post("/wishlists", r.handlerContext.CreateWishlist)
+		wishlistRouter.Patch("/wishlists/{id}", r.handlerContext.UpdateWishlist)
+		wishlistRouter.Delete("/wishlists/{id}", r.handlerContext.DeleteWishlist)
+		wishlistRouter.Post("/wishlists/{id}/items", r.handlerContext.AddWishlistItem)
+		wishlistRouter.Delete("/wishlists/{id}/items/{itemId}", r.handlerContext.RemoveWishlistItem)
+		wishlistRouter.Post("/wishlists/{id}/items/{itemId}/move-to-cart", r.handlerContext.MoveWishlistItemToCart)
+		wishlistRouter.Post("/wishlists/save-for-later", r.handlerContext.MoveCartItemToWishlist)
+	})
+}